@@ -21,12 +21,31 @@ import (
 	"flag"
 	"fmt"
 	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/daemon"
+	"github.com/stefan-kiss/genkubessl/internal/history"
+	"github.com/stefan-kiss/genkubessl/internal/hooks"
+	"github.com/stefan-kiss/genkubessl/internal/kubebootstrap"
 	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/kubeencrypt"
 	"github.com/stefan-kiss/genkubessl/internal/kubekeys"
+	"github.com/stefan-kiss/genkubessl/internal/local"
+	"github.com/stefan-kiss/genkubessl/internal/manifest"
+	"github.com/stefan-kiss/genkubessl/internal/metrics"
+	"github.com/stefan-kiss/genkubessl/internal/probe"
+	"github.com/stefan-kiss/genkubessl/internal/prune"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
 	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/verify"
+	"github.com/stefan-kiss/genkubessl/internal/webhookcerts"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
 //var (
@@ -40,6 +59,13 @@ const (
 ./genkubessl [-src source] [-dst destination] [command] [parameters...]
 commands:
 	kubecerts	generates kubernetes mtls certificates
+	rollback	restores the certificates and keys replaced by previous runs
+	local		runs on a node: installs the certificates of that node only, straight into its filesystem
+	webhookcerts	generates serving certificates for in-cluster admission webhooks
+	verify		audits the certificates and keys in the source without writing anything, exits 1 on findings
+	probe		compares the certificates served by the nodes with the stored ones, exits 1 unless all match
+	daemon		runs kubecerts periodically, renewing certificates as they get close to expiring
+	metrics		exports the expiry of the stored certificates and keys as prometheus metrics
 	cacert	    generates generate a ca and signed cert
 	nakedcert   generates a 'naked' self-signed certificate
 
@@ -92,20 +118,231 @@ note: first name for each node will be considered the node name (the hostname us
 `
 	UsersHelp = `
 OPTIONAL. If missing admin user will be created
-comma separated list of <user:group>
-format: <user/group>[,user/group]...
+comma separated list of <user:group>, optionally with an email address added to the cert alt names
+format: <user/group[/email]>[,user/group[/email]]...
 
-Example: "bob.john/admin-users,andrew.lewis/read-only,thomas.johnson/test-group"
+Example: "bob.john/admin-users/bob.john@example.org,andrew.lewis/read-only,thomas.johnson/test-group"
 note: this only creates certificates for the users, any RBAC rules you have to set separately
+`
+	TemplatesHelp = `
+OPTIONAL. JSON file declaring extra certificates, generated and checked like the built in ones
+format: a list of objects with the fields
+	Path		cert and key path without extension (required)
+	Parent		path of the signing CA, a built in one or one declared earlier in the file. Empty declares a new CA
+	Nodes		node roles getting their own copy: masters, workers, etcd. Empty for a global cert
+	CommonName	(required) and Organisation, templates where {{.NodeName}} is the node name
+	Usages		client and/or server
+	NodeSans, ApiSans	add the node or the api alt names
+	ExtraSans	additional alt names, templates as well, {{.ClusterDomain}} is the cluster DNS domain
+Example: [{"Path": "/etc/kubernetes/pki/etcd/calico-client", "Parent": "/etc/kubernetes/pki/etcd/ca",
+	"CommonName": "calico", "Usages": ["client"]}]
+`
+	PruneHelp = `
+OPTIONAL. Move nodes and files that are no longer part of the cluster definition
+from the destination storage into archive/<timestamp>/
+`
+	PruneListHelp = `
+OPTIONAL. Only list nodes and files that -prune would archive
+`
+	RevokeHelp = `
+OPTIONAL. Used with -prune: add pruned certificates to the revocation list (<ca>.crl) of their CA
 `
 	DestinationUrlHelp = `
 URL describing the location where to store the generated certificates
 if schema is missing it is interpreted as a file path
+private keys (*.key), manifests (*.yaml) and kubeconfigs (*.conf) holding secrets are encrypted at rest when either of these query parameters is given:
+	keyfile=<path>	passphrase is read from the given file
+	passenv=<name>	passphrase is read from the given environment variable
+file storage options can be given as query parameters as well:
+	owner=<user or uid>, group=<group or gid>
+	certmode=0644, keymode=0600, pubmode=0644, filemode=0600, dirmode=0755, rootdirmode=0755
+	config=<path>	file with one option=value per line
+Example: "outputs/system?passenv=GENKUBESSL_PASSPHRASE&group=kube&certmode=0644"
 Default "outputs/system"
+`
+	RotateSAHelp = `
+OPTIONAL. Replace the service account signing key (sa.key) even if it is valid.
+The public key of the replaced one stays in sa.pub for -sa-grace so issued tokens keep verifying
+`
+	SAGraceHelp = `
+OPTIONAL. How long the public keys of replaced service account signing keys are kept in sa.pub
+0 drops them right away, invalidating every token they signed
+`
+	SAKeyTypeHelp = `
+OPTIONAL. Type of the service account signing key: RSA, P224, P256, P384 or P521
+a key of another type is replaced (see -rotate-sa)
+Default: keep the type of the current key, RSA for a new one
+`
+	EncryptionProviderHelp = `
+OPTIONAL. Provider of the apiserver encryption at rest keys: aescbc, aesgcm or secretbox
+switching providers adds a key for the new one on top, keys of the old one are kept for decryption
+Default "aescbc"
+`
+	EncryptionResourcesHelp = `
+OPTIONAL. Comma separated list of resources encrypted at rest
+Default "secrets"
+`
+	RotateEncryptionHelp = `
+OPTIONAL. Add a new encryption at rest key on top, the current one is kept for decryption only
+`
+	RetireEncryptionHelp = `
+OPTIONAL. Drop every encryption at rest key but the current one
+only safe once every resource was rewritten with the current key (kubectl get secrets -A -o json | kubectl replace -f -)
+can not be used with -rotate-encryption, runs adding a key never retire the old ones
+`
+	BootstrapHelp = `
+OPTIONAL. Let workers get their kubelet client certificate through kubelet TLS bootstrapping:
+no kubelet client certificates are issued for workers, a bootstrap token is generated instead
+along with the Secret and RBAC manifest to apply (global/etc/kubernetes/bootstrap/bootstrap-token.yaml)
+and the bootstrap kubeconfig (etc/kubernetes/bootstrap-kubelet.conf) globally and for every worker
+`
+	BootstrapTTLHelp = `
+OPTIONAL. Validity of new bootstrap tokens, 0 for tokens that never expire
+tokens are replaced once they expire in less than an hour
+`
+	BootstrapGroupHelp = `
+OPTIONAL. Group bootstrapping kubelets are part of, must start with "system:bootstrappers:"
+`
+	ApiServerHelp = `
+OPTIONAL. Url of the apiserver used in generated kubeconfigs
+Default: https://<main api host, see -apisans>:6443
+`
+	LocalBootstrapHelp = `
+OPTIONAL. The node is a worker using kubelet TLS bootstrapping (see kubecerts -bootstrap):
+install etc/kubernetes/bootstrap-kubelet.conf instead of the kubelet client certificate
+`
+	WebhooksHelp = `
+MANDATORY
+comma separated list of the services serving admission webhooks
+format: <service>/<namespace>[,<service>/<namespace>]...
+
+for every webhook the destination gets, under global/webhooks/<namespace>/<service>/:
+	tls.crt, tls.key		the serving certificate
+	secret.yaml		the kubernetes.io/tls Secret <service>-tls holding them (and ca.crt)
+	cabundle-patch.json	JSON patch setting the caBundle of the webhook configuration:
+	kubectl patch validatingwebhookconfiguration <name> --type=json --patch-file cabundle-patch.json
+Example: "policy-webhook/policy-system,mutator/kube-system"
+`
+	WebhookCAHelp = `
+OPTIONAL. CA signing the webhook certificates: a built in one (like /etc/kubernetes/pki/ca), which must
+exist and be valid as it is never created nor replaced here, or a dedicated one under /webhooks/, created if missing
+Default "/webhooks/ca"
+`
+	ClusterDomainHelp = `
+OPTIONAL. DNS domain of the cluster
+Default "cluster.local"
+`
+	ServiceCIDRHelp = `
+OPTIONAL. Service network(s) of the cluster, one per address family for dual stack clusters
+the first address of each (the kubernetes service IP) is added to the apiserver alt names
+Example: "10.96.0.0/12,fd00:10:96::/112"
+Default "10.96.0.0/12"
+`
+	NameConstraintsHelp = `
+OPTIONAL. Add X.509 name constraints to the CA's created by this run, existing CA's are left alone
+the permitted DNS domains and IP ranges default to the ones derived from the certs each CA signs:
+the cluster domain, the domain of each node and the /24 (IPv4) or /64 (IPv6) network of each IP address
+`
+	PermittedDNSHelp = `
+OPTIONAL. With -name-constraints: comma separated DNS domains new CA's may issue certs for, replacing the derived ones
+Example: "example.org,cluster.local,localhost,kubernetes"
+`
+	ExcludedDNSHelp = `
+OPTIONAL. With -name-constraints: comma separated DNS domains new CA's may never issue certs for
+`
+	PermittedIPsHelp = `
+OPTIONAL. With -name-constraints: comma separated IP ranges new CA's may issue certs for, replacing the derived ones
+Example: "10.0.0.0/8,127.0.0.0/8,::1/128"
+`
+	ExcludedIPsHelp = `
+OPTIONAL. With -name-constraints: comma separated IP ranges new CA's may never issue certs for
+`
+	MinValidHelp = `
+OPTIONAL. Report certificates expiring within this long
+Default the time kubecerts renews certificates before they expire
+`
+	ProbeTimeoutHelp = `
+OPTIONAL. How long to wait for each endpoint to complete the TLS handshake
+`
+	RenewBeforeHelp = `
+OPTIONAL. Renew certificates expiring within this long
+`
+	ReissueUsagesHelp = `
+OPTIONAL. Reissue the certificates carrying no extended key usages (issued by earlier versions)
+on clusters created before usages were set this replaces every leaf certificate at once
+`
+	HookHelp = `
+OPTIONAL. Command run through /bin/sh once for the global area and once for every node the run changed files of
+It gets GENKUBESSL_NODE (empty for the global area), GENKUBESSL_ROLES, GENKUBESSL_CHANGED_FILES
+and GENKUBESSL_GENERATION in its environment and the same as JSON on stdin
+Example: "/usr/local/bin/restart-components.sh"
+`
+	HookTimeoutHelp = `
+OPTIONAL. Kill hooks still running after this long
+`
+	IntervalHelp = `
+OPTIONAL. Time between two daemon runs
+`
+	JitterHelp = `
+OPTIONAL. Spread the daemon runs by up to this fraction of -interval so nodes do not all run at once
+`
+	BackoffHelp = `
+OPTIONAL. Delay before retrying a failed daemon run, doubled on every further failure up to -interval
+`
+	HealthListenHelp = `
+OPTIONAL. Serve the daemon status on /healthz at this address, 503 until a run succeeded and while the last run failed
+Example: "127.0.0.1:9444"
+`
+	TextfileHelp = `
+OPTIONAL. Write the metrics to this file instead of stdout, for the node exporter textfile collector
+The file is replaced atomically. Example: "/var/lib/node_exporter/textfile/genkubessl.prom"
+`
+	ListenHelp = `
+OPTIONAL. Serve the metrics on /metrics at this address instead, collecting them on every scrape
+Example: ":9443"
+`
+	PatchWebhooksHelp = `
+OPTIONAL. Number of webhooks in the webhook configurations, the caBundle patch sets all of them
+`
+	NodeHelp = `
+OPTIONAL. Name of the node we are running on, as given in -masters, -workers or -etcd
+Default: the hostname
+`
+	RootHelp = `
+OPTIONAL. URL of the node filesystem root the certificates are installed into
+accepts the same file storage options as the destination url (-dst flag)
+Default "/"
+`
+	DetectIPsHelp = `
+OPTIONAL. Add the addresses of the node network interfaces to the node alt names.
+Container and overlay interfaces (docker0, cni0, flannel.1, cali*, ...) are skipped.
+The node certificates then differ from the ones kubecerts keeps for it in the shared storage
+`
+	DetectInterfacesHelp = `
+OPTIONAL. Used with -detect-ips: comma separated interfaces to take the addresses of, instead of all of them
+`
+	MaterializeHelp = `
+OPTIONAL. Also copy certificates and keys that are still valid from source to destination
+so the destination always holds the complete set (useful when -src and -dst differ)
+`
+	RollbackToHelp = `
+MANDATORY unless -list is given
+undo generation <to> and every later one, restoring files as they were before generation <to> ran
+`
+	RollbackListHelp = `
+OPTIONAL. list the generations kept in the destination history
+`
+	LockTimeoutHelp = `
+how long to wait for another genkubessl run holding the destination to finish
+`
+	HistoryKeepHelp = `
+how many history generations to keep in the destination, older ones are removed by the next run writing one.
+0 keeps them all
 `
 	SourceUrlHelp = `
 URL describing the location where to get the existing (if any) ca's and certificates'
 if schema is missing it is interpreted as a file path
+accepts the same encryption query parameters as the destination url (-dst flag)
 if missing it will be set to the same value as destination url (-dest flag)
 `
 )
@@ -120,17 +357,70 @@ func printusage(set *flag.FlagSet) {
 	os.Exit(2)
 }
 
+// absURL turns plain relative paths into absolute ones. Urls with a scheme are left alone.
+func absURL(storageURL string) string {
+	if strings.Contains(storageURL, "://") || filepath.IsAbs(storageURL) {
+		return storageURL
+	}
+	// TODO
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, storageURL)
+}
+
+func getStorage(storageURL string) storage.StoreDrv {
+	drv, err := storage.GetStorage(storageURL)
+	if err != nil {
+		log.Fatalf("error getting storage driver for %s: %v", storageURL, err)
+	}
+	return drv
+}
+
+// loadTemplates reads the extra certificate templates given with -templates
+func loadTemplates(templatesPath string) []kubecerts.CertTemplateConfig {
+	if templatesPath == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(templatesPath)
+	if err != nil {
+		log.Fatalf("error reading certificate templates: %v", err)
+	}
+	templates, err := kubecerts.ParseTemplates(content)
+	if err != nil {
+		log.Fatalf("error reading certificate templates from %s: %v", templatesPath, err)
+	}
+	return templates
+}
+
+// lockOwner describes this process for whoever finds the storage locked
+func lockOwner() string {
+	hostname, _ := os.Hostname()
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	return fmt.Sprintf("%s@%s pid %d since %s", username, hostname, os.Getpid(), time.Now().Format(time.RFC3339))
+}
+
 func main() {
 	var err error
 
 	src := flag.String("src", "", SourceUrlHelp)
 	dst := flag.String("dst", "outputs/system", DestinationUrlHelp)
+	lockTimeout := flag.Duration("lock-timeout", time.Minute, LockTimeoutHelp)
+	historyKeep := flag.Int("history-keep", 10, HistoryKeepHelp)
 
 	kubecertsCmd := flag.NewFlagSet("kubecerts", flag.ExitOnError)
 	cacrtCmd := flag.NewFlagSet("cacert", flag.ExitOnError)
 	nakedcrtCmd := flag.NewFlagSet("nakedcert", flag.ExitOnError)
 	nodecertsCmd := flag.NewFlagSet("nodecerts", flag.ExitOnError)
 	userconfigCmd := flag.NewFlagSet("userconfig", flag.ExitOnError)
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ExitOnError)
+	localCmd := flag.NewFlagSet("local", flag.ExitOnError)
+	webhookcertsCmd := flag.NewFlagSet("webhookcerts", flag.ExitOnError)
+	verifyCmd := flag.NewFlagSet("verify", flag.ExitOnError)
+	probeCmd := flag.NewFlagSet("probe", flag.ExitOnError)
+	metricsCmd := flag.NewFlagSet("metrics", flag.ExitOnError)
+	daemonCmd := flag.NewFlagSet("daemon", flag.ExitOnError)
 
 	flag.Parse()
 
@@ -140,62 +430,606 @@ func main() {
 	}
 	// TODO handle Parse() errors
 	switch flag.Arg(0) {
-	case "kubecerts":
+	case "kubecerts", "daemon":
+		// the daemon runs the kubecerts pipeline over and over, it takes the very same parameters
+		kubecertsCmd := kubecertsCmd
+		if flag.Arg(0) == "daemon" {
+			kubecertsCmd = daemonCmd
+		}
 		apisans := kubecertsCmd.String("apisans", "", ApiSansHelp)
 		masters := kubecertsCmd.String("masters", "", MastersHelp)
 		workers := kubecertsCmd.String("workers", "", WorkersHelp)
 		etcd := kubecertsCmd.String("etcd", "", EtcdHelp)
 		users := kubecertsCmd.String("users", "", UsersHelp)
+		templates := kubecertsCmd.String("templates", "", TemplatesHelp)
+		clusterDomain := kubecertsCmd.String("cluster-domain", kubecerts.DefaultClusterDomain, ClusterDomainHelp)
+		serviceCIDR := kubecertsCmd.String("service-cidr", "10.96.0.0/12", ServiceCIDRHelp)
+		nameConstraints := kubecertsCmd.Bool("name-constraints", false, NameConstraintsHelp)
+		permittedDNS := kubecertsCmd.String("permitted-dns", "", PermittedDNSHelp)
+		excludedDNS := kubecertsCmd.String("excluded-dns", "", ExcludedDNSHelp)
+		permittedIPs := kubecertsCmd.String("permitted-ips", "", PermittedIPsHelp)
+		excludedIPs := kubecertsCmd.String("excluded-ips", "", ExcludedIPsHelp)
+		pruneOrphans := kubecertsCmd.Bool("prune", false, PruneHelp)
+		pruneList := kubecertsCmd.Bool("prune-list", false, PruneListHelp)
+		revoke := kubecertsCmd.Bool("revoke", false, RevokeHelp)
+		materialize := kubecertsCmd.Bool("materialize", false, MaterializeHelp)
+		rotateSA := kubecertsCmd.Bool("rotate-sa", false, RotateSAHelp)
+		saGrace := kubecertsCmd.Duration("sa-grace", 30*24*time.Hour, SAGraceHelp)
+		saKeyType := kubecertsCmd.String("sa-keytype", "", SAKeyTypeHelp)
+		encProvider := kubecertsCmd.String("encryption-provider", "aescbc", EncryptionProviderHelp)
+		encResources := kubecertsCmd.String("encryption-resources", "secrets", EncryptionResourcesHelp)
+		rotateEnc := kubecertsCmd.Bool("rotate-encryption", false, RotateEncryptionHelp)
+		retireEnc := kubecertsCmd.Bool("retire-encryption", false, RetireEncryptionHelp)
+		bootstrap := kubecertsCmd.Bool("bootstrap", false, BootstrapHelp)
+		bootstrapTTL := kubecertsCmd.Duration("bootstrap-ttl", 24*time.Hour, BootstrapTTLHelp)
+		bootstrapGroup := kubecertsCmd.String("bootstrap-group", kubebootstrap.DefaultGroup, BootstrapGroupHelp)
+		apiServer := kubecertsCmd.String("api-server", "", ApiServerHelp)
+		renewBefore := kubecertsCmd.Duration("renew-before", kubecerts.CheckCertMinValid, RenewBeforeHelp)
+		reissueUsages := kubecertsCmd.Bool("reissue-usages", false, ReissueUsagesHelp)
+		hook := kubecertsCmd.String("hook", "", HookHelp)
+		hookTimeout := kubecertsCmd.Duration("hook-timeout", 5*time.Minute, HookTimeoutHelp)
+		var interval, backoff *time.Duration
+		var jitter *float64
+		var listen *string
+		if flag.Arg(0) == "daemon" {
+			interval = kubecertsCmd.Duration("interval", daemon.DefaultInterval, IntervalHelp)
+			jitter = kubecertsCmd.Float64("jitter", daemon.DefaultJitter, JitterHelp)
+			backoff = kubecertsCmd.Duration("backoff", daemon.DefaultBackoff, BackoffHelp)
+			listen = kubecertsCmd.String("listen", "", HealthListenHelp)
+		}
 
 		err = kubecertsCmd.Parse(flag.Args()[1:])
 		if err != nil {
 			printusage(kubecertsCmd)
 		}
+		if flag.Arg(0) == "daemon" {
+			if err = daemon.CheckFlags(kubecertsCmd); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if *rotateEnc && *retireEnc {
+			log.Fatal("-rotate-encryption and -retire-encryption can not be used together: " +
+				"retire the old keys once every resource was rewritten with the new one")
+		}
+		KeyConfig := kubekeys.KeyConfig{
+			Rotate:  *rotateSA,
+			Grace:   *saGrace,
+			KeyType: strings.ToUpper(*saKeyType),
+		}
+		EncryptionConfig := kubeencrypt.EncryptionConfig{
+			Provider:  *encProvider,
+			Resources: strings.Split(*encResources, ","),
+			Rotate:    *rotateEnc,
+			Retire:    *retireEnc,
+		}
 		ClusterConfig := kubecerts.ClusterConfig{
-			Apisans: apisans,
-			Masters: masters,
-			Workers: workers,
-			Etcd:    etcd,
-			Users:   users,
+			Apisans:       apisans,
+			Masters:       masters,
+			Workers:       workers,
+			Etcd:          etcd,
+			Users:         users,
+			Bootstrap:     *bootstrap,
+			Templates:     loadTemplates(*templates),
+			ClusterDomain: *clusterDomain,
+			ServiceCIDR:   *serviceCIDR,
+			RenewBefore:   *renewBefore,
+			ReissueUsages: *reissueUsages,
+			NameConstraints: kubecerts.NameConstraintsConfig{
+				Enabled:      *nameConstraints,
+				PermittedDNS: *permittedDNS,
+				ExcludedDNS:  *excludedDNS,
+				PermittedIPs: *permittedIPs,
+				ExcludedIPs:  *excludedIPs,
+			},
+		}
+		if *apiServer == "" {
+			*apiServer = kubebootstrap.DefaultServer(*apisans)
+		}
+		BootstrapConfig := kubebootstrap.BootstrapConfig{
+			Server: *apiServer,
+			TTL:    *bootstrapTTL,
+			Group:  *bootstrapGroup,
 		}
-		fmt.Printf("CERTS =>>\n")
 		if *src == "" {
 			*src = *dst
 		}
-		// TODO
-		cwd, _ := os.Getwd()
+		*src = absURL(*src)
+		*dst = absURL(*dst)
+		wrd := getStorage(*dst)
+		rdd := getStorage(*src)
+
+		// run goes through the whole pipeline once, nothing reaches the destination unless all of it succeeds
+		run := func() (hist *history.Generation, err error) {
+			kubecerts.Reset()
+			kubekeys.Reset()
+			kubeencrypt.Reset()
+			kubebootstrap.Reset()
+			prune.Reset()
+
+			fmt.Printf("CERTS =>>\n")
+			// the lock is dropped by the OS should we exit early
+			release, err := wrd.Lock(lockOwner(), *lockTimeout)
+			if err != nil {
+				return nil, fmt.Errorf("error locking %s: %v", *dst, err)
+			}
+			defer func() {
+				if err := release(); err != nil {
+					log.Printf("error unlocking %s: %v", *dst, err)
+				}
+			}()
+
+			stage := storage.NewStoreStage(wrd)
+			hist, err = history.Begin(stage)
+			if err != nil {
+				return nil, fmt.Errorf("error reading history of %s: %v", *dst, err)
+			}
+			hist.Keep = *historyKeep
+
+			GlobalConfig := config.GlobalConfig{
+				WriteDriver: stage,
+				ReadDriver:  rdd,
+				History:     hist,
+				Materialize: *materialize,
+			}
+
+			err = kubecerts.Execute(GlobalConfig, ClusterConfig)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("KEYS =>>\n")
+
+			err = kubekeys.CheckCreateKeys(GlobalConfig, KeyConfig)
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("ENCRYPTION =>>\n")
+			err = kubeencrypt.CheckCreateConfig(GlobalConfig, EncryptionConfig)
+			if err != nil {
+				return nil, err
+			}
+			if *bootstrap {
+				fmt.Printf("BOOTSTRAP =>>\n")
+				var caPEM []byte
+				for _, ca := range kubecerts.CertificateAuthorities() {
+					if ca.WritePath == filepath.Join(kubecerts.GlobalPath, "/etc/kubernetes/pki/ca") {
+						caPEM = sslutil.EncodeCertPEM(ca.Cert)
+					}
+				}
+				workers := make([]string, 0, len(kubecerts.KubeHosts["workers"]))
+				for worker := range kubecerts.KubeHosts["workers"] {
+					workers = append(workers, worker)
+				}
+				sort.Strings(workers)
+				err = kubebootstrap.CheckCreateToken(GlobalConfig, BootstrapConfig, caPEM, workers)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			expected := append(kubecerts.StoredFiles(), kubekeys.StoredFiles()...)
+			expected = append(expected, kubeencrypt.StoredFiles()...)
+			expected = append(expected, kubebootstrap.StoredFiles()...)
+			if *pruneOrphans || *pruneList {
+				fmt.Printf("PRUNE =>>\n")
+				err = prune.Execute(GlobalConfig, expected, *pruneList, *revoke)
+				if err != nil {
+					return nil, fmt.Errorf("error pruning %s: %v", *dst, err)
+				}
+			}
+			runManifest, err := manifest.Build(GlobalConfig, expected, kubecerts.KubeHosts)
+			if err != nil {
+				return nil, err
+			}
+			written, err := manifest.Write(stage, runManifest)
+			if err != nil {
+				return nil, fmt.Errorf("error writing manifest to %s: %v", *dst, err)
+			}
+			if written {
+				fmt.Printf("FILE SAVED : [%-30s] [%-50s]\n", "", manifest.ManifestPath)
+			}
+			err = hist.Commit()
+			if err != nil {
+				return nil, fmt.Errorf("error writing history to %s: %v", *dst, err)
+			}
+			err = stage.Commit()
+			if err != nil {
+				return nil, fmt.Errorf("error writing to %s: %v", *dst, err)
+			}
+			return hist, nil
+		}
+		globalChanged := func() bool {
+			return kubecerts.Changed || kubekeys.Changed || kubeencrypt.Changed || kubebootstrap.Changed || prune.Changed
+		}
+		// events whose hook failed, delivered again after the next run
+		pendingHooks := hooks.NewPending()
+		// runHooks runs the hook for the global area and every node the run wrote to
+		runHooks := func(hist *history.Generation) error {
+			if *hook == "" {
+				return nil
+			}
+			pendingHooks.Add(hooks.Events(hist, kubecerts.KubeHosts))
+			if len(pendingHooks.Events()) == 0 {
+				return nil
+			}
+			fmt.Printf("HOOKS =>>\n")
+			return pendingHooks.Deliver(*hook, *hookTimeout)
+		}
+
+		if flag.Arg(0) == "daemon" {
+			DaemonConfig := daemon.DaemonConfig{
+				Interval: *interval,
+				Jitter:   *jitter,
+				Backoff:  *backoff,
+				Listen:   *listen,
+			}
+			err = daemon.Execute(DaemonConfig, func() (changed bool, err error) {
+				hist, err := run()
+				if err != nil {
+					return false, err
+				}
+				if len(hist.Files) > 0 {
+					fmt.Printf("\nHISTORY_GENERATION: %d\n", hist.Generation)
+				}
+				if globalChanged() {
+					fmt.Printf("\nGLOBAL_CHANGED: TRUE\n")
+				} else {
+					fmt.Printf("\nGLOBAL_CHANGED: FALSE\n")
+				}
+				// the hooks that failed are run again after the next run, failing it meanwhile brings it sooner
+				if err = runHooks(hist); err != nil {
+					return globalChanged(), fmt.Errorf("changes stored but hooks will be retried: %v", err)
+				}
+				return globalChanged(), nil
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}
+
+		hist, err := run()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(hist.Files) > 0 {
+			fmt.Printf("\nHISTORY_GENERATION: %d\n", hist.Generation)
+		}
+		if globalChanged() {
+			fmt.Printf("\nGLOBAL_CHANGED: TRUE\n")
+		} else {
+			fmt.Printf("\nGLOBAL_CHANGED: FALSE\n")
+		}
+		if err = runHooks(hist); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	case "rollback":
+		to := rollbackCmd.Int("to", 0, RollbackToHelp)
+		list := rollbackCmd.Bool("list", false, RollbackListHelp)
+
+		err = rollbackCmd.Parse(flag.Args()[1:])
+		if err != nil || (*to < 1 && !*list) {
+			printusage(rollbackCmd)
+		}
+		*dst = absURL(*dst)
+		wrd := getStorage(*dst)
 
-		if !filepath.IsAbs(*src) {
-			*src = filepath.Join(cwd, *src)
+		if *list {
+			generations, err := history.Generations(wrd)
+			if err != nil {
+				log.Fatalf("error reading history of %s: %v", *dst, err)
+			}
+			for _, generation := range generations {
+				meta, err := history.Load(wrd, generation)
+				if err != nil {
+					log.Fatalf("error reading history of %s: %v", *dst, err)
+				}
+				fmt.Printf("GENERATION : [%-5d] [%s]\n", meta.Generation, meta.Time.Format(time.RFC3339))
+				for _, entry := range meta.Files {
+					fmt.Printf("    %-60s => %q\n", entry.Path, entry.Reason)
+				}
+			}
+			os.Exit(0)
 		}
 
-		if !filepath.IsAbs(*dst) {
-			*dst = filepath.Join(cwd, *dst)
+		release, err := wrd.Lock(lockOwner(), *lockTimeout)
+		if err != nil {
+			log.Fatalf("error locking %s: %v", *dst, err)
 		}
-		wrd, err := storage.GetStorage(*dst)
+		stage := storage.NewStoreStage(wrd)
+		restored, err := history.Rollback(stage, *to)
 		if err != nil {
-			log.Fatalf("error getting storage driver for %s: %v", *dst, err)
+			log.Fatalf("error rolling back %s: %v", *dst, err)
 		}
-		rdd, err := storage.GetStorage(*src)
+		err = stage.Commit()
 		if err != nil {
-			log.Fatalf("error getting storage driver for %s: %v", *src, err)
+			log.Fatalf("error writing to %s: %v", *dst, err)
 		}
+		if err = release(); err != nil {
+			log.Printf("error unlocking %s: %v", *dst, err)
+		}
+		for _, entry := range restored {
+			if entry.Existed {
+				fmt.Printf("RESTORED   : [%-50s]\n", entry.Path)
+			} else {
+				fmt.Printf("REMOVED    : [%-50s]\n", entry.Path)
+			}
+		}
+		os.Exit(0)
+	case "local":
+		hostname, _ := os.Hostname()
+		apisans := localCmd.String("apisans", "", ApiSansHelp)
+		masters := localCmd.String("masters", "", MastersHelp)
+		workers := localCmd.String("workers", "", WorkersHelp)
+		etcd := localCmd.String("etcd", "", EtcdHelp)
+		node := localCmd.String("node", hostname, NodeHelp)
+		root := localCmd.String("root", "/", RootHelp)
+		detectIPs := localCmd.Bool("detect-ips", false, DetectIPsHelp)
+		detectInterfaces := localCmd.String("detect-interfaces", "", DetectInterfacesHelp)
+		bootstrap := localCmd.Bool("bootstrap", false, LocalBootstrapHelp)
+		templates := localCmd.String("templates", "", TemplatesHelp)
+		clusterDomain := localCmd.String("cluster-domain", kubecerts.DefaultClusterDomain, ClusterDomainHelp)
+		serviceCIDR := localCmd.String("service-cidr", "10.96.0.0/12", ServiceCIDRHelp)
+
+		err = localCmd.Parse(flag.Args()[1:])
+		if err != nil || *node == "" {
+			printusage(localCmd)
+		}
+		// hostnames may come in upper case, node names in the cluster definition never do
+		*node = kubecerts.NormalizeName(*node)
+		ClusterConfig := kubecerts.ClusterConfig{
+			Apisans:       apisans,
+			Masters:       masters,
+			Workers:       workers,
+			Etcd:          etcd,
+			Node:          *node,
+			Bootstrap:     *bootstrap,
+			Templates:     loadTemplates(*templates),
+			ClusterDomain: *clusterDomain,
+			ServiceCIDR:   *serviceCIDR,
+		}
+		if *detectIPs {
+			var names []string
+			if *detectInterfaces != "" {
+				names = strings.Split(*detectInterfaces, ",")
+			}
+			ClusterConfig.ExtraNodeSans, err = local.DetectIPs(names)
+			if err != nil {
+				log.Fatalf("error detecting node addresses: %v", err)
+			}
+		}
+		if *src == "" {
+			*src = *dst
+		}
+		*src = absURL(*src)
+		*root = absURL(*root)
+
+		rootDrv := getStorage(*root)
+		err = rootDrv.SetConfigValue("lockfile", local.DefaultLockFile)
+		if err != nil {
+			log.Fatalf("error configuring %s: %v", *root, err)
+		}
+		release, err := rootDrv.Lock(lockOwner(), *lockTimeout)
+		if err != nil {
+			log.Fatalf("error locking %s: %v", *root, err)
+		}
+		stage := storage.NewStoreStage(rootDrv)
+		localDrv := local.NewStoreLocal(*node, stage, getStorage(*src))
 
 		GlobalConfig := config.GlobalConfig{
-			WriteDriver: wrd,
-			ReadDriver:  rdd,
+			WriteDriver:    localDrv,
+			ReadDriver:     localDrv,
+			ReadOnlyGlobal: true,
+		}
+
+		fmt.Printf("CERTS =>>\n")
+		err = kubecerts.Execute(GlobalConfig, ClusterConfig)
+		if err != nil {
+			log.Fatalf("error generating certificates for %s: %v", *node, err)
+		}
+		fmt.Printf("FILES =>>\n")
+		roles := kubecerts.NodeRoles(kubecerts.KubeHosts, *node)
+		if _, worker := kubecerts.KubeHosts["workers"][*node]; worker && *bootstrap {
+			roles = append(roles, "bootstrap")
+		}
+		err = local.Install(localDrv, roles)
+		if err != nil {
+			log.Fatalf("error installing files on %s: %v", *node, err)
 		}
+		err = stage.Commit()
+		if err != nil {
+			log.Fatalf("error writing to %s: %v", *root, err)
+		}
+		if err = release(); err != nil {
+			log.Printf("error unlocking %s: %v", *root, err)
+		}
+		if kubecerts.Changed || local.Changed {
+			fmt.Printf("\nNODE_CHANGED: TRUE\n")
+		} else {
+			fmt.Printf("\nNODE_CHANGED: FALSE\n")
+		}
+		os.Exit(0)
+	case "webhookcerts":
+		webhooks := webhookcertsCmd.String("webhooks", "", WebhooksHelp)
+		webhookCA := webhookcertsCmd.String("ca", webhookcerts.DefaultCA, WebhookCAHelp)
+		clusterDomain := webhookcertsCmd.String("cluster-domain", kubecerts.DefaultClusterDomain, ClusterDomainHelp)
+		patchWebhooks := webhookcertsCmd.Int("patch-webhooks", 1, PatchWebhooksHelp)
+		materialize := webhookcertsCmd.Bool("materialize", false, MaterializeHelp)
+
+		err = webhookcertsCmd.Parse(flag.Args()[1:])
+		if err != nil || *patchWebhooks < 1 {
+			printusage(webhookcertsCmd)
+		}
+		parsed, err := webhookcerts.ParseWebhooks(*webhooks)
+		if err != nil {
+			log.Fatalf("error parsing -webhooks: %v", err)
+		}
+		WebhookConfig := webhookcerts.WebhookConfig{
+			Webhooks:      parsed,
+			ClusterDomain: *clusterDomain,
+			CA:            *webhookCA,
+			PatchWebhooks: *patchWebhooks,
+		}
+		fmt.Printf("CERTS =>>\n")
+		if *src == "" {
+			*src = *dst
+		}
+		*src = absURL(*src)
+		*dst = absURL(*dst)
+		wrd := getStorage(*dst)
+		rdd := getStorage(*src)
 
-		_ = kubecerts.Execute(GlobalConfig, ClusterConfig)
-		fmt.Printf("KEYS =>>\n")
+		release, err := wrd.Lock(lockOwner(), *lockTimeout)
+		if err != nil {
+			log.Fatalf("error locking %s: %v", *dst, err)
+		}
+		stage := storage.NewStoreStage(wrd)
+		hist, err := history.Begin(stage)
+		if err != nil {
+			log.Fatalf("error reading history of %s: %v", *dst, err)
+		}
+		hist.Keep = *historyKeep
+		GlobalConfig := config.GlobalConfig{
+			WriteDriver: stage,
+			ReadDriver:  rdd,
+			History:     hist,
+			Materialize: *materialize,
+		}
 
-		_ = kubekeys.CheckCreateKeys(GlobalConfig)
-		if kubecerts.Changed || kubekeys.Changed {
+		err = webhookcerts.Execute(GlobalConfig, WebhookConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = hist.Commit()
+		if err != nil {
+			log.Fatalf("error writing history to %s: %v", *dst, err)
+		}
+		err = stage.Commit()
+		if err != nil {
+			log.Fatalf("error writing to %s: %v", *dst, err)
+		}
+		if err = release(); err != nil {
+			log.Printf("error unlocking %s: %v", *dst, err)
+		}
+		if len(hist.Files) > 0 {
+			fmt.Printf("\nHISTORY_GENERATION: %d\n", hist.Generation)
+		}
+		if kubecerts.Changed || webhookcerts.Changed {
 			fmt.Printf("\nGLOBAL_CHANGED: TRUE\n")
 		} else {
 			fmt.Printf("\nGLOBAL_CHANGED: FALSE\n")
 		}
 		os.Exit(0)
+	case "verify":
+		templates := verifyCmd.String("templates", "", TemplatesHelp)
+		minValid := verifyCmd.Duration("min-valid", kubecerts.CheckCertMinValid, MinValidHelp)
+
+		err = verifyCmd.Parse(flag.Args()[1:])
+		if err != nil {
+			printusage(verifyCmd)
+		}
+		VerifyConfig := verify.VerifyConfig{
+			Templates: loadTemplates(*templates),
+			MinValid:  *minValid,
+		}
+		if *src == "" {
+			*src = *dst
+		}
+		*src = absURL(*src)
+
+		fmt.Printf("VERIFY =>>\n")
+		findings, err := verify.Execute(getStorage(*src), VerifyConfig)
+		if err != nil {
+			log.Fatalf("error verifying %s: %v", *src, err)
+		}
+		fmt.Printf("\nFINDINGS: %d\n", len(findings))
+		if len(findings) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "probe":
+		apisans := probeCmd.String("apisans", "", ApiSansHelp)
+		masters := probeCmd.String("masters", "", MastersHelp)
+		workers := probeCmd.String("workers", "", WorkersHelp)
+		etcd := probeCmd.String("etcd", "", EtcdHelp)
+		timeout := probeCmd.Duration("timeout", 5*time.Second, ProbeTimeoutHelp)
+
+		err = probeCmd.Parse(flag.Args()[1:])
+		if err != nil {
+			printusage(probeCmd)
+		}
+		hosts, err := kubecerts.ParseHosts(apisans, masters, workers, etcd)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *src == "" {
+			*src = *dst
+		}
+		*src = absURL(*src)
+
+		fmt.Printf("PROBE =>>\n")
+		results, err := probe.Execute(getStorage(*src), probe.Targets(hosts), *timeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		failed := 0
+		for _, result := range results {
+			if result.Status != probe.Match {
+				failed++
+			}
+		}
+		fmt.Printf("\nNOT_MATCHING: %d\n", failed)
+		if failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "metrics":
+		textfile := metricsCmd.String("textfile", "", TextfileHelp)
+		listen := metricsCmd.String("listen", "", ListenHelp)
+
+		err = metricsCmd.Parse(flag.Args()[1:])
+		if err != nil {
+			printusage(metricsCmd)
+		}
+		if *textfile != "" && *listen != "" {
+			log.Fatal("-textfile and -listen are mutually exclusive")
+		}
+		if *src == "" {
+			*src = *dst
+		}
+		*src = absURL(*src)
+		drv := getStorage(*src)
+
+		if *listen != "" {
+			http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+				content, err := metrics.Collect(drv)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.Header().Set("Content-Type", metrics.ContentType)
+				_, _ = w.Write(content)
+			})
+			log.Fatal(http.ListenAndServe(*listen, nil))
+		}
+
+		content, err := metrics.Collect(drv)
+		if err != nil {
+			log.Fatalf("error collecting metrics from %s: %v", *src, err)
+		}
+		if *textfile == "" {
+			_, _ = os.Stdout.Write(content)
+			os.Exit(0)
+		}
+		// the collector may read the file any time, never let it see a partial one
+		tmp := *textfile + ".tmp"
+		if err = ioutil.WriteFile(tmp, content, 0644); err != nil {
+			log.Fatal(err)
+		}
+		if err = os.Rename(tmp, *textfile); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
 	case "nodecerts":
 		err = nodecertsCmd.Parse(flag.Args()[1:])
 		if err != nil {
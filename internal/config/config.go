@@ -1,8 +1,22 @@
 package config
 
-import "github.com/stefan-kiss/genkubessl/internal/storage"
+import (
+	"github.com/stefan-kiss/genkubessl/internal/history"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+)
 
 type GlobalConfig struct {
 	WriteDriver storage.StoreDrv
 	ReadDriver  storage.StoreDrv
+	// History keeps what the run replaces, nil disables it
+	History *history.Generation
+	// Materialize copies certs and keys that pass validation from ReadDriver to
+	// WriteDriver so the destination always holds the complete set
+	Materialize bool
+	// ReadOnlyGlobal forbids (re)generating anything in the global area,
+	// a failing global file is an error instead (local mode)
+	ReadOnlyGlobal bool
+	// ReadOnlyCerts lists the template paths of certs that are only read, never (re)generated:
+	// a missing or failing one is an error instead
+	ReadOnlyCerts []string
 }
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"path"
+	"strings"
+)
+
+// CheckWrite writes content to filePath, a file of node (of the global area when empty), unless it is already
+// there (in the destination as well when materializing). reason is what the file is written for, when empty
+// it is the content having changed or the file not being readable. written tells whether the file was written.
+func CheckWrite(GlobalCfg GlobalConfig, node string, filePath string, content []byte, reason string) (written bool, err error) {
+	name := strings.TrimPrefix(filePath, storage.GlobalPath)
+	if node != "" {
+		name = strings.TrimPrefix(filePath, path.Join(storage.NodesPath, node))
+	}
+
+	current, err := GlobalCfg.ReadDriver.Read(filePath)
+	if err != nil && !storage.IsNotExist(err) {
+		return false, fmt.Errorf("error loading %s: %v", filePath, err)
+	}
+	if err == nil && bytes.Equal(current, content) && reason == "" {
+		fmt.Printf("FILE OK    : [%-30s] [%-50s]\n", node, name)
+		if !GlobalCfg.Materialize {
+			return false, nil
+		}
+		if stored, err := GlobalCfg.WriteDriver.Read(filePath); err == nil && bytes.Equal(stored, content) {
+			return false, nil
+		}
+		reason = "materialized from source"
+	}
+	if reason == "" && err == nil {
+		reason = "content changed"
+	} else if reason == "" {
+		reason = storage.ReadFailure("file", err)
+	}
+	if err = GlobalCfg.History.Save(filePath, reason); err != nil {
+		return false, err
+	}
+	if err = GlobalCfg.WriteDriver.Write(filePath, content); err != nil {
+		return false, fmt.Errorf("error writing %s: %v", filePath, err)
+	}
+	fmt.Printf("FILE SAVED : [%-30s] [%-50s] => %q\n", node, name, reason)
+	return true, nil
+}
@@ -0,0 +1,254 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package daemon
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultInterval = time.Hour
+	DefaultJitter   = 0.1
+	DefaultBackoff  = 30 * time.Second
+
+	// how long a shutdown waits for health checks in flight
+	shutdownTimeout = 5 * time.Second
+)
+
+// OneShotFlags are the kubecerts flags asking for an action rather than a state. Every run
+// would repeat it: the service account key would be rotated and encryption keys retired over and over.
+var OneShotFlags = []string{"rotate-sa", "rotate-encryption", "retire-encryption"}
+
+// CheckFlags rejects the OneShotFlags turned on from the command line, they are for kubecerts only
+func CheckFlags(set *flag.FlagSet) (err error) {
+	var given []string
+	set.Visit(func(f *flag.Flag) {
+		for _, name := range OneShotFlags {
+			if f.Name == name && f.Value.String() != "false" {
+				given = append(given, "-"+name)
+			}
+		}
+	})
+	if len(given) > 0 {
+		return fmt.Errorf("%s can not be used in daemon mode, every run would repeat it: run kubecerts once instead", strings.Join(given, ", "))
+	}
+	return nil
+}
+
+// DaemonConfig controls how often the pipeline runs
+type DaemonConfig struct {
+	// Interval between two runs that succeeded
+	Interval time.Duration
+	// Jitter spreads the runs of several daemons: the first run is delayed by up to Jitter * Interval
+	// and every interval is stretched or shrunk by as much
+	Jitter float64
+	// Backoff is the delay after the first failed run, doubled on every further failure up to Interval
+	Backoff time.Duration
+	// Listen is the address /healthz is served on, nothing is served when empty
+	Listen string
+}
+
+// Status of the daemon, as served on /healthz. The times are nil (and left out) until they happened.
+type Status struct {
+	Runs        int        `json:"runs"`
+	Failures    int        `json:"consecutive_failures"`
+	LastRun     *time.Time `json:"last_run,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastChange  *time.Time `json:"last_change,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	NextRun     *time.Time `json:"next_run,omitempty"`
+}
+
+// RunFunc runs the pipeline once, changed tells whether anything was written (even when it failed later on)
+type RunFunc func() (changed bool, err error)
+
+type Daemon struct {
+	Config DaemonConfig
+	run    RunFunc
+
+	mu     sync.Mutex
+	status Status
+	rand   *rand.Rand
+}
+
+func New(cfg DaemonConfig, run RunFunc) *Daemon {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = DefaultBackoff
+	}
+	if cfg.Jitter < 0 {
+		cfg.Jitter = 0
+	}
+	return &Daemon{
+		Config: cfg,
+		run:    run,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid()))),
+	}
+}
+
+// Status returns a copy of the current status
+func (d *Daemon) Status() Status {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// jitter returns a random duration within [-max, max)
+func (d *Daemon) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(d.rand.Int63n(2*int64(max))) - max
+}
+
+// delay returns how long to wait after a run that failed `failures` times in a row
+func (d *Daemon) delay(failures int) time.Duration {
+	if failures == 0 {
+		return d.Config.Interval + d.jitter(time.Duration(float64(d.Config.Interval)*d.Config.Jitter))
+	}
+	backoff := d.Config.Backoff
+	for idx := 1; idx < failures && backoff < d.Config.Interval; idx++ {
+		backoff *= 2
+	}
+	if backoff > d.Config.Interval {
+		backoff = d.Config.Interval
+	}
+	return backoff
+}
+
+// once runs the pipeline and returns how long to wait for the next run
+func (d *Daemon) once() time.Duration {
+	changed, err := d.run()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.status.Runs++
+	d.status.LastRun = &now
+	// a run can fail after storing its changes (a hook failed)
+	if changed {
+		d.status.LastChange = &now
+	}
+	if err != nil {
+		d.status.Failures++
+		d.status.LastError = err.Error()
+		log.Printf("run %d failed (%d in a row): %v", d.status.Runs, d.status.Failures, err)
+	} else {
+		d.status.Failures = 0
+		d.status.LastError = ""
+		d.status.LastSuccess = &now
+	}
+	wait := d.delay(d.status.Failures)
+	next := now.Add(wait)
+	d.status.NextRun = &next
+	return wait
+}
+
+// Loop runs the pipeline until stop is closed. A run in progress is never interrupted.
+func (d *Daemon) Loop(stop <-chan struct{}) {
+	wait := time.Duration(0)
+	if max := time.Duration(float64(d.Config.Interval) * d.Config.Jitter); max > 0 {
+		wait = time.Duration(d.rand.Int63n(int64(max)))
+	}
+	next := time.Now().Add(wait)
+	d.mu.Lock()
+	d.status.NextRun = &next
+	d.mu.Unlock()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+		}
+		timer.Reset(d.once())
+	}
+}
+
+// ServeHTTP answers /healthz: 200 along with the status once a run succeeded and as long as the last one did,
+// 503 before that and while the last run failed
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := d.Status()
+	content, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if status.LastSuccess == nil || status.Failures > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_, _ = w.Write(append(content, '\n'))
+}
+
+// Execute runs the pipeline every Interval until SIGTERM or SIGINT, serving /healthz on Listen.
+func Execute(cfg DaemonConfig, run RunFunc) (err error) {
+	d := New(cfg, run)
+
+	var server *http.Server
+	if d.Config.Listen != "" {
+		listener, err := net.Listen("tcp", d.Config.Listen)
+		if err != nil {
+			return fmt.Errorf("cannot listen on %s: %v", d.Config.Listen, err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/healthz", d)
+		server = &http.Server{Handler: mux}
+		go func() {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				log.Printf("health endpoint stopped: %v", err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	stop := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Printf("%s received, shutting down", sig)
+		close(stop)
+	}()
+
+	d.Loop(stop)
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		return server.Shutdown(ctx)
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package daemon
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	d := New(DaemonConfig{Interval: time.Hour, Jitter: 0.1, Backoff: 10 * time.Minute}, nil)
+	for idx := 0; idx < 100; idx++ {
+		if got := d.delay(0); got < 54*time.Minute || got >= 66*time.Minute {
+			t.Fatalf("delay(0) = %v, want within an hour +/- 10%%", got)
+		}
+	}
+	tests := map[int]time.Duration{
+		1:  10 * time.Minute,
+		2:  20 * time.Minute,
+		3:  40 * time.Minute,
+		4:  time.Hour,
+		50: time.Hour,
+	}
+	for failures, want := range tests {
+		if got := d.delay(failures); got != want {
+			t.Errorf("delay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+}
+
+func TestLoop(t *testing.T) {
+	stop := make(chan struct{})
+	runs := 0
+	d := New(DaemonConfig{Interval: time.Millisecond, Backoff: time.Millisecond}, func() (bool, error) {
+		runs++
+		switch runs {
+		case 1:
+			return true, nil
+		case 2:
+			return false, fmt.Errorf("storage unreachable")
+		case 3:
+			// the run in progress completes, there is none after it
+			close(stop)
+			return false, fmt.Errorf("still unreachable")
+		}
+		t.Errorf("run %d after stop", runs)
+		return false, nil
+	})
+	d.Loop(stop)
+
+	status := d.Status()
+	if status.Runs != 3 || status.Failures != 2 || status.LastError != "still unreachable" {
+		t.Errorf("Status() = %+v", status)
+	}
+	if status.LastChange == nil || status.LastSuccess == nil {
+		t.Errorf("Status() = %+v, want the first run recorded as a change", status)
+	}
+
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz = %d after a failed run, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestOnceChangedAndFailed(t *testing.T) {
+	d := New(DaemonConfig{}, func() (bool, error) { return true, fmt.Errorf("1 hook(s) failed") })
+	d.once()
+	status := d.Status()
+	if status.LastChange == nil || status.LastSuccess != nil || status.Failures != 1 {
+		t.Errorf("Status() = %+v, want a failed run that changed files", status)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	d := New(DaemonConfig{}, func() (bool, error) { return false, nil })
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz = %d before the first run, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if strings.Contains(rec.Body.String(), "last_success") {
+		t.Errorf("/healthz = %s, want no last_success before the first run", rec.Body.String())
+	}
+
+	d.once()
+	rec = httptest.NewRecorder()
+	d.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want %d", rec.Code, http.StatusOK)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("/healthz content type = %q", ct)
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	newSet := func() *flag.FlagSet {
+		set := flag.NewFlagSet("daemon", flag.ContinueOnError)
+		set.Bool("rotate-sa", false, "")
+		set.Bool("rotate-encryption", false, "")
+		set.Bool("retire-encryption", false, "")
+		set.Bool("prune", false, "")
+		return set
+	}
+	set := newSet()
+	_ = set.Parse([]string{"-prune"})
+	if err := CheckFlags(set); err != nil {
+		t.Errorf("CheckFlags() error = %v", err)
+	}
+	set = newSet()
+	_ = set.Parse([]string{"-rotate-sa", "-retire-encryption=false", "-rotate-encryption", "-prune"})
+	err := CheckFlags(set)
+	if err == nil || !strings.HasPrefix(err.Error(), "-rotate-encryption, -rotate-sa can not be used") {
+		t.Errorf("CheckFlags() error = %v, want both one shot flags rejected", err)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package history
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// HistoryPath holds a directory per generation, next to storage.GlobalPath and storage.NodesPath
+	HistoryPath = "history"
+	MetaFile    = "meta.json"
+)
+
+// Entry describes one file a run wrote to
+type Entry struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+	// Existed is false for files that were created rather than replaced,
+	// rolling back means removing them
+	Existed bool `json:"existed"`
+}
+
+// Meta is stored as history/<generation>/meta.json
+type Meta struct {
+	Generation int       `json:"generation"`
+	Time       time.Time `json:"time"`
+	Files      []Entry   `json:"files"`
+}
+
+// Generation collects the previous content of every file a single run replaces
+// under history/<generation>/ so the run can be undone.
+type Generation struct {
+	Meta
+	// Keep is how many generations Commit leaves in storage, this one included. 0 keeps them all.
+	Keep  int
+	drv   storage.StoreDrv
+	saved map[string]struct{}
+}
+
+func generationPath(generation int) string {
+	return path.Join(HistoryPath, strconv.Itoa(generation))
+}
+
+// Generations returns the number of every generation found in storage, sorted.
+func Generations(drv storage.StoreDrv) (generations []int, err error) {
+	files, err := drv.List(HistoryPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		parts := strings.Split(file, "/")
+		if len(parts) != 3 || parts[2] != MetaFile {
+			continue
+		}
+		if generation, err := strconv.Atoi(parts[1]); err == nil {
+			generations = append(generations, generation)
+		}
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// Load reads the metadata of a generation
+func Load(drv storage.StoreDrv, generation int) (meta Meta, err error) {
+	content, err := drv.Read(path.Join(generationPath(generation), MetaFile))
+	if err != nil {
+		return meta, err
+	}
+	if err = json.Unmarshal(content, &meta); err != nil {
+		return meta, fmt.Errorf("invalid history metadata for generation %d: %v", generation, err)
+	}
+	return meta, nil
+}
+
+// Begin starts the generation following the last one in storage.
+func Begin(drv storage.StoreDrv) (g *Generation, err error) {
+	generations, err := Generations(drv)
+	if err != nil {
+		return nil, err
+	}
+	next := 1
+	if len(generations) > 0 {
+		next = generations[len(generations)-1] + 1
+	}
+	return &Generation{
+		Meta:  Meta{Generation: next, Time: time.Now().UTC()},
+		drv:   drv,
+		saved: make(map[string]struct{}),
+	}, nil
+}
+
+// Save keeps a copy of filePath, as it is before being overwritten, along with the reason for replacing it.
+// Only the first call per file counts, later ones would save content written by this very run.
+func (g *Generation) Save(filePath string, reason string) (err error) {
+	if g == nil {
+		return nil
+	}
+	if _, ok := g.saved[filePath]; ok {
+		return nil
+	}
+	content, err := g.drv.Read(filePath)
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+	existed := err == nil
+	if existed {
+		err = g.drv.Write(path.Join(generationPath(g.Generation), filePath), content)
+		if err != nil {
+			return fmt.Errorf("error saving %q to history: %v", filePath, err)
+		}
+	}
+	g.saved[filePath] = struct{}{}
+	g.Files = append(g.Files, Entry{Path: filePath, Reason: reason, Existed: existed})
+	return nil
+}
+
+// Commit writes the generation metadata and removes the generations beyond Keep, oldest first.
+// Runs that did not write anything leave no trace.
+func (g *Generation) Commit() (err error) {
+	if g == nil || len(g.Files) == 0 {
+		return nil
+	}
+	content, err := json.MarshalIndent(g.Meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = g.drv.Write(path.Join(generationPath(g.Generation), MetaFile), content)
+	if err != nil {
+		return err
+	}
+	return Expire(g.drv, g.Keep)
+}
+
+// Expire removes every generation but the last keep ones. keep 0 keeps them all.
+func Expire(drv storage.StoreDrv, keep int) (err error) {
+	generations, err := Generations(drv)
+	if err != nil || keep <= 0 || len(generations) <= keep {
+		return err
+	}
+	for _, generation := range generations[:len(generations)-keep] {
+		files, err := drv.List(generationPath(generation))
+		if err != nil {
+			return err
+		}
+		for _, filePath := range files {
+			if err = drv.Delete(filePath); err != nil {
+				return fmt.Errorf("error expiring history generation %d: %v", generation, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Rollback undoes generation `to` and every later one, restoring the files to what they
+// were before generation `to` ran. The rollback itself is recorded as a new generation.
+func Rollback(drv storage.StoreDrv, to int) (restored []Entry, err error) {
+	generations, err := Generations(drv)
+	if err != nil {
+		return nil, err
+	}
+
+	// path => content to restore, nil means the file did not exist
+	target := make(map[string][]byte)
+	found := false
+	for idx := len(generations) - 1; idx >= 0 && generations[idx] >= to; idx-- {
+		generation := generations[idx]
+		found = found || generation == to
+		meta, err := Load(drv, generation)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range meta.Files {
+			target[entry.Path] = nil
+			if !entry.Existed {
+				continue
+			}
+			content, err := drv.Read(path.Join(generationPath(generation), entry.Path))
+			if err != nil {
+				return nil, fmt.Errorf("generation %d is incomplete: %v", generation, err)
+			}
+			target[entry.Path] = content
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no such generation: %d", to)
+	}
+
+	g, err := Begin(drv)
+	if err != nil {
+		return nil, err
+	}
+	reason := fmt.Sprintf("rollback to before generation %d", to)
+	files := make([]string, 0, len(target))
+	for filePath := range target {
+		files = append(files, filePath)
+	}
+	sort.Strings(files)
+
+	batch := make(map[string][]byte)
+	for _, filePath := range files {
+		if err = g.Save(filePath, reason); err != nil {
+			return nil, err
+		}
+		content := target[filePath]
+		if content != nil {
+			batch[filePath] = content
+		} else if exists, _ := drv.Exists(filePath); exists {
+			if err = drv.Delete(filePath); err != nil {
+				return nil, err
+			}
+		}
+		restored = append(restored, Entry{Path: filePath, Reason: reason, Existed: content != nil})
+	}
+	if err = drv.WriteBatch(batch); err != nil {
+		return nil, err
+	}
+	return restored, g.Commit()
+}
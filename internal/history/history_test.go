@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package history
+
+import (
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// run simulates one genkubessl run writing files
+func run(t *testing.T, drv *file.StoreFile, files map[string]string) {
+	g, err := Begin(drv)
+	if err != nil {
+		t.Fatalf("Begin() error = %v", err)
+	}
+	for name, content := range files {
+		if err = g.Save(name, "test"); err != nil {
+			t.Fatalf("Save(%q) error = %v", name, err)
+		}
+		if err = drv.Write(name, []byte(content)); err != nil {
+			t.Fatalf("Write(%q) error = %v", name, err)
+		}
+	}
+	if err = g.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-history")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	drv := file.NewStoreFile(root)
+
+	run(t, drv, map[string]string{"global/ca.crt": "ca1", "global/ca.key": "key1"})
+	run(t, drv, map[string]string{"global/ca.crt": "ca2", "global/ca.key": "key2"})
+	run(t, drv, map[string]string{"global/ca.crt": "ca3", "nodes/new/kubelet.crt": "new"})
+	run(t, drv, map[string]string{})
+
+	generations, err := Generations(drv)
+	if err != nil {
+		t.Fatalf("Generations() error = %v", err)
+	}
+	// the last run wrote nothing and left no generation behind
+	if want := []int{1, 2, 3}; !reflect.DeepEqual(generations, want) {
+		t.Errorf("Generations() = %v, want %v", generations, want)
+	}
+
+	if _, err = Rollback(drv, 7); err == nil {
+		t.Errorf("Rollback() to a missing generation should fail")
+	}
+
+	if _, err = Rollback(drv, 2); err != nil {
+		t.Fatalf("Rollback() error = %v", err)
+	}
+	for name, want := range map[string]string{"global/ca.crt": "ca1", "global/ca.key": "key1"} {
+		if content, err := drv.Read(name); err != nil || string(content) != want {
+			t.Errorf("after Rollback() %q = %q, %v, want %q", name, content, err, want)
+		}
+	}
+	if exists, _ := drv.Exists("nodes/new/kubelet.crt"); exists {
+		t.Errorf("Rollback() should remove files created by rolled back generations")
+	}
+
+	// the rollback can itself be rolled back
+	if _, err = Rollback(drv, 4); err != nil {
+		t.Fatalf("Rollback() of the rollback error = %v", err)
+	}
+	for name, want := range map[string]string{"global/ca.crt": "ca3", "global/ca.key": "key2", "nodes/new/kubelet.crt": "new"} {
+		if content, err := drv.Read(name); err != nil || string(content) != want {
+			t.Errorf("after undoing Rollback() %q = %q, %v, want %q", name, content, err, want)
+		}
+	}
+}
+
+func TestCommitKeep(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-history")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	drv := file.NewStoreFile(root)
+
+	for idx, content := range []string{"v1", "v2", "v3", "v4"} {
+		g, err := Begin(drv)
+		if err != nil {
+			t.Fatalf("Begin() error = %v", err)
+		}
+		g.Keep = 2
+		if err = g.Save("global/ca.key", "test"); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		if err = drv.Write("global/ca.key", []byte(content)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if err = g.Commit(); err != nil {
+			t.Fatalf("Commit() error = %v", err)
+		}
+		if g.Generation != idx+1 {
+			t.Errorf("Begin() generation = %d, want %d", g.Generation, idx+1)
+		}
+	}
+	if generations, _ := Generations(drv); !reflect.DeepEqual(generations, []int{3, 4}) {
+		t.Errorf("Generations() = %v, want the last two kept", generations)
+	}
+	if files, _ := drv.List(HistoryPath); len(files) != 4 {
+		t.Errorf("List() = %v, want the files of generations 3 and 4 only", files)
+	}
+}
@@ -0,0 +1,211 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/history"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// environment handed to hooks
+	EnvNode         = "GENKUBESSL_NODE"
+	EnvRoles        = "GENKUBESSL_ROLES"
+	EnvChangedFiles = "GENKUBESSL_CHANGED_FILES"
+	EnvGeneration   = "GENKUBESSL_GENERATION"
+)
+
+// Change is a file written by the run, Path is where it lives on the node (or in the global area)
+type Change struct {
+	Path    string `json:"path"`
+	Reason  string `json:"reason"`
+	Created bool   `json:"created"`
+}
+
+// Event is what a hook gets to see: the changes of a single node, or of the global area when Node is empty.
+// It is written to the hook as JSON on stdin.
+type Event struct {
+	Node       string   `json:"node"`
+	Roles      []string `json:"roles"`
+	Generation int      `json:"generation"`
+	Files      []Change `json:"files"`
+}
+
+// ChangedFiles returns the path of every changed file
+func (e Event) ChangedFiles() (files []string) {
+	for _, file := range e.Files {
+		files = append(files, file.Path)
+	}
+	return files
+}
+
+// Events groups the files a run wrote, as recorded in its history generation, by node.
+// The global event, if any, comes first, nodes follow in name order.
+func Events(g *history.Generation, hosts kubecerts.KubeHostsAll) (events []Event) {
+	if g == nil {
+		return nil
+	}
+	byNode := make(map[string]*Event)
+	var nodes []string
+	for _, entry := range g.Files {
+		node, filePath, ok := storage.SplitPath(entry.Path)
+		if !ok {
+			continue
+		}
+		event, ok := byNode[node]
+		if !ok {
+			event = &Event{Node: node, Roles: kubecerts.NodeRoles(hosts, node), Generation: g.Generation}
+			byNode[node] = event
+			nodes = append(nodes, node)
+		}
+		event.Files = append(event.Files, Change{Path: filePath, Reason: entry.Reason, Created: !entry.Existed})
+	}
+	// "" (the global area) sorts first
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		event := byNode[node]
+		sort.Slice(event.Files, func(i, j int) bool { return event.Files[i].Path < event.Files[j].Path })
+		events = append(events, *event)
+	}
+	return events
+}
+
+// Run runs command through the shell for a single event, passing it on stdin and in the environment.
+// The output of the hook goes to our own.
+func Run(command string, event Event, timeout time.Duration) (err error) {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		EnvNode+"="+event.Node,
+		EnvRoles+"="+strings.Join(event.Roles, ","),
+		EnvChangedFiles+"="+strings.Join(event.ChangedFiles(), " "),
+		EnvGeneration+"="+strconv.Itoa(event.Generation),
+	)
+	cmd.Stdin = bytes.NewReader(append(content, '\n'))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// Execute runs command once per event. A failing hook does not stop the others, every failure is reported
+// and the events whose hook failed are returned.
+func Execute(command string, events []Event, timeout time.Duration) (undelivered []Event, err error) {
+	var failed []string
+	for _, event := range events {
+		name := event.Node
+		if name == "" {
+			name = storage.GlobalPath
+		}
+		files := fmt.Sprintf("%d changed file(s)", len(event.Files))
+		if err := Run(command, event, timeout); err != nil {
+			fmt.Printf("HOOK FAIL  : [%-30s] [%-50s] => %q\n", event.Node, files, err.Error())
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			undelivered = append(undelivered, event)
+			continue
+		}
+		fmt.Printf("HOOK OK    : [%-30s] [%-50s]\n", event.Node, files)
+	}
+	if len(failed) > 0 {
+		return undelivered, fmt.Errorf("%d hook(s) failed: %s", len(failed), strings.Join(failed, "; "))
+	}
+	return nil, nil
+}
+
+// Pending keeps the events whose hook failed so they are delivered again along with the events of
+// later runs. Changed files are not changed again by the next run, without it their hook would never run.
+type Pending struct {
+	events map[string]Event
+}
+
+func NewPending() *Pending {
+	return &Pending{events: make(map[string]Event)}
+}
+
+// Add merges events into the pending ones. A node with an event pending already gets a single event
+// holding the files of both, the newest reason and generation win.
+func (p *Pending) Add(events []Event) {
+	for _, event := range events {
+		pending, ok := p.events[event.Node]
+		if !ok {
+			p.events[event.Node] = event
+			continue
+		}
+		files := make(map[string]Change)
+		for _, file := range pending.Files {
+			files[file.Path] = file
+		}
+		for _, file := range event.Files {
+			// created stays created until the hook gets to see it
+			file.Created = file.Created || files[file.Path].Created
+			files[file.Path] = file
+		}
+		event.Files = event.Files[:0:0]
+		for _, file := range files {
+			event.Files = append(event.Files, file)
+		}
+		sort.Slice(event.Files, func(i, j int) bool { return event.Files[i].Path < event.Files[j].Path })
+		p.events[event.Node] = event
+	}
+}
+
+// Events returns the pending events, the global one first and nodes in name order
+func (p *Pending) Events() (events []Event) {
+	nodes := make([]string, 0, len(p.events))
+	for node := range p.events {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	for _, node := range nodes {
+		events = append(events, p.events[node])
+	}
+	return events
+}
+
+// Deliver runs command for every pending event and keeps only those whose hook failed.
+func (p *Pending) Deliver(command string, timeout time.Duration) (err error) {
+	undelivered, err := Execute(command, p.Events(), timeout)
+	p.events = make(map[string]Event)
+	p.Add(undelivered)
+	return err
+}
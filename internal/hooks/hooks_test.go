@@ -0,0 +1,157 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package hooks
+
+import (
+	"encoding/json"
+	"github.com/stefan-kiss/genkubessl/internal/history"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvents(t *testing.T) {
+	g := &history.Generation{Meta: history.Meta{Generation: 7, Files: []history.Entry{
+		{Path: "nodes/w2/etc/kubernetes/pki/kubelet.key", Reason: "certificate missing"},
+		{Path: "global/etc/kubernetes/pki/ca.crt", Reason: "cert expires within 240h0m0s", Existed: true},
+		{Path: "nodes/w2/etc/kubernetes/pki/kubelet.crt", Reason: "certificate missing"},
+		{Path: "nodes/m1/etc/kubernetes/pki/apiserver.crt", Reason: "cert not emitted by parent CA", Existed: true},
+		{Path: "history/6/meta.json"},
+	}}}
+	hosts := kubecerts.KubeHostsAll{
+		"masters": {"m1": nil},
+		"etcd":    {"m1": nil},
+		"workers": {"w2": nil},
+	}
+	want := []Event{
+		{Node: "", Generation: 7, Files: []Change{
+			{Path: "/etc/kubernetes/pki/ca.crt", Reason: "cert expires within 240h0m0s"},
+		}},
+		{Node: "m1", Roles: []string{"masters", "etcd"}, Generation: 7, Files: []Change{
+			{Path: "/etc/kubernetes/pki/apiserver.crt", Reason: "cert not emitted by parent CA"},
+		}},
+		{Node: "w2", Roles: []string{"workers"}, Generation: 7, Files: []Change{
+			{Path: "/etc/kubernetes/pki/kubelet.crt", Reason: "certificate missing", Created: true},
+			{Path: "/etc/kubernetes/pki/kubelet.key", Reason: "certificate missing", Created: true},
+		}},
+	}
+	if got := Events(g, hosts); !reflect.DeepEqual(got, want) {
+		t.Errorf("Events() = %+v, want %+v", got, want)
+	}
+	if got := Events(nil, hosts); got != nil {
+		t.Errorf("Events(nil) = %+v, want nil", got)
+	}
+}
+
+func TestRun(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-hooks")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	out := filepath.Join(tmp, "out")
+	command := `printf '%s|%s|%s|%s\n' "$GENKUBESSL_NODE" "$GENKUBESSL_ROLES" "$GENKUBESSL_CHANGED_FILES" "$GENKUBESSL_GENERATION" > ` + out + ` && cat >> ` + out
+
+	event := Event{Node: "w2", Roles: []string{"workers", "etcd"}, Generation: 3, Files: []Change{
+		{Path: "/etc/kubernetes/pki/kubelet.crt", Reason: "certificate missing", Created: true},
+		{Path: "/etc/kubernetes/pki/kubelet.key", Reason: "certificate missing", Created: true},
+	}}
+	if err = Run(command, event, time.Minute); err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	content, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("hook did not run: %v", err)
+	}
+	lines := strings.SplitN(string(content), "\n", 2)
+	wantEnv := "w2|workers,etcd|/etc/kubernetes/pki/kubelet.crt /etc/kubernetes/pki/kubelet.key|3"
+	if lines[0] != wantEnv {
+		t.Errorf("hook environment = %q, want %q", lines[0], wantEnv)
+	}
+	var got Event
+	if err = json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatalf("hook stdin is not JSON: %v", err)
+	}
+	if !reflect.DeepEqual(got, event) {
+		t.Errorf("hook stdin = %+v, want %+v", got, event)
+	}
+}
+
+func TestExecuteReportsFailures(t *testing.T) {
+	events := []Event{{Node: ""}, {Node: "m1"}, {Node: "w1"}}
+	undelivered, err := Execute(`[ "$GENKUBESSL_NODE" != m1 ]`, events, time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "1 hook(s) failed: m1:") {
+		t.Errorf("Execute() error = %v, want m1 reported", err)
+	}
+	if !reflect.DeepEqual(undelivered, []Event{{Node: "m1"}}) {
+		t.Errorf("Execute() undelivered = %+v, want the m1 event", undelivered)
+	}
+	if err = Run("exec sleep 5", Event{}, 50*time.Millisecond); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("Run() error = %v, want a timeout", err)
+	}
+}
+
+func TestPending(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-hooks")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	// the hook of w1 fails until the node is back
+	back := filepath.Join(tmp, "back")
+	command := `[ "$GENKUBESSL_NODE" != w1 ] || [ -e ` + back + ` ]`
+
+	kubelet := Change{Path: "/etc/kubernetes/pki/kubelet.crt", Reason: "certificate missing", Created: true}
+	p := NewPending()
+	p.Add([]Event{
+		{Node: "m1", Generation: 1, Files: []Change{{Path: "/etc/kubernetes/pki/apiserver.crt"}}},
+		{Node: "w1", Generation: 1, Files: []Change{kubelet}},
+	})
+	if err = p.Deliver(command, time.Minute); err == nil {
+		t.Fatalf("Deliver() succeeded with the hook of w1 failing")
+	}
+	if got := p.Events(); len(got) != 1 || got[0].Node != "w1" {
+		t.Fatalf("Events() = %+v, want only w1 left", got)
+	}
+
+	// the next run changes nothing for w1 but the client cert, the kubelet cert is still delivered
+	client := Change{Path: "/etc/kubernetes/pki/kubelet-client.crt", Reason: "cert expires within 240h0m0s"}
+	p.Add([]Event{{Node: "w1", Generation: 2, Files: []Change{{Path: kubelet.Path, Reason: "content changed"}, client}}})
+	want := []Event{{Node: "w1", Generation: 2, Files: []Change{
+		{Path: "/etc/kubernetes/pki/kubelet-client.crt", Reason: "cert expires within 240h0m0s"},
+		{Path: "/etc/kubernetes/pki/kubelet.crt", Reason: "content changed", Created: true},
+	}}}
+	if got := p.Events(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Events() = %+v, want %+v", got, want)
+	}
+
+	if err = ioutil.WriteFile(back, nil, 0600); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err = p.Deliver(command, time.Minute); err != nil {
+		t.Errorf("Deliver() error = %v", err)
+	}
+	if got := p.Events(); len(got) != 0 {
+		t.Errorf("Events() = %+v after delivery, want none", got)
+	}
+}
@@ -0,0 +1,308 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubebootstrap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"math/big"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenPath holds the bootstrap token Secret along with the RBAC rules TLS bootstrapping needs
+	TokenPath = "/etc/kubernetes/bootstrap/bootstrap-token.yaml"
+	// KubeconfigPath is the kubelet --bootstrap-kubeconfig, both in the global area and for every worker
+	KubeconfigPath = "/etc/kubernetes/bootstrap-kubelet.conf"
+
+	// DefaultGroup is the group bootstrapping kubelets authenticate as, besides system:bootstrappers
+	DefaultGroup = "system:bootstrappers:genkubessl:default-node-token"
+
+	// tokens expiring sooner are replaced
+	TokenMinValid = time.Hour
+
+	tokenChars     = "abcdefghijklmnopqrstuvwxyz0123456789"
+	tokenIDLen     = 6
+	tokenSecretLen = 16
+	bootstrapUser  = "tls-bootstrap-token-user"
+	clusterName    = "kubernetes"
+)
+
+var (
+	// TODO return value rather than use global
+	Changed = false
+
+	tokenIDRegexp     = regexp.MustCompile(`^[a-z0-9]{6}$`)
+	tokenSecretRegexp = regexp.MustCompile(`^[a-z0-9]{16}$`)
+
+	// written files, for StoredFiles
+	storedFiles []string
+)
+
+// Reset clears the outcome of a previous run.
+func Reset() {
+	Changed = false
+	storedFiles = nil
+}
+
+// BootstrapConfig describes the bootstrap token and the kubeconfig built around it
+type BootstrapConfig struct {
+	// Server is the apiserver url kubelets bootstrap against
+	Server string
+	// TTL of new tokens, 0 for tokens that never expire
+	TTL time.Duration
+	// Group bootstrapping kubelets are put in, must start with system:bootstrappers:
+	Group string
+}
+
+// Token is a bootstrap token as described by
+// https://kubernetes.io/docs/reference/access-authn-authz/bootstrap-tokens/
+type Token struct {
+	ID         string
+	Secret     string
+	Expiration time.Time
+	Group      string
+}
+
+func (t *Token) String() string {
+	return t.ID + "." + t.Secret
+}
+
+func randomString(n int) (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(tokenChars)))
+	for i := 0; i < n; i++ {
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b.WriteByte(tokenChars[idx.Int64()])
+	}
+	return b.String(), nil
+}
+
+// NewToken generates a random token valid for ttl (forever if 0)
+func NewToken(ttl time.Duration, group string, now time.Time) (token *Token, err error) {
+	token = &Token{Group: group}
+	if token.ID, err = randomString(tokenIDLen); err != nil {
+		return nil, err
+	}
+	if token.Secret, err = randomString(tokenSecretLen); err != nil {
+		return nil, err
+	}
+	if ttl > 0 {
+		token.Expiration = now.Add(ttl).UTC().Truncate(time.Second)
+	}
+	return token, nil
+}
+
+// Validate checks the token format and that it stays valid for at least minValid
+func (t *Token) Validate(now time.Time, minValid time.Duration) (err error) {
+	if !tokenIDRegexp.MatchString(t.ID) {
+		return fmt.Errorf("invalid token id %q", t.ID)
+	}
+	if !tokenSecretRegexp.MatchString(t.Secret) {
+		return fmt.Errorf("invalid token secret")
+	}
+	if !strings.HasPrefix(t.Group, "system:bootstrappers:") {
+		return fmt.Errorf("invalid token group %q", t.Group)
+	}
+	if !t.Expiration.IsZero() && t.Expiration.Before(now.Add(minValid)) {
+		return fmt.Errorf("token expires at %s", t.Expiration.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// RenderManifest returns the bootstrap token Secret followed by the bindings allowing members
+// of the token group to request node client certs and get them approved automatically.
+func (t *Token) RenderManifest() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "apiVersion: v1\n")
+	fmt.Fprintf(&b, "kind: Secret\n")
+	fmt.Fprintf(&b, "metadata:\n")
+	fmt.Fprintf(&b, "  name: bootstrap-token-%s\n", t.ID)
+	fmt.Fprintf(&b, "  namespace: kube-system\n")
+	fmt.Fprintf(&b, "type: bootstrap.kubernetes.io/token\n")
+	fmt.Fprintf(&b, "stringData:\n")
+	fmt.Fprintf(&b, "  description: \"kubelet TLS bootstrap token generated by genkubessl\"\n")
+	fmt.Fprintf(&b, "  token-id: %s\n", t.ID)
+	fmt.Fprintf(&b, "  token-secret: %s\n", t.Secret)
+	if !t.Expiration.IsZero() {
+		fmt.Fprintf(&b, "  expiration: %s\n", t.Expiration.UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&b, "  usage-bootstrap-authentication: \"true\"\n")
+	fmt.Fprintf(&b, "  usage-bootstrap-signing: \"true\"\n")
+	fmt.Fprintf(&b, "  auth-extra-groups: %s\n", t.Group)
+	bindings := []struct{ name, role, group string }{
+		{"genkubessl:kubelet-bootstrap", "system:node-bootstrapper", t.Group},
+		{"genkubessl:node-autoapprove-bootstrap", "system:certificates.k8s.io:certificatesigningrequests:nodeclient", t.Group},
+		{"genkubessl:node-autoapprove-certificate-rotation", "system:certificates.k8s.io:certificatesigningrequests:selfnodeclient", "system:nodes"},
+	}
+	for _, binding := range bindings {
+		fmt.Fprintf(&b, "---\n")
+		fmt.Fprintf(&b, "apiVersion: rbac.authorization.k8s.io/v1\n")
+		fmt.Fprintf(&b, "kind: ClusterRoleBinding\n")
+		fmt.Fprintf(&b, "metadata:\n")
+		fmt.Fprintf(&b, "  name: %s\n", binding.name)
+		fmt.Fprintf(&b, "roleRef:\n")
+		fmt.Fprintf(&b, "  apiGroup: rbac.authorization.k8s.io\n")
+		fmt.Fprintf(&b, "  kind: ClusterRole\n")
+		fmt.Fprintf(&b, "  name: %s\n", binding.role)
+		fmt.Fprintf(&b, "subjects:\n")
+		fmt.Fprintf(&b, "  - apiGroup: rbac.authorization.k8s.io\n")
+		fmt.Fprintf(&b, "    kind: Group\n")
+		fmt.Fprintf(&b, "    name: %s\n", binding.group)
+	}
+	return b.Bytes()
+}
+
+// ParseManifest reads the token back from a manifest written by RenderManifest
+func ParseManifest(content []byte) (token *Token, err error) {
+	token = &Token{}
+	for _, line := range strings.Split(string(content), "\n") {
+		if line == "---" {
+			break
+		}
+		field := strings.SplitN(strings.TrimSpace(line), ": ", 2)
+		if len(field) != 2 {
+			continue
+		}
+		switch field[0] {
+		case "token-id":
+			token.ID = field[1]
+		case "token-secret":
+			token.Secret = field[1]
+		case "auth-extra-groups":
+			token.Group = field[1]
+		case "expiration":
+			if token.Expiration, err = time.Parse(time.RFC3339, field[1]); err != nil {
+				return nil, fmt.Errorf("invalid token expiration: %v", err)
+			}
+		}
+	}
+	if token.ID == "" || token.Secret == "" {
+		return nil, fmt.Errorf("no bootstrap token found")
+	}
+	return token, nil
+}
+
+// RenderKubeconfig returns the kubeconfig a kubelet bootstraps with
+func RenderKubeconfig(server string, caPEM []byte, token *Token) []byte {
+	var b bytes.Buffer
+	context := bootstrapUser + "@" + clusterName
+	fmt.Fprintf(&b, "apiVersion: v1\n")
+	fmt.Fprintf(&b, "kind: Config\n")
+	fmt.Fprintf(&b, "clusters:\n")
+	fmt.Fprintf(&b, "- cluster:\n")
+	fmt.Fprintf(&b, "    certificate-authority-data: %s\n", base64.StdEncoding.EncodeToString(caPEM))
+	fmt.Fprintf(&b, "    server: %s\n", server)
+	fmt.Fprintf(&b, "  name: %s\n", clusterName)
+	fmt.Fprintf(&b, "contexts:\n")
+	fmt.Fprintf(&b, "- context:\n")
+	fmt.Fprintf(&b, "    cluster: %s\n", clusterName)
+	fmt.Fprintf(&b, "    user: %s\n", bootstrapUser)
+	fmt.Fprintf(&b, "  name: %s\n", context)
+	fmt.Fprintf(&b, "current-context: %s\n", context)
+	fmt.Fprintf(&b, "preferences: {}\n")
+	fmt.Fprintf(&b, "users:\n")
+	fmt.Fprintf(&b, "- name: %s\n", bootstrapUser)
+	fmt.Fprintf(&b, "  user:\n")
+	fmt.Fprintf(&b, "    token: %s\n", token.String())
+	return b.Bytes()
+}
+
+// DefaultServer builds the apiserver url from the main api host as given to -apisans
+func DefaultServer(apisans string) string {
+	host := strings.Split(strings.Split(apisans, ",")[0], "/")[0]
+	return "https://" + host + ":6443"
+}
+
+// StoredFiles returns the storage paths of every file written by the last CheckCreateToken.
+func StoredFiles() (files []string) {
+	return storedFiles
+}
+
+// CheckCreateToken makes sure there is a bootstrap token valid for at least TokenMinValid and that
+// the bootstrap kubeconfig in the global area and the one of every node listed carry it.
+func CheckCreateToken(GlobalCfg config.GlobalConfig, BootCfg BootstrapConfig, caPEM []byte, nodes []string) (err error) {
+	now := time.Now()
+	storedFiles = nil
+
+	tokenPath := path.Join(storage.GlobalPath, TokenPath)
+	failed := ""
+	var token *Token
+	content, err := GlobalCfg.ReadDriver.Read(tokenPath)
+	if err != nil {
+		failed = "bootstrap token missing"
+		if !storage.IsNotExist(err) {
+			failed = fmt.Sprintf("error loading bootstrap token: %v", err)
+		}
+	} else if token, err = ParseManifest(content); err != nil {
+		failed = err.Error()
+	} else if err = token.Validate(now, TokenMinValid); err != nil {
+		failed = err.Error()
+	} else if token.Group != BootCfg.Group {
+		failed = fmt.Sprintf("token group is %s, %s requested", token.Group, BootCfg.Group)
+	}
+
+	if failed != "" {
+		fmt.Printf("TOKEN ERROR: [%-30s] [%-50s] => %q\n", "", TokenPath, failed)
+		if token, err = NewToken(BootCfg.TTL, BootCfg.Group, now); err != nil {
+			return err
+		}
+		if err = token.Validate(now, 0); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("TOKEN OK   : [%-30s] [%-50s] => expires %q\n", "", TokenPath, expires(token))
+	}
+
+	write := func(node string, filePath string, content []byte, reason string) (err error) {
+		storedFiles = append(storedFiles, filePath)
+		written, err := config.CheckWrite(GlobalCfg, node, filePath, content, reason)
+		Changed = Changed || written
+		return err
+	}
+	if err = write("", tokenPath, token.RenderManifest(), failed); err != nil {
+		return err
+	}
+	kubeconfig := RenderKubeconfig(BootCfg.Server, caPEM, token)
+	if err = write("", path.Join(storage.GlobalPath, KubeconfigPath), kubeconfig, ""); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err = write(node, path.Join(storage.NodesPath, node, KubeconfigPath), kubeconfig, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expires(token *Token) string {
+	if token.Expiration.IsZero() {
+		return "never"
+	}
+	return token.Expiration.Format(time.RFC3339)
+}
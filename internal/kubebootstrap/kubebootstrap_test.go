@@ -0,0 +1,111 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubebootstrap
+
+import (
+	"bytes"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	now := time.Now()
+	token, err := NewToken(24*time.Hour, DefaultGroup, now)
+	if err != nil {
+		t.Fatalf("NewToken() error = %v", err)
+	}
+	if !regexp.MustCompile(`^[a-z0-9]{6}\.[a-z0-9]{16}$`).MatchString(token.String()) {
+		t.Errorf("NewToken() = %q, invalid format", token.String())
+	}
+	if err = token.Validate(now, TokenMinValid); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+	if err = token.Validate(now.Add(24*time.Hour), TokenMinValid); err == nil {
+		t.Errorf("Validate() should fail for an expired token")
+	}
+
+	parsed, err := ParseManifest(token.RenderManifest())
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	if *parsed != *token {
+		t.Errorf("ParseManifest() = %+v, want %+v", parsed, token)
+	}
+
+	forever, _ := NewToken(0, DefaultGroup, now)
+	if err = forever.Validate(now.Add(100*365*24*time.Hour), TokenMinValid); err != nil {
+		t.Errorf("Validate() of token without expiration error = %v", err)
+	}
+}
+
+func TestCheckCreateToken(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-kubebootstrap")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	bootCfg := BootstrapConfig{Server: DefaultServer("kapi.example.org/10.0.0.1"), TTL: time.Hour * 24, Group: DefaultGroup}
+	tokenPath := path.Join(storage.GlobalPath, TokenPath)
+	nodePath := path.Join(storage.NodesPath, "w1", KubeconfigPath)
+
+	if err = CheckCreateToken(cfg, bootCfg, []byte("ca"), []string{"w1"}); err != nil {
+		t.Fatalf("CheckCreateToken() error = %v", err)
+	}
+	manifest, _ := drv.Read(tokenPath)
+	token, err := ParseManifest(manifest)
+	if err != nil {
+		t.Fatalf("ParseManifest() error = %v", err)
+	}
+	kubeconfig, err := drv.Read(nodePath)
+	if err != nil || !bytes.Contains(kubeconfig, []byte("token: "+token.String())) {
+		t.Errorf("node kubeconfig does not carry the token: %s, %v", kubeconfig, err)
+	}
+	if !bytes.Contains(kubeconfig, []byte("server: https://kapi.example.org:6443")) {
+		t.Errorf("node kubeconfig does not point to the api server: %s", kubeconfig)
+	}
+	if len(StoredFiles()) != 3 {
+		t.Errorf("StoredFiles() = %v", StoredFiles())
+	}
+
+	if err = CheckCreateToken(cfg, bootCfg, []byte("ca"), []string{"w1"}); err != nil {
+		t.Fatalf("CheckCreateToken() error = %v", err)
+	}
+	if again, _ := drv.Read(tokenPath); !bytes.Equal(again, manifest) {
+		t.Errorf("valid token was replaced")
+	}
+
+	// about to expire
+	token.Expiration = time.Now().Add(TokenMinValid / 2).UTC().Truncate(time.Second)
+	_ = drv.Write(tokenPath, token.RenderManifest())
+	if err = CheckCreateToken(cfg, bootCfg, []byte("ca"), []string{"w1"}); err != nil {
+		t.Fatalf("CheckCreateToken() error = %v", err)
+	}
+	manifest, _ = drv.Read(tokenPath)
+	if renewed, err := ParseManifest(manifest); err != nil || renewed.ID == token.ID {
+		t.Errorf("expiring token was not replaced: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"net"
+	"sort"
+	"strings"
+)
+
+// NameConstraintsConfig adds X.509 name constraints to the CA's created from now on, existing CA's keep
+// theirs (or lack thereof). Lists are comma separated, empty permitted lists are derived from the alt names
+// of the certs each CA signs: the cluster domain, the domain of each node and the /24 (IPv4) or /64 (IPv6)
+// network of each IP address (loopback addresses as such).
+type NameConstraintsConfig struct {
+	Enabled      bool
+	PermittedDNS string
+	ExcludedDNS  string
+	PermittedIPs string
+	ExcludedIPs  string
+}
+
+// set by the last Execute
+var nameConstraints NameConstraintsConfig
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func parseDomains(list string) (domains []string, err error) {
+	for _, domain := range splitList(list) {
+		name := NormalizeName(domain)
+		if err = validateDNSName(strings.TrimPrefix(name, "."), false); err != nil {
+			return nil, fmt.Errorf("invalid name constraint domain %q: %v", domain, err)
+		}
+		domains = append(domains, name)
+	}
+	return domains, nil
+}
+
+func parseRanges(list string) (ranges []*net.IPNet, err error) {
+	for _, cidr := range splitList(list) {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name constraint IP range %q: %v", cidr, err)
+		}
+		ranges = append(ranges, ipnet)
+	}
+	return ranges, nil
+}
+
+// parse returns the explicitly given constraints
+func (c NameConstraintsConfig) parse() (nc sslutil.NameConstraints, err error) {
+	if nc.PermittedDNSDomains, err = parseDomains(c.PermittedDNS); err != nil {
+		return nc, err
+	}
+	if nc.ExcludedDNSDomains, err = parseDomains(c.ExcludedDNS); err != nil {
+		return nc, err
+	}
+	if nc.PermittedIPRanges, err = parseRanges(c.PermittedIPs); err != nil {
+		return nc, err
+	}
+	if nc.ExcludedIPRanges, err = parseRanges(c.ExcludedIPs); err != nil {
+		return nc, err
+	}
+	return nc, nil
+}
+
+// constraintDomain is the domain permitting name: the cluster domain for in cluster names,
+// the domain of fully qualified host names and the name itself for short ones and services
+func constraintDomain(name string) string {
+	name = strings.TrimPrefix(name, "*.")
+	if matchesDomain(name, clusterDomain) {
+		return clusterDomain
+	}
+	if strings.HasSuffix(name, ".svc") {
+		return name
+	}
+	if labels := strings.Split(name, "."); len(labels) > 2 {
+		return strings.Join(labels[1:], ".")
+	}
+	return name
+}
+
+func matchesDomain(name string, domain string) bool {
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+// deriveDomains keeps the shortest domains, dropping those within another one
+func deriveDomains(names []string) (domains []string) {
+	unique := make(map[string]struct{})
+	for _, name := range names {
+		unique[constraintDomain(name)] = struct{}{}
+	}
+	for domain := range unique {
+		covered := false
+		for other := range unique {
+			if other != domain && matchesDomain(domain, other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			domains = append(domains, domain)
+		}
+	}
+	sort.Strings(domains)
+	return domains
+}
+
+func deriveRanges(ips []net.IP) (ranges []*net.IPNet) {
+	unique := make(map[string]*net.IPNet)
+	for _, ip := range ips {
+		mask := net.CIDRMask(64, 128)
+		switch {
+		case ip.To4() != nil && ip.IsLoopback():
+			ip, mask = ip.To4(), net.CIDRMask(8, 32)
+		case ip.To4() != nil:
+			ip, mask = ip.To4(), net.CIDRMask(24, 32)
+		case ip.IsLoopback():
+			mask = net.CIDRMask(128, 128)
+		}
+		ipnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		unique[ipnet.String()] = ipnet
+	}
+	for _, ipnet := range unique {
+		ranges = append(ranges, ipnet)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].String() < ranges[j].String() })
+	return ranges
+}
+
+// caNameConstraints returns the constraints of the CA at caPath, deriving the permitted ones not given
+// from the certs it signs. A CA only signing certs without alt names is left unconstrained.
+func caNameConstraints(caPath string) (nc sslutil.NameConstraints, err error) {
+	if !nameConstraints.Enabled {
+		return nc, nil
+	}
+	if nc, err = nameConstraints.parse(); err != nil {
+		return nc, err
+	}
+
+	var names []string
+	var ips []net.IP
+	for _, crt := range AllKubeCerts {
+		if kubeCertTemplates[crt.templateIdx].parent != caPath {
+			continue
+		}
+		altNames := sslutil.NewCertConfig(0, "", nil, crt.sans).AltNames
+		names = append(names, altNames.DNSNames...)
+		ips = append(ips, altNames.IPs...)
+	}
+	if len(nc.PermittedDNSDomains) == 0 {
+		nc.PermittedDNSDomains = deriveDomains(names)
+	}
+	if len(nc.PermittedIPRanges) == 0 {
+		nc.PermittedIPRanges = deriveRanges(ips)
+	}
+	return nc, nil
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDeriveDomains(t *testing.T) {
+	names := []string{
+		"master1.example.org",
+		"worker1.nodes.example.org",
+		"*.apps.example.org",
+		"kubernetes",
+		"kubernetes.default.svc",
+		"kubernetes.default.svc.cluster.local",
+		"localhost",
+		"master1",
+	}
+	want := []string{"cluster.local", "example.org", "kubernetes", "kubernetes.default.svc", "localhost", "master1"}
+	if got := deriveDomains(names); !reflect.DeepEqual(got, want) {
+		t.Errorf("deriveDomains() = %v, want %v", got, want)
+	}
+}
+
+func TestDeriveRanges(t *testing.T) {
+	var ips []net.IP
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "127.0.0.1", "::1", "fd00::1", "fd00::2:1"} {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	var got []string
+	for _, ipnet := range deriveRanges(ips) {
+		got = append(got, ipnet.String())
+	}
+	want := []string{"10.0.0.0/24", "127.0.0.0/8", "::1/128", "fd00::/64"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("deriveRanges() = %v, want %v", got, want)
+	}
+}
+
+func TestNameConstraintsConfigParse(t *testing.T) {
+	nc, err := NameConstraintsConfig{PermittedDNS: "Example.ORG., .internal", PermittedIPs: "10.0.0.0/8, fd00::/8"}.parse()
+	if err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+	if !reflect.DeepEqual(nc.PermittedDNSDomains, []string{"example.org", ".internal"}) || len(nc.PermittedIPRanges) != 2 {
+		t.Errorf("parse() = %+v", nc)
+	}
+	for _, c := range []NameConstraintsConfig{{ExcludedDNS: "bad_name.org"}, {ExcludedIPs: "10.0.0.1"}} {
+		if _, err = c.parse(); err == nil {
+			t.Errorf("parse(%+v) should fail", c)
+		}
+	}
+}
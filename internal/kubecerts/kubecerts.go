@@ -28,8 +28,10 @@ import (
 	"github.com/stefan-kiss/genkubessl/internal/storage"
 	"github.com/stefan-kiss/genkubessl/internal/util"
 	"log"
+	"net"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 	"time"
@@ -43,14 +45,32 @@ type ClusterConfig struct {
 	Users      *string
 	InStorage  storage.StoreDrv
 	OutStorage storage.StoreDrv
+	// Node restricts the run to the CA's and the certs of a single node (local mode)
+	Node string
+	// ExtraNodeSans are added to the alt names of Node in every role it has
+	ExtraNodeSans []string
+	// Bootstrap leaves the kubelet client certs of workers to kubelet TLS bootstrapping
+	Bootstrap bool
+	// Templates declares extra certificates, see CertTemplateConfig
+	Templates []CertTemplateConfig
+	// ClusterDomain is the cluster DNS domain, "cluster.local" when empty
+	ClusterDomain string
+	// ServiceCIDR lists the service network of each address family (comma separated),
+	// the first address of each is the kubernetes service IP
+	ServiceCIDR string
+	// NameConstraints restrict the names new CA's can issue certificates for
+	NameConstraints NameConstraintsConfig
+	// RenewBefore renews certificates expiring within this long, CheckCertMinValid when zero
+	RenewBefore time.Duration
+	// ReissueUsages reissues the certificates issued without extended key usages, see ReissueUsages
+	ReissueUsages bool
 }
 
-// TODO [low priority] add command line option to get local dns instead of hardcoding cluster.local
-
 type KubeHostsAll map[string]map[string][]string
 
 type KubeTemplateData struct {
-	NodeName string
+	NodeName      string
+	ClusterDomain string
 }
 
 type KubeCertTemplate struct {
@@ -60,9 +80,12 @@ type KubeCertTemplate struct {
 	nodes                []string
 	nodeSans             bool
 	apiSans              bool
+	serviceSans          bool
 	extraSans            []string
 	commonnameTemplate   string
 	organisationTemplate string
+	// tlsBootstrap certs are obtained by workers themselves when TLS bootstrapping is used
+	tlsBootstrap bool
 }
 
 type KubeCert struct {
@@ -90,8 +113,13 @@ const (
 	GlobalPath = "global"
 	NodesPath  = "nodes"
 
-	// hardcoded min duration
+	// default for ClusterConfig.RenewBefore
 	CheckCertMinValid = time.Hour * 24 * 10
+
+	DefaultClusterDomain = "cluster.local"
+
+	// UsersPath holds the client certs of the users given with -users
+	UsersPath = "/etc/kubernetes/pki/users/"
 )
 
 var (
@@ -100,6 +128,20 @@ var (
 
 	defaultNodeSans = []string{"127.0.0.1", "localhost", "::1"}
 
+	// cluster DNS domain, as set by the last Execute
+	clusterDomain = DefaultClusterDomain
+
+	// certs expiring sooner are renewed, as set by the last Execute
+	renewBefore = CheckCertMinValid
+
+	// ReissueUsages reissues certs carrying no extended key usage, as issued before usages were set on them.
+	// Off unless asked for: on clusters created back then every leaf cert would be replaced at once.
+	// Set by Execute from ClusterConfig.
+	ReissueUsages = false
+
+	// KubeHosts as parsed by the last Execute
+	KubeHosts KubeHostsAll
+
 	KubeCAMap    = make(map[string]int)
 	AllKubeCerts = make([]*KubeCert, 0)
 
@@ -125,7 +167,8 @@ var (
 			usages:             []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
 			nodeSans:           true,
 			apiSans:            true,
-			extraSans:          []string{"kubernetes", "kubernetes.default", "kubernetes.default.svc", "kubernetes.default.svc.cluster.local"},
+			serviceSans:        true,
+			extraSans:          []string{"kubernetes", "kubernetes.default", "kubernetes.default.svc", "kubernetes.default.svc.{{.ClusterDomain}}"},
 		},
 		{
 			path:                 "/etc/kubernetes/pki/apiserver-kubelet-client",
@@ -156,6 +199,7 @@ var (
 			commonnameTemplate:   "system:node:{{.NodeName}}",
 			organisationTemplate: "system:nodes",
 			usages:               []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			tlsBootstrap:         true,
 		},
 		{
 			path:                 "/var/lib/kubelet/pki/kubelet",
@@ -221,8 +265,24 @@ var (
 			usages:               []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 		},
 	}
+
+	// the built in templates, before -users and declared templates are added
+	builtinTemplates = append([]KubeCertTemplate{}, kubeCertTemplates...)
 )
 
+// Reset forgets everything a previous run rendered so Execute can run again within the same process.
+func Reset() {
+	Changed = false
+	clusterDomain = DefaultClusterDomain
+	renewBefore = CheckCertMinValid
+	ReissueUsages = false
+	nameConstraints = NameConstraintsConfig{}
+	KubeHosts = nil
+	KubeCAMap = make(map[string]int)
+	AllKubeCerts = make([]*KubeCert, 0)
+	kubeCertTemplates = append([]KubeCertTemplate{}, builtinTemplates...)
+}
+
 func renderStringTemplate(templateString string, data KubeTemplateData) string {
 	var outBuf bytes.Buffer
 	outBufWriter := bufio.NewWriter(&outBuf)
@@ -241,9 +301,10 @@ func renderStringTemplate(templateString string, data KubeTemplateData) string {
 }
 
 // not very performant but we want unique San's
-func makeSans(hosts KubeHostsAll, nodeType string, node string, apiSans bool, nodeSans bool, extraSans []string) (sans []string) {
+func makeSans(hosts KubeHostsAll, nodeType string, node string, apiSans bool, nodeSans bool, serviceSans bool, extraSans []string) (sans []string) {
 	// empty map for uniqueness
 	sansMAP := make(map[string]struct{})
+	data := KubeTemplateData{NodeName: node, ClusterDomain: clusterDomain}
 
 	if apiSans {
 		for hostName, altSans := range hosts["apisans"] {
@@ -262,9 +323,16 @@ func makeSans(hosts KubeHostsAll, nodeType string, node string, apiSans bool, no
 			sansMAP[altName] = struct{}{}
 		}
 	}
+	if serviceSans {
+		for _, altSans := range hosts["services"] {
+			for _, altName := range altSans {
+				sansMAP[altName] = struct{}{}
+			}
+		}
+	}
 	if len(extraSans) > 0 {
 		for _, altName := range extraSans {
-			sansMAP[altName] = struct{}{}
+			sansMAP[renderStringTemplate(altName, data)] = struct{}{}
 		}
 	}
 	for san, _ := range sansMAP {
@@ -277,9 +345,10 @@ func MakeKubeCertFromTemplate(hosts KubeHostsAll, template KubeCertTemplate, idx
 	var sans []string
 	var commonName string
 	var organisation []string
-	sans = makeSans(hosts, nodetype, node, template.apiSans, template.nodeSans, template.extraSans)
-	commonName = renderStringTemplate(template.commonnameTemplate, KubeTemplateData{node})
-	organisation = []string{renderStringTemplate(template.organisationTemplate, KubeTemplateData{node})}
+	data := KubeTemplateData{NodeName: node, ClusterDomain: clusterDomain}
+	sans = makeSans(hosts, nodetype, node, template.apiSans, template.nodeSans, template.serviceSans, template.extraSans)
+	commonName = renderStringTemplate(template.commonnameTemplate, data)
+	organisation = []string{renderStringTemplate(template.organisationTemplate, data)}
 	if reflect.DeepEqual(organisation, []string{""}) {
 		organisation = []string{}
 	}
@@ -307,10 +376,16 @@ func MakeKubeCertFromTemplate(hosts KubeHostsAll, template KubeCertTemplate, idx
 	return kc, nil
 }
 
-func RenderCertTemplates(hosts KubeHostsAll) (err error) {
+// RenderCertTemplates renders every template for every node. When onlyNode is set only
+// the CA's and the certs belonging to that node are rendered. With bootstrap workers
+// get no certs they can request through kubelet TLS bootstrapping.
+func RenderCertTemplates(hosts KubeHostsAll, onlyNode string, bootstrap bool) (err error) {
 
 	for idx, templateValues := range kubeCertTemplates {
 		if len(templateValues.nodes) < 1 {
+			if onlyNode != "" && templateValues.parent != "" {
+				continue
+			}
 			kc, err := MakeKubeCertFromTemplate(hosts, templateValues, idx, "", "")
 			if err != nil {
 				log.Fatalf("Error making KubeCert from template %d", idx)
@@ -322,7 +397,13 @@ func RenderCertTemplates(hosts KubeHostsAll) (err error) {
 				if hosts[nodetype] == nil {
 					continue
 				}
+				if bootstrap && templateValues.tlsBootstrap && nodetype == "workers" {
+					continue
+				}
 				for node := range hosts[nodetype] {
+					if onlyNode != "" && node != onlyNode {
+						continue
+					}
 					kc, err := MakeKubeCertFromTemplate(hosts, templateValues, idx, nodetype, node)
 					if err != nil {
 						log.Fatalf("Error making KubeCert from template %d", idx)
@@ -344,14 +425,21 @@ func RenderCertTemplates(hosts KubeHostsAll) (err error) {
 func genCrt(crt *KubeCert) (err error) {
 
 	crtConf := sslutil.NewCertConfig(0, crt.commonName, crt.organisation, crt.sans)
+	crtConf.Usages = kubeCertTemplates[crt.templateIdx].usages
 
 	if parent := kubeCertTemplates[crt.templateIdx].parent; parent == "" {
-		crt.cert, crt.key, err = sslutil.SelfSignedCaKey(*crtConf, nil)
+		crtConf.NameConstraints, err = caNameConstraints(kubeCertTemplates[crt.templateIdx].path)
+		if err == nil {
+			crt.cert, crt.key, err = sslutil.SelfSignedCaKey(*crtConf, nil)
+		}
 	} else {
 		parentCrt := AllKubeCerts[KubeCAMap[parent]].cert
 		parentKey := AllKubeCerts[KubeCAMap[parent]].key
 		//pp.Print(parentKey)
-		crt.cert, crt.key, err = sslutil.SelfSignedCertKey(*crtConf, parentCrt, parentKey, nil)
+		err = sslutil.CheckNameConstraints(parentCrt, crtConf.AltNames)
+		if err == nil {
+			crt.cert, crt.key, err = sslutil.SelfSignedCertKey(*crtConf, parentCrt, parentKey, nil)
+		}
 	}
 	if err != nil {
 		return fmt.Errorf("certificate: %q => %q\n", kubeCertTemplates[crt.templateIdx].path, err)
@@ -374,18 +462,37 @@ func genPEM(crt *KubeCert) (err error) {
 	return nil
 }
 
-func writeCerts(GlobalCfg config.GlobalConfig, crt *KubeCert) (err error) {
-	err = GlobalCfg.WriteDriver.Write(crt.writePath+".crt", crt.certPEM)
-	if err != nil {
-		return fmt.Errorf("error writing file for cert: %q", crt.commonName)
+// writeCerts writes the cert and its key as one unit so they can never get out of sync
+func writeCerts(GlobalCfg config.GlobalConfig, crt *KubeCert, reason string) (err error) {
+	for _, ext := range []string{".crt", ".key"} {
+		if err = GlobalCfg.History.Save(crt.writePath+ext, reason); err != nil {
+			return err
+		}
 	}
-	err = GlobalCfg.WriteDriver.Write(crt.writePath+".key", crt.keyPEM)
+	err = GlobalCfg.WriteDriver.WriteBatch(map[string][]byte{
+		crt.writePath + ".crt": crt.certPEM,
+		crt.writePath + ".key": crt.keyPEM,
+	})
 	if err != nil {
-		return fmt.Errorf("error writing file for cert: %q", crt.commonName)
+		return fmt.Errorf("error writing files for cert: %q: %v", crt.commonName, err)
 	}
 	return nil
 }
 
+// materialize copies a valid cert read from the source storage into the destination
+// unless the destination already holds the exact same cert and key.
+func materialize(GlobalCfg config.GlobalConfig, crt *KubeCert) (copied bool, err error) {
+	dstCertPEM, certErr := GlobalCfg.WriteDriver.Read(crt.writePath + ".crt")
+	dstKeyPEM, keyErr := GlobalCfg.WriteDriver.Read(crt.writePath + ".key")
+	if certErr == nil && keyErr == nil && bytes.Equal(dstCertPEM, crt.certPEM) && bytes.Equal(dstKeyPEM, crt.keyPEM) {
+		return false, nil
+	}
+	if err = writeCerts(GlobalCfg, crt, "materialized from source"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
 func cmpWithDefinition(crt *x509.Certificate, def *KubeCert) (err error) {
 	if crt.Subject.CommonName != def.commonName {
 		return fmt.Errorf("mismatching CommonName")
@@ -395,7 +502,7 @@ func cmpWithDefinition(crt *x509.Certificate, def *KubeCert) (err error) {
 	}
 	// add more Subject fields as necessary. currently kubernetes does not use others
 
-	if err = util.UniqueStringSliceCmp(sslutil.GetAllSans(crt), def.sans); err != nil {
+	if err = util.UniqueStringSliceCmp(sslutil.GetAllSans(crt), sslutil.NormalizeSans(def.sans)); err != nil {
 
 		fmt.Printf("Cert Sans: ")
 		pp.Print(sslutil.GetAllSans(crt))
@@ -406,9 +513,33 @@ func cmpWithDefinition(crt *x509.Certificate, def *KubeCert) (err error) {
 
 		return fmt.Errorf("mismatching AltNames")
 	}
+
+	// certs issued before usages were set on them have none, they are only reissued when asked to
+	if len(crt.ExtKeyUsage) == 0 && !ReissueUsages {
+		return nil
+	}
+	if !sameUsages(crt.ExtKeyUsage, kubeCertTemplates[def.templateIdx].usages) {
+		return fmt.Errorf("mismatching ExtKeyUsage")
+	}
 	return nil
 }
 
+// sameUsages compares extended key usages regardless of their order
+func sameUsages(got []x509.ExtKeyUsage, want []x509.ExtKeyUsage) bool {
+	set := make(map[x509.ExtKeyUsage]struct{}, len(want))
+	for _, usage := range want {
+		set[usage] = struct{}{}
+	}
+	seen := make(map[x509.ExtKeyUsage]struct{}, len(got))
+	for _, usage := range got {
+		if _, ok := set[usage]; !ok {
+			return false
+		}
+		seen[usage] = struct{}{}
+	}
+	return len(seen) == len(set)
+}
+
 func Execute(GlobalCfg config.GlobalConfig, ClusterConfig ClusterConfig) error {
 
 	kubeHosts, err := getKubehosts(ClusterConfig.Apisans, ClusterConfig.Masters, ClusterConfig.Workers, ClusterConfig.Etcd)
@@ -416,18 +547,46 @@ func Execute(GlobalCfg config.GlobalConfig, ClusterConfig ClusterConfig) error {
 		return err
 	}
 
-	_ = getUsers(ClusterConfig.Users)
-
-	err = RenderCertTemplates(*kubeHosts)
+	clusterDomain = DefaultClusterDomain
+	if ClusterConfig.ClusterDomain != "" {
+		clusterDomain = ClusterConfig.ClusterDomain
+	}
+	renewBefore = CheckCertMinValid
+	if ClusterConfig.RenewBefore > 0 {
+		renewBefore = ClusterConfig.RenewBefore
+	}
+	ReissueUsages = ClusterConfig.ReissueUsages
+	nameConstraints = ClusterConfig.NameConstraints
+	if _, err = nameConstraints.parse(); err != nil {
+		return err
+	}
+	serviceIPs, err := ServiceIPs(ClusterConfig.ServiceCIDR)
 	if err != nil {
 		return err
 	}
+	(*kubeHosts)["services"] = map[string][]string{"kubernetes": serviceIPs}
+
+	if err = getUsers(ClusterConfig.Users); err != nil {
+		return err
+	}
 
-	err = CheckCreateCerts(GlobalCfg)
+	if err = AddTemplates(ClusterConfig.Templates); err != nil {
+		return err
+	}
+
+	if ClusterConfig.Node != "" {
+		if err = addNodeSans(*kubeHosts, ClusterConfig.Node, ClusterConfig.ExtraNodeSans); err != nil {
+			return err
+		}
+	}
+	KubeHosts = *kubeHosts
+
+	err = RenderCertTemplates(*kubeHosts, ClusterConfig.Node, ClusterConfig.Bootstrap)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	return nil
+
+	return CheckCreateCerts(GlobalCfg)
 }
 
 func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
@@ -445,14 +604,14 @@ func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
 		if crt.failed == "" {
 			crt.certPEM, err = GlobalConfig.ReadDriver.Read(crt.readPath + ".crt")
 			if err != nil {
-				crt.failed = "error loading certificate"
+				crt.failed = storage.ReadFailure("certificate", err)
 			}
 		}
 
 		if crt.failed == "" {
 			crt.keyPEM, err = GlobalConfig.ReadDriver.Read(crt.readPath + ".key")
 			if err != nil {
-				crt.failed = "error loading certificate"
+				crt.failed = storage.ReadFailure("private key", err)
 			}
 		}
 
@@ -463,10 +622,21 @@ func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
 			}
 		}
 
+		if crt.failed == "" && time.Now().Add(renewBefore).After(crt.cert.NotAfter) {
+			crt.failed = fmt.Sprintf("cert expires within %s", renewBefore)
+		}
+
 		if crt.failed == "" && parent == "" {
 			err = sslutil.VerifyCrtSignature(crt.cert, crt.key)
 			if err != nil {
-				crt.failed = "error verifying cert signature"
+				crt.failed = "CA cert not self signed by its key"
+			}
+		}
+
+		if crt.failed == "" && parent != "" {
+			err = sslutil.KeyMatchesCrt(crt.cert, crt.key)
+			if err != nil {
+				crt.failed = "private key does not match the cert"
 			}
 		}
 
@@ -486,6 +656,14 @@ func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
 
 		if crt.failed != "" {
 			fmt.Printf("CRT ERROR  : [%-30s] [%-50s] => %q\n", crt.node, certname, crt.failed)
+			if crt.node == "" && GlobalConfig.ReadOnlyGlobal {
+				return fmt.Errorf("global certificate %q failed its checks (%s) and global files are read only", certname, crt.failed)
+			}
+			for _, readOnly := range GlobalConfig.ReadOnlyCerts {
+				if readOnly == certname {
+					return fmt.Errorf("certificate %q failed its checks (%s) and is only read here", certname, crt.failed)
+				}
+			}
 		}
 		if ForceRegen || (crt.failed != "" && OverWrite) {
 			err = genCrt(crt)
@@ -497,7 +675,7 @@ func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
 				return err
 			}
 
-			err = writeCerts(GlobalConfig, crt)
+			err = writeCerts(GlobalConfig, crt, crt.failed)
 			if err != nil {
 				return err
 			}
@@ -505,6 +683,17 @@ func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
 			Changed = true
 		} else if crt.failed == "" {
 			fmt.Printf("CRT OK     : [%-30s] [%-50s]\n", crt.node, certname)
+			if !GlobalConfig.Materialize {
+				continue
+			}
+			copied, err := materialize(GlobalConfig, crt)
+			if err != nil {
+				return err
+			}
+			if copied {
+				fmt.Printf("CRT COPIED : [%-30s] [%-50s]\n", crt.node, certname)
+				Changed = true
+			}
 			continue
 		} else {
 			fmt.Printf("%t %q %t\n", ForceRegen, crt.failed, OverWrite)
@@ -516,59 +705,217 @@ func CheckCreateCerts(GlobalConfig config.GlobalConfig) (err error) {
 
 }
 
-func parsesans(hosts *string, single bool) (map[string][]string, error) {
+// StoredFiles returns the storage paths of every rendered certificate and key.
+func StoredFiles() (files []string) {
+	for _, crt := range AllKubeCerts {
+		files = append(files, crt.writePath+".crt", crt.writePath+".key")
+	}
+	return files
+}
+
+type CertificateAuthority struct {
+	WritePath string
+	Cert      *x509.Certificate
+	Key       interface{}
+}
+
+// CertificateAuthorities returns the CA's loaded or generated by CheckCreateCerts, sorted by path.
+func CertificateAuthorities() (cas []CertificateAuthority) {
+	for _, idx := range KubeCAMap {
+		crt := AllKubeCerts[idx]
+		cas = append(cas, CertificateAuthority{
+			WritePath: crt.writePath,
+			Cert:      crt.cert,
+			Key:       crt.key,
+		})
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i].WritePath < cas[j].WritePath })
+	return cas
+}
+
+// NodeRoles returns the node types (masters, workers, etcd) node belongs to
+func NodeRoles(hosts KubeHostsAll, node string) (roles []string) {
+	for _, nodetype := range []string{"masters", "workers", "etcd"} {
+		if _, ok := hosts[nodetype][node]; ok {
+			roles = append(roles, nodetype)
+		}
+	}
+	return roles
+}
+
+// addNodeSans adds extra alt names to node in every role it has
+func addNodeSans(hosts KubeHostsAll, node string, extraSans []string) (err error) {
+	roles := NodeRoles(hosts, node)
+	if len(roles) == 0 {
+		return fmt.Errorf("node %q is not part of the cluster definition", node)
+	}
+	for _, nodetype := range roles {
+		// etcd shares the masters map when not given explicitly,
+		// going through known keeps us from adding the same san twice
+		known := make(map[string]struct{})
+		for _, san := range hosts[nodetype][node] {
+			known[san] = struct{}{}
+		}
+		sans := hosts[nodetype][node]
+		for _, extraSan := range extraSans {
+			san, err := canonicalSan(extraSan, true)
+			if err != nil {
+				return err
+			}
+			if _, ok := known[san]; !ok {
+				sans = append(sans, san)
+				known[san] = struct{}{}
+			}
+		}
+		hosts[nodetype][node] = sans
+	}
+	return nil
+}
+
+// ServiceIPs returns the kubernetes service IP of every service network: its first address.
+// There can be one network per address family (dual stack).
+func ServiceIPs(serviceCIDR string) (ips []string, err error) {
+	if serviceCIDR == "" {
+		return nil, nil
+	}
+	families := make(map[int]string)
+	for _, cidr := range strings.Split(serviceCIDR, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid service cidr %q: %v", cidr, err)
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones < 2 {
+			return nil, fmt.Errorf("service cidr %q is too small", cidr)
+		}
+		if other, ok := families[bits]; ok {
+			return nil, fmt.Errorf("service cidrs %q and %q are of the same address family", other, cidr)
+		}
+		families[bits] = cidr
+
+		ip := make(net.IP, len(network.IP))
+		copy(ip, network.IP)
+		for idx := len(ip) - 1; idx >= 0; idx-- {
+			ip[idx]++
+			if ip[idx] != 0 {
+				break
+			}
+		}
+		ips = append(ips, ip.String())
+	}
+	return ips, nil
+}
+
+// parsesans parses the hosts of a single role. Names are normalized and IP addresses canonicalized
+// so they compare equal to what ends up in the certificates, every problem found is added to problems.
+func parsesans(role string, hosts *string, single bool, problems *ValidationError) map[string][]string {
 	if hosts == nil || *hosts == "" {
-		return nil, fmt.Errorf("must have at least one host")
+		problems.add("%s: must have at least one host", role)
+		return nil
 	}
 
 	hostslist := strings.Split(*hosts, ",")
 	if single && len(hostslist) > 1 {
-		return nil, fmt.Errorf("only one main api host allowed")
+		problems.add("%s: only one main api host allowed", role)
+		return nil
 	}
 	var hostmap = make(map[string][]string)
 
 	for _, host := range hostslist {
 
-		extrasans := strings.Split(host, "/")
-		if len(extrasans) > 2 {
-			return nil, fmt.Errorf("only node name per host allowed")
+		// URIs carry slashes of their own, everything past the first one are alt names
+		extrasans := strings.SplitN(host, "/", 2)
+
+		var node string
+		var err error
+		if role == "apisans" {
+			node, err = canonicalSan(extrasans[0], true)
+		} else {
+			node = NormalizeName(extrasans[0])
+			err = validateDNSName(node, false)
 		}
-		node := extrasans[0]
-		if len(extrasans) > 1 {
-			hostmap[node] = strings.Split(extrasans[1], ":")
-			for _, extrasan := range hostmap[node] {
-				if extrasan == "" {
-					return nil, fmt.Errorf("any extrasan supplied must not be empty for %q", node)
-				}
+		if err != nil {
+			problems.add("%s: %q: invalid node name %q: %v", role, host, extrasans[0], err)
+			continue
+		}
+		if _, ok := hostmap[node]; ok {
+			problems.add("%s: %q: node %q is listed more than once", role, host, node)
+			continue
+		}
+		hostmap[node] = nil
+		if len(extrasans) < 2 {
+			continue
+		}
+
+		known := map[string]struct{}{node: {}}
+		for _, extrasan := range splitSans(extrasans[1]) {
+			if extrasan == "" {
+				problems.add("%s: %q: any extrasan supplied must not be empty (IPv6 addresses go in brackets)", role, host)
+				continue
 			}
-		} else {
-			hostmap[node] = nil
+			san, err := canonicalSan(extrasan, true)
+			if err != nil {
+				problems.add("%s: %q: %v", role, host, err)
+				continue
+			}
+			if _, ok := known[san]; ok {
+				continue
+			}
+			known[san] = struct{}{}
+			hostmap[node] = append(hostmap[node], san)
 		}
 	}
-	return hostmap, nil
+	return hostmap
 }
+
+// getUsers adds a client cert template per user, users given as user/group[/email]
 func getUsers(users *string) (err error) {
+	if users == nil || *users == "" {
+		return nil
+	}
 	usergroups := strings.Split(*users, ",")
 	var kubeUser string
 	var kubeGroup string
 	for _, ug := range usergroups {
 		user_gr := strings.Split(ug, "/")
-		if len(user_gr) < 2 {
+		if len(user_gr) < 2 || len(user_gr) > 3 {
 			fmt.Printf("invalid user: %q", ug)
 			continue
 		}
 		kubeUser = user_gr[0]
 		kubeGroup = user_gr[1]
+		var extraSans []string
+		if len(user_gr) == 3 {
+			if sslutil.SanKind(user_gr[2]) != sslutil.SanEmail {
+				return fmt.Errorf("user %q: %q is not an email address", kubeUser, user_gr[2])
+			}
+			email, err := canonicalEmail(user_gr[2])
+			if err != nil {
+				return fmt.Errorf("user %q: %v", kubeUser, err)
+			}
+			extraSans = []string{email}
+		}
 		kubeCertTemplates = append(kubeCertTemplates, KubeCertTemplate{
-			path:                 "/etc/kubernetes/pki/users/" + kubeUser,
+			path:                 UsersPath + kubeUser,
 			usages:               []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
 			parent:               "/etc/kubernetes/pki/ca",
+			extraSans:            extraSans,
 			commonnameTemplate:   kubeUser,
 			organisationTemplate: kubeGroup,
 		})
 	}
 	return nil
 }
+
+// ParseHosts parses and validates a cluster definition the way Execute does
+func ParseHosts(apisans *string, masters *string, workers *string, etcd *string) (hosts KubeHostsAll, err error) {
+	kubeHosts, err := getKubehosts(apisans, masters, workers, etcd)
+	if err != nil {
+		return nil, err
+	}
+	return *kubeHosts, nil
+}
+
 func getKubehosts(apisans *string, masters *string, workers *string, etcd *string) (cluster *KubeHostsAll, err error) {
 
 	var kh = KubeHostsAll{
@@ -578,30 +925,21 @@ func getKubehosts(apisans *string, masters *string, workers *string, etcd *strin
 		"etcd":    map[string][]string{},
 	}
 
-	api, err := parsesans(apisans, false)
-	if err != nil {
-		return nil, err
-	}
-	kh["apisans"] = api
-	mst, err := parsesans(masters, false)
-	if err != nil {
-		return nil, err
-	}
-	kh["masters"] = mst
-
-	wrk, err := parsesans(workers, false)
-	if err != nil {
-		return nil, err
-	}
-	kh["workers"] = wrk
-
-	etc, err := parsesans(etcd, false)
+	problems := &ValidationError{}
+	kh["apisans"] = parsesans("apisans", apisans, false, problems)
+	kh["masters"] = parsesans("masters", masters, false, problems)
+	kh["workers"] = parsesans("workers", workers, false, problems)
 
-	if err == nil {
-		kh["etcd"] = etc
+	// etcd runs on the masters unless given explicitly
+	if etcd == nil || *etcd == "" {
+		kh["etcd"] = kh["masters"]
 	} else {
-		kh["etcd"] = mst
+		kh["etcd"] = parsesans("etcd", etcd, false, problems)
 	}
 
+	validateHosts(kh, problems)
+	if err = problems.errorOrNil(); err != nil {
+		return nil, err
+	}
 	return &kh, nil
 }
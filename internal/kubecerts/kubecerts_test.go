@@ -0,0 +1,267 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"crypto/x509"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"github.com/stefan-kiss/genkubessl/internal/testutil"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestServiceIPs(t *testing.T) {
+	tests := map[string][]string{
+		"":                                nil,
+		"10.96.0.0/12":                    {"10.96.0.1"},
+		"10.96.0.10/12":                   {"10.96.0.1"},
+		"192.168.0.0/24,fd00:10:96::/112": {"192.168.0.1", "fd00:10:96::1"},
+		"fd00::ff:ffff:ff00/120":          {"fd00::ff:ffff:ff01"},
+	}
+	for cidr, want := range tests {
+		got, err := ServiceIPs(cidr)
+		if err != nil {
+			t.Errorf("ServiceIPs(%q) error = %v", cidr, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ServiceIPs(%q) = %v, want %v", cidr, got, want)
+		}
+	}
+	for _, cidr := range []string{"10.96.0.1", "10.0.0.0/8,10.1.0.0/16", "10.0.0.0/31"} {
+		if _, err := ServiceIPs(cidr); err == nil {
+			t.Errorf("ServiceIPs(%q) should fail", cidr)
+		}
+	}
+}
+
+func TestMakeSansServiceAndDomain(t *testing.T) {
+	defer func() { clusterDomain = DefaultClusterDomain }()
+	clusterDomain = "k8s.internal"
+	hosts := KubeHostsAll{
+		"services": {"kubernetes": {"10.96.0.1"}},
+	}
+	sans := makeSans(hosts, "", "", false, false, true, []string{"kubernetes.default.svc.{{.ClusterDomain}}"})
+	sort.Strings(sans)
+	want := []string{"10.96.0.1", "kubernetes.default.svc.k8s.internal"}
+	if !reflect.DeepEqual(sans, want) {
+		t.Errorf("makeSans() = %v, want %v", sans, want)
+	}
+}
+
+func TestCheckCreateCertsRepairsMismatchedPairs(t *testing.T) {
+	builtin := append([]KubeCertTemplate{}, kubeCertTemplates...)
+	defer func() {
+		kubeCertTemplates = builtin
+		AllKubeCerts = make([]*KubeCert, 0)
+		KubeCAMap = make(map[string]int)
+	}()
+	tmp, err := ioutil.TempDir("", "genkubessl-kubecerts")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	templates := []CertTemplateConfig{
+		{Path: "/etc/x/a", Parent: "/etc/kubernetes/pki/ca", CommonName: "a", Usages: []string{"client"}},
+		{Path: "/etc/x/b", Parent: "/etc/kubernetes/pki/ca", CommonName: "b", Usages: []string{"client"}},
+	}
+	run := func() {
+		kubeCertTemplates = append([]KubeCertTemplate{}, builtin...)
+		AllKubeCerts = make([]*KubeCert, 0)
+		KubeCAMap = make(map[string]int)
+		if err := ExecuteTemplates(cfg, templates); err != nil {
+			t.Fatalf("ExecuteTemplates() error = %v", err)
+		}
+	}
+	run()
+
+	// swap the keys of the two leaves and give the CA a key of its own
+	aKey, _ := drv.Read("global/etc/x/a.key")
+	bKey, _ := drv.Read("global/etc/x/b.key")
+	otherKey, _ := sslutil.NewPrivateKey("ED25519")
+	otherPEM, _ := sslutil.MarshalPrivateKeyToPEM(otherKey)
+	_ = drv.WriteBatch(map[string][]byte{
+		"global/etc/x/a.key":               bKey,
+		"global/etc/x/b.key":               aKey,
+		"global/etc/kubernetes/pki/ca.key": otherPEM,
+	})
+	run()
+
+	for _, name := range []string{"etc/kubernetes/pki/ca", "etc/x/a", "etc/x/b"} {
+		certPEM, _ := drv.Read("global/" + name + ".crt")
+		keyPEM, _ := drv.Read("global/" + name + ".key")
+		crt, key, err := sslutil.LoadCrtAndKeyFromPEM(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err = sslutil.KeyMatchesCrt(crt, key); err != nil {
+			t.Errorf("%s was not repaired: %v", name, err)
+		}
+	}
+}
+
+func TestCheckCreateCertsRenewsExpiring(t *testing.T) {
+	defer Reset()
+	tmp, err := ioutil.TempDir("", "genkubessl-kubecerts")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	templates := []CertTemplateConfig{
+		{Path: "/etc/x/a", Parent: "/etc/kubernetes/pki/ca", CommonName: "a", Usages: []string{"client"}},
+	}
+	run := func(before time.Duration) []byte {
+		Reset()
+		renewBefore = before
+		if err := ExecuteTemplates(cfg, templates); err != nil {
+			t.Fatalf("ExecuteTemplates() error = %v", err)
+		}
+		content, _ := drv.Read("global/etc/x/a.crt")
+		return content
+	}
+	first := run(CheckCertMinValid)
+	if !reflect.DeepEqual(run(CheckCertMinValid), first) || Changed {
+		t.Errorf("cert outside of the renewal window was renewed")
+	}
+	// everything is issued for 10 years
+	if reflect.DeepEqual(run(11*sslutil.Duration365d), first) || !Changed {
+		t.Errorf("cert within the renewal window was not renewed")
+	}
+	if got := len(kubeCertTemplates); got != 2 {
+		t.Errorf("len(kubeCertTemplates) = %d after Reset, want the CA and the declared template", got)
+	}
+}
+
+func TestCheckCreateCertsMaterialize(t *testing.T) {
+	defer Reset()
+	src, err := ioutil.TempDir("", "genkubessl-kubecerts-src")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "genkubessl-kubecerts-dst")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dst)
+	srcDrv := file.NewStoreFile(src)
+	dstDrv := file.NewStoreFile(dst)
+	templates := []CertTemplateConfig{
+		{Path: "/etc/x/a", Parent: "/etc/kubernetes/pki/ca", CommonName: "a", Usages: []string{"client"}},
+	}
+	run := func(cfg config.GlobalConfig) {
+		Reset()
+		if err := ExecuteTemplates(cfg, templates); err != nil {
+			t.Fatalf("ExecuteTemplates() error = %v", err)
+		}
+	}
+	run(config.GlobalConfig{WriteDriver: srcDrv, ReadDriver: srcDrv})
+
+	cfg := config.GlobalConfig{WriteDriver: dstDrv, ReadDriver: srcDrv}
+	run(cfg)
+	if files, _ := dstDrv.List(GlobalPath); len(files) != 0 || Changed {
+		t.Fatalf("valid certs copied to the destination without materialize: %v", files)
+	}
+
+	cfg.Materialize = true
+	for idx, wantChanged := range []bool{true, false} {
+		run(cfg)
+		if Changed != wantChanged {
+			t.Errorf("run %d: Changed = %t, want %t", idx, Changed, wantChanged)
+		}
+		for _, name := range []string{"global/etc/kubernetes/pki/ca", "global/etc/x/a"} {
+			for _, ext := range []string{".crt", ".key"} {
+				want, _ := srcDrv.Read(name + ext)
+				got, err := dstDrv.Read(name + ext)
+				if err != nil || string(got) != string(want) {
+					t.Errorf("run %d: %s%s not copied from the source: %v", idx, name, ext, err)
+				}
+			}
+		}
+	}
+}
+
+func TestCheckCreateCertsReissueUsages(t *testing.T) {
+	defer Reset()
+	drv, cleanup := testutil.TempStore(t)
+	defer cleanup()
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	templates := []CertTemplateConfig{
+		{Path: "/etc/x/a", Parent: "/etc/kubernetes/pki/ca", CommonName: "a", Usages: []string{"client"}},
+	}
+	run := func() {
+		Reset()
+		if err := ExecuteTemplates(cfg, templates); err != nil {
+			t.Fatalf("ExecuteTemplates() error = %v", err)
+		}
+	}
+	run()
+
+	// certs issued by earlier versions carry no extended key usage at all, they are left alone by default
+	ca := testutil.Load(t, drv, "global/etc/kubernetes/pki/ca")
+	testutil.Store(t, drv, "global/etc/x/a", testutil.WithoutUsages(t, ca, testutil.Load(t, drv, "global/etc/x/a")))
+	run()
+	if Changed {
+		t.Fatalf("cert without extended key usage was reissued without ReissueUsages")
+	}
+	Reset()
+	ReissueUsages = true
+	if err := ExecuteTemplates(cfg, templates); err != nil {
+		t.Fatalf("ExecuteTemplates() error = %v", err)
+	}
+	if !Changed {
+		t.Fatalf("cert without extended key usage was not reissued")
+	}
+	got := testutil.Load(t, drv, "global/etc/x/a").Crt.ExtKeyUsage
+	if !reflect.DeepEqual(got, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+		t.Errorf("reissued cert ExtKeyUsage = %v, want client auth", got)
+	}
+	run()
+	if Changed {
+		t.Errorf("reissued cert was reissued again")
+	}
+}
+
+func TestSameUsages(t *testing.T) {
+	server, client := x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth
+	tests := []struct {
+		got, want []x509.ExtKeyUsage
+		same      bool
+	}{
+		{nil, nil, true},
+		{[]x509.ExtKeyUsage{client, server}, []x509.ExtKeyUsage{server, client}, true},
+		{nil, []x509.ExtKeyUsage{client}, false},
+		{[]x509.ExtKeyUsage{client, server}, []x509.ExtKeyUsage{client}, false},
+		{[]x509.ExtKeyUsage{server}, []x509.ExtKeyUsage{client}, false},
+	}
+	for _, test := range tests {
+		if got := sameUsages(test.got, test.want); got != test.same {
+			t.Errorf("sameUsages(%v, %v) = %t, want %t", test.got, test.want, got, test.same)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// CertTemplateConfig declares an extra certificate in configuration. It is turned into
+// a KubeCertTemplate and goes through the same pipeline as the built in ones.
+type CertTemplateConfig struct {
+	// Path of the cert and key, without extension. Example: "/etc/kubernetes/pki/etcd/calico-client"
+	Path string `json:"Path"`
+	// Parent is the path of the signing CA, empty for a new CA. CA's must be declared before the certs they sign.
+	Parent string `json:"Parent"`
+	// Nodes lists the node roles (masters, workers, etcd) getting their own copy, empty for a global cert
+	Nodes []string `json:"Nodes"`
+	// CommonName, Organisation and ExtraSans are templates, {{.NodeName}} is the node the cert
+	// is issued for and {{.ClusterDomain}} the cluster DNS domain
+	CommonName   string `json:"CommonName"`
+	Organisation string `json:"Organisation"`
+	// Usages: "client" and/or "server"
+	Usages    []string `json:"Usages"`
+	NodeSans  bool     `json:"NodeSans"`
+	ApiSans   bool     `json:"ApiSans"`
+	ExtraSans []string `json:"ExtraSans"`
+}
+
+var (
+	templateUsages = map[string]x509.ExtKeyUsage{
+		"client": x509.ExtKeyUsageClientAuth,
+		"server": x509.ExtKeyUsageServerAuth,
+	}
+	templateNodes = map[string]struct{}{
+		"masters": {},
+		"workers": {},
+		"etcd":    {},
+	}
+)
+
+// ParseTemplates reads a JSON list of certificate templates
+func ParseTemplates(content []byte) (templates []CertTemplateConfig, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&templates); err != nil {
+		return nil, fmt.Errorf("invalid certificate templates: %v", err)
+	}
+	return templates, nil
+}
+
+// toKubeCertTemplate validates a declared template against the ones known so far
+func (c CertTemplateConfig) toKubeCertTemplate(known []KubeCertTemplate) (tpl KubeCertTemplate, err error) {
+	if c.Path == "" || !path.IsAbs(c.Path) || path.Clean(c.Path) != c.Path || path.Ext(c.Path) != "" {
+		return tpl, fmt.Errorf("path must be absolute, clean and without extension")
+	}
+	parentKnown := c.Parent == ""
+	for _, other := range known {
+		if other.path == c.Path {
+			return tpl, fmt.Errorf("path already used by another certificate")
+		}
+		if other.path == c.Parent {
+			if other.parent != "" {
+				return tpl, fmt.Errorf("parent %q is not a CA", c.Parent)
+			}
+			parentKnown = true
+		}
+	}
+	if !parentKnown {
+		return tpl, fmt.Errorf("parent %q is not a CA declared before", c.Parent)
+	}
+	if c.Parent == "" && (len(c.Nodes) > 0 || len(c.Usages) > 0 || c.NodeSans || c.ApiSans || len(c.ExtraSans) > 0) {
+		return tpl, fmt.Errorf("a CA can not have nodes, usages or alt names")
+	}
+	for _, nodetype := range c.Nodes {
+		if _, ok := templateNodes[nodetype]; !ok {
+			return tpl, fmt.Errorf("unknown node role %q", nodetype)
+		}
+	}
+	if c.NodeSans && len(c.Nodes) == 0 {
+		return tpl, fmt.Errorf("NodeSans requires Nodes")
+	}
+	if c.Parent != "" && len(c.Usages) == 0 {
+		return tpl, fmt.Errorf("at least one usage is required")
+	}
+	var usages []x509.ExtKeyUsage
+	for _, usage := range c.Usages {
+		extUsage, ok := templateUsages[strings.ToLower(usage)]
+		if !ok {
+			return tpl, fmt.Errorf("unknown usage %q", usage)
+		}
+		usages = append(usages, extUsage)
+	}
+	if strings.TrimSpace(c.CommonName) == "" {
+		return tpl, fmt.Errorf("CommonName is required")
+	}
+	for _, text := range []string{c.CommonName, c.Organisation} {
+		if _, err = template.New("template").Parse(text); err != nil {
+			return tpl, fmt.Errorf("invalid template %q: %v", text, err)
+		}
+	}
+	for _, san := range c.ExtraSans {
+		if strings.TrimSpace(san) == "" {
+			return tpl, fmt.Errorf("extra alt names must not be empty")
+		}
+		if _, err = template.New("template").Parse(san); err != nil {
+			return tpl, fmt.Errorf("invalid template %q: %v", san, err)
+		}
+		if strings.Contains(san, "{{") {
+			continue
+		}
+		if _, err = canonicalSan(san, true); err != nil {
+			return tpl, fmt.Errorf("invalid alt name: %v", err)
+		}
+	}
+
+	return KubeCertTemplate{
+		path:                 c.Path,
+		usages:               usages,
+		parent:               c.Parent,
+		nodes:                c.Nodes,
+		nodeSans:             c.NodeSans,
+		apiSans:              c.ApiSans,
+		extraSans:            c.ExtraSans,
+		commonnameTemplate:   c.CommonName,
+		organisationTemplate: c.Organisation,
+	}, nil
+}
+
+// AddTemplates validates the declared templates and appends them to the built in ones,
+// the same way -users does. Nothing is added unless every template is valid.
+func AddTemplates(templates []CertTemplateConfig) (err error) {
+	known := append([]KubeCertTemplate{}, kubeCertTemplates...)
+	for idx, c := range templates {
+		tpl, err := c.toKubeCertTemplate(known)
+		if err != nil {
+			return fmt.Errorf("certificate template %d (%q): %v", idx, c.Path, err)
+		}
+		known = append(known, tpl)
+	}
+	kubeCertTemplates = known
+	return nil
+}
+
+// ExecuteTemplates runs the pipeline for the declared templates only, along with the built in CA's they are signed by.
+// No cluster definition is involved: templates for nodes are not rendered.
+func ExecuteTemplates(GlobalCfg config.GlobalConfig, templates []CertTemplateConfig) (err error) {
+	parents := make(map[string]struct{})
+	for _, c := range templates {
+		parents[c.Parent] = struct{}{}
+	}
+	var cas []KubeCertTemplate
+	for _, tpl := range kubeCertTemplates {
+		if _, ok := parents[tpl.path]; ok && tpl.parent == "" {
+			cas = append(cas, tpl)
+		}
+	}
+	kubeCertTemplates = cas
+	if err = AddTemplates(templates); err != nil {
+		return err
+	}
+
+	KubeHosts = KubeHostsAll{}
+	if err = RenderCertTemplates(KubeHosts, "", false); err != nil {
+		return err
+	}
+	return CheckCreateCerts(GlobalCfg)
+}
+
+// StoredCert returns the cert and key loaded or generated by CheckCreateCerts for a global template path
+func StoredCert(tplPath string) (certPEM []byte, keyPEM []byte, ok bool) {
+	for _, crt := range AllKubeCerts {
+		if crt.node == "" && kubeCertTemplates[crt.templateIdx].path == tplPath {
+			return crt.certPEM, crt.keyPEM, true
+		}
+	}
+	return nil, nil, false
+}
+
+// TemplateCAs returns the paths of the certificate authorities among the templates known so far
+func TemplateCAs() (cas []string) {
+	for _, tpl := range kubeCertTemplates {
+		if tpl.parent == "" {
+			cas = append(cas, tpl.path)
+		}
+	}
+	return cas
+}
+
+// ExpectedIssuer returns the CA that signs the cert at tplPath and the usages it is issued for,
+// ok is false for paths no known template (or user cert) lives at. CA's have no parent.
+func ExpectedIssuer(tplPath string) (parent string, usages []x509.ExtKeyUsage, ok bool) {
+	for _, tpl := range kubeCertTemplates {
+		if tpl.path == tplPath {
+			return tpl.parent, tpl.usages, true
+		}
+	}
+	if strings.HasPrefix(tplPath, UsersPath) {
+		return "/etc/kubernetes/pki/ca", []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, true
+	}
+	return "", nil, false
+}
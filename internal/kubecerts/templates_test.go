@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"crypto/x509"
+	"reflect"
+	"testing"
+)
+
+func TestAddTemplates(t *testing.T) {
+	builtin := kubeCertTemplates
+	defer func() { kubeCertTemplates = builtin }()
+
+	templates, err := ParseTemplates([]byte(`[
+		{"Path": "/etc/kubernetes/pki/metrics-ca", "CommonName": "metrics-ca"},
+		{"Path": "/etc/kubernetes/pki/scraper", "Parent": "/etc/kubernetes/pki/metrics-ca",
+		 "Nodes": ["workers"], "CommonName": "scraper:{{.NodeName}}", "Usages": ["client", "Server"], "NodeSans": true}
+	]`))
+	if err != nil {
+		t.Fatalf("ParseTemplates() error = %v", err)
+	}
+	if err = AddTemplates(templates); err != nil {
+		t.Fatalf("AddTemplates() error = %v", err)
+	}
+	if len(kubeCertTemplates) != len(builtin)+2 {
+		t.Fatalf("AddTemplates() added %d templates", len(kubeCertTemplates)-len(builtin))
+	}
+	scraper := kubeCertTemplates[len(kubeCertTemplates)-1]
+	want := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth}
+	if !reflect.DeepEqual(scraper.usages, want) || !scraper.nodeSans || scraper.parent != "/etc/kubernetes/pki/metrics-ca" {
+		t.Errorf("AddTemplates() template = %+v", scraper)
+	}
+}
+
+func TestAddTemplatesInvalid(t *testing.T) {
+	builtin := kubeCertTemplates
+	defer func() { kubeCertTemplates = builtin }()
+
+	tests := map[string]CertTemplateConfig{
+		"relative path":   {Path: "etc/x", Parent: "/etc/kubernetes/pki/ca", CommonName: "x", Usages: []string{"client"}},
+		"extension":       {Path: "/etc/x.crt", Parent: "/etc/kubernetes/pki/ca", CommonName: "x", Usages: []string{"client"}},
+		"duplicate path":  {Path: "/etc/kubernetes/pki/admin", Parent: "/etc/kubernetes/pki/ca", CommonName: "x", Usages: []string{"client"}},
+		"unknown parent":  {Path: "/etc/x", Parent: "/etc/missing-ca", CommonName: "x", Usages: []string{"client"}},
+		"parent not a CA": {Path: "/etc/x", Parent: "/etc/kubernetes/pki/admin", CommonName: "x", Usages: []string{"client"}},
+		"unknown role":    {Path: "/etc/x", Parent: "/etc/kubernetes/pki/ca", Nodes: []string{"db"}, CommonName: "x", Usages: []string{"client"}},
+		"unknown usage":   {Path: "/etc/x", Parent: "/etc/kubernetes/pki/ca", CommonName: "x", Usages: []string{"sign"}},
+		"no usage":        {Path: "/etc/x", Parent: "/etc/kubernetes/pki/ca", CommonName: "x"},
+		"no common name":  {Path: "/etc/x", Parent: "/etc/kubernetes/pki/ca", Usages: []string{"client"}},
+		"bad template":    {Path: "/etc/x", Parent: "/etc/kubernetes/pki/ca", CommonName: "{{.NodeName", Usages: []string{"client"}},
+		"CA with nodes":   {Path: "/etc/x", Nodes: []string{"masters"}, CommonName: "x"},
+	}
+	for name, tpl := range tests {
+		if err := AddTemplates([]CertTemplateConfig{tpl}); err == nil {
+			t.Errorf("%s: AddTemplates() should fail", name)
+		}
+		if len(kubeCertTemplates) != len(builtin) {
+			t.Fatalf("%s: invalid template added", name)
+		}
+	}
+
+	if _, err := ParseTemplates([]byte(`[{"Path": "/etc/x", "Unknown": true}]`)); err == nil {
+		t.Errorf("ParseTemplates() should refuse unknown fields")
+	}
+}
@@ -0,0 +1,209 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxDNSNameLen  = 253
+	maxDNSLabelLen = 63
+)
+
+var (
+	dnsLabelRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+)
+
+// ValidationError lists every problem found in the cluster definition, not just the first one
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid cluster definition:\n\t" + strings.Join(e.Problems, "\n\t")
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// errorOrNil keeps a typed nil from turning into a non nil error
+func (e *ValidationError) errorOrNil() error {
+	if len(e.Problems) == 0 {
+		return nil
+	}
+	return e
+}
+
+// NormalizeName lowercases a DNS name and drops the trailing dot of fully qualified names
+func NormalizeName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// validateDNSName checks name is a RFC 1123 DNS name. With wildcard the leftmost label
+// may be "*" provided at least two labels follow it.
+func validateDNSName(name string, wildcard bool) (err error) {
+	if name == "" {
+		return fmt.Errorf("empty name")
+	}
+	if len(name) > maxDNSNameLen {
+		return fmt.Errorf("longer than %d characters", maxDNSNameLen)
+	}
+	labels := strings.Split(name, ".")
+	if labels[0] == "*" {
+		if !wildcard {
+			return fmt.Errorf("wildcards are not allowed here")
+		}
+		if len(labels) < 3 {
+			return fmt.Errorf("wildcards need at least two labels after them")
+		}
+		labels = labels[1:]
+	}
+	for _, label := range labels {
+		if strings.Contains(label, "*") {
+			return fmt.Errorf("a wildcard can only be the whole leftmost label")
+		}
+		if len(label) > maxDNSLabelLen {
+			return fmt.Errorf("label %q longer than %d characters", label, maxDNSLabelLen)
+		}
+		if !dnsLabelRegexp.MatchString(label) {
+			return fmt.Errorf("label %q is not a valid RFC 1123 label", label)
+		}
+	}
+	return nil
+}
+
+// canonicalSan returns an alt name in the form it has once in a certificate: IP addresses
+// (IPv6 optionally in brackets) in their canonical notation, URIs as url.URL prints them,
+// DNS names and the domain of email addresses normalized.
+func canonicalSan(san string, wildcard bool) (canonical string, err error) {
+	if strings.HasPrefix(san, "[") && strings.HasSuffix(san, "]") {
+		inner := san[1 : len(san)-1]
+		if sslutil.SanKind(inner) == sslutil.SanURI {
+			return canonicalSan(inner, wildcard)
+		}
+		ip := net.ParseIP(inner)
+		if ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("%q is not a valid IPv6 address", san)
+		}
+		return ip.String(), nil
+	}
+
+	switch sslutil.SanKind(san) {
+	case sslutil.SanIP:
+		return net.ParseIP(san).String(), nil
+	case sslutil.SanURI:
+		return canonicalURI(san)
+	case sslutil.SanEmail:
+		return canonicalEmail(san)
+	}
+	name := NormalizeName(san)
+	if err = validateDNSName(name, wildcard); err != nil {
+		return "", fmt.Errorf("%q is neither an IP address nor a valid DNS name: %v", san, err)
+	}
+	return name, nil
+}
+
+// canonicalURI accepts absolute URIs with a host, SPIFFE IDs (spiffe://<trust domain>/<path>) being the typical use
+func canonicalURI(san string) (canonical string, err error) {
+	uri, err := url.Parse(san)
+	if err != nil {
+		return "", fmt.Errorf("%q is not a valid URI: %v", san, err)
+	}
+	if uri.Host == "" {
+		return "", fmt.Errorf("%q is not a valid URI: missing host", san)
+	}
+	if uri.User != nil {
+		return "", fmt.Errorf("%q is not a valid URI: user info is not allowed", san)
+	}
+	uri.Host = strings.ToLower(uri.Host)
+	return uri.String(), nil
+}
+
+// canonicalEmail accepts local@domain, lowercasing the domain only as the local part is case sensitive
+func canonicalEmail(san string) (canonical string, err error) {
+	at := strings.LastIndex(san, "@")
+	local, domain := san[:at], NormalizeName(san[at+1:])
+	if local == "" || strings.ContainsAny(local, "@ \t\"") {
+		return "", fmt.Errorf("%q is not a valid email address: invalid local part", san)
+	}
+	if err = validateDNSName(domain, false); err != nil {
+		return "", fmt.Errorf("%q is not a valid email address: %v", san, err)
+	}
+	return local + "@" + domain, nil
+}
+
+// splitSans splits the colon separated alt names of a host, leaving bracketed IPv6 addresses (and URIs)
+// alone as well as the "://" of URIs. URIs with more colons (a port) have to go in brackets.
+func splitSans(sans string) (parts []string) {
+	depth := 0
+	start := 0
+	for idx, c := range sans {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ':':
+			if depth == 0 && !strings.HasPrefix(sans[idx:], "://") {
+				parts = append(parts, sans[start:idx])
+				start = idx + 1
+			}
+		}
+	}
+	return append(parts, sans[start:])
+}
+
+// validateHosts checks the cluster definition as a whole: a node is either a master or a worker
+// (etcd members may be masters as well) and an IP address belongs to a single node.
+// The api alt names are left out, they often point to one of the masters.
+func validateHosts(kh KubeHostsAll, problems *ValidationError) {
+	for node := range kh["masters"] {
+		if _, ok := kh["workers"][node]; ok {
+			problems.add("node %q is both a master and a worker", node)
+		}
+	}
+
+	ipOwners := make(map[string]string)
+	for _, role := range []string{"masters", "workers", "etcd"} {
+		nodes := make([]string, 0, len(kh[role]))
+		for node := range kh[role] {
+			nodes = append(nodes, node)
+		}
+		sort.Strings(nodes)
+		for _, node := range nodes {
+			for _, san := range append([]string{node}, kh[role][node]...) {
+				if net.ParseIP(san) == nil {
+					continue
+				}
+				if owner, ok := ipOwners[san]; ok && owner != node {
+					problems.add("IP address %s is used by both %q and %q", san, owner, node)
+					continue
+				}
+				ipOwners[san] = node
+			}
+		}
+	}
+}
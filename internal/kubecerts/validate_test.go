@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubecerts
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCanonicalSan(t *testing.T) {
+	tests := map[string]string{
+		"Master1.Example.ORG.":     "master1.example.org",
+		"*.apps.example.org":       "*.apps.example.org",
+		"10.0.0.1":                 "10.0.0.1",
+		"FD00:0:0:0:0:0:0:1":       "fd00::1",
+		"[fd00:0000::0001]":        "fd00::1",
+		"::ffff:10.0.0.1":          "10.0.0.1",
+		"a-b.c":                    "a-b.c",
+		strings.Repeat("a", 63):    strings.Repeat("a", 63),
+		"xn--bcher-kva.example.de": "xn--bcher-kva.example.de",
+		"SPIFFE://Cluster.Local/ns/Default/sa/web": "spiffe://cluster.local/ns/Default/sa/web",
+		"[https://registry.example.org:5000/v2]":   "https://registry.example.org:5000/v2",
+		"Bob.John@Example.ORG":                     "Bob.John@example.org",
+	}
+	for san, want := range tests {
+		got, err := canonicalSan(san, true)
+		if err != nil {
+			t.Errorf("canonicalSan(%q) error = %v", san, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("canonicalSan(%q) = %q, want %q", san, got, want)
+		}
+	}
+
+	invalid := []string{
+		"under_score.example.org",
+		"-dash.example.org",
+		"dash-.example.org",
+		"double..dot",
+		"*.example",
+		"*",
+		"a.*.example.org",
+		"*foo.example.org",
+		"[10.0.0.1]",
+		"[fd00::zz]",
+		strings.Repeat("a", 64),
+		strings.Repeat("a.", 127) + "aa",
+		"spiffe:///no/host",
+		"https://user@example.org/",
+		"@example.org",
+		"bob@bad_domain.org",
+		"bob@@example.org",
+	}
+	for _, san := range invalid {
+		if got, err := canonicalSan(san, true); err == nil {
+			t.Errorf("canonicalSan(%q) = %q, should fail", san, got)
+		}
+	}
+	if _, err := canonicalSan("*.example.org", false); err == nil {
+		t.Errorf("canonicalSan() should refuse wildcards when not allowed")
+	}
+}
+
+func TestSplitSans(t *testing.T) {
+	got := splitSans("10.0.0.1:[fd00::1]:master1.example.org:spiffe://cluster.local/node:[https://a.org:443/]")
+	want := []string{"10.0.0.1", "[fd00::1]", "master1.example.org", "spiffe://cluster.local/node", "[https://a.org:443/]"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("splitSans() = %q, want %q", got, want)
+	}
+}
+
+func TestGetKubehostsNormalizes(t *testing.T) {
+	apisans := "API.example.org./10.0.0.100"
+	masters := "Master1/10.0.0.1:[FD00::0001]:10.0.0.1:master1.example.org."
+	workers := "worker1/10.0.0.11"
+	kh, err := getKubehosts(&apisans, &masters, &workers, nil)
+	if err != nil {
+		t.Fatalf("getKubehosts() error = %v", err)
+	}
+	want := KubeHostsAll{
+		"apisans": {"api.example.org": {"10.0.0.100"}},
+		"masters": {"master1": {"10.0.0.1", "fd00::1", "master1.example.org"}},
+		"workers": {"worker1": {"10.0.0.11"}},
+		"etcd":    {"master1": {"10.0.0.1", "fd00::1", "master1.example.org"}},
+	}
+	if !reflect.DeepEqual(*kh, want) {
+		t.Errorf("getKubehosts() = %v, want %v", *kh, want)
+	}
+}
+
+func TestGetKubehostsReportsEveryProblem(t *testing.T) {
+	apisans := "api.example.org/10.0.0.1"
+	masters := "master1/10.0.0.1,master_2/10.0.0.2,master1/10.0.0.3"
+	workers := "worker1/10.0.0.1:bad_name,master1,*.example.org"
+	etcd := "master1/10.0.0.1,etcd1/fd00::1"
+	_, err := getKubehosts(&apisans, &masters, &workers, &etcd)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("getKubehosts() error = %v, want a *ValidationError", err)
+	}
+
+	want := []string{
+		`masters: "master_2/10.0.0.2": invalid node name "master_2"`,
+		`masters: "master1/10.0.0.3": node "master1" is listed more than once`,
+		`workers: "worker1/10.0.0.1:bad_name": "bad_name" is neither an IP address nor a valid DNS name`,
+		`workers: "*.example.org": invalid node name "*.example.org"`,
+		`etcd: "etcd1/fd00::1": any extrasan supplied must not be empty (IPv6 addresses go in brackets)`,
+		`node "master1" is both a master and a worker`,
+		`IP address 10.0.0.1 is used by both "master1" and "worker1"`,
+	}
+	if len(verr.Problems) != len(want) {
+		t.Errorf("got %d problems, want %d:\n%v", len(verr.Problems), len(want), verr)
+	}
+	for _, problem := range want {
+		if !strings.Contains(verr.Error(), problem) {
+			t.Errorf("missing problem %q in:\n%v", problem, verr)
+		}
+	}
+}
+
+func TestValidateHostsStackedEtcd(t *testing.T) {
+	apisans := "api.example.org/10.0.0.1"
+	masters := "master1/10.0.0.1"
+	workers := "worker1/10.0.0.11"
+	etcd := "master1/10.0.0.1,etcd1/10.0.0.21"
+	if _, err := getKubehosts(&apisans, &masters, &workers, &etcd); err != nil {
+		t.Errorf("getKubehosts() error = %v", err)
+	}
+}
+
+func TestGetUsersEmail(t *testing.T) {
+	base := len(kubeCertTemplates)
+	defer func() { kubeCertTemplates = kubeCertTemplates[:base] }()
+
+	users := "bob/admins/Bob@Example.org,alice/viewers"
+	if err := getUsers(&users); err != nil {
+		t.Fatalf("getUsers() error = %v", err)
+	}
+	if got := kubeCertTemplates[base].extraSans; !reflect.DeepEqual(got, []string{"Bob@example.org"}) {
+		t.Errorf("bob extraSans = %v", got)
+	}
+	if got := kubeCertTemplates[base+1].extraSans; got != nil {
+		t.Errorf("alice extraSans = %v, want none", got)
+	}
+
+	kubeCertTemplates = kubeCertTemplates[:base]
+	users = "carol/admins/not-an-email"
+	if err := getUsers(&users); err == nil {
+		t.Errorf("getUsers() should refuse an invalid email address")
+	}
+}
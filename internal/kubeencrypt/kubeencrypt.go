@@ -0,0 +1,337 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubeencrypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// ConfigPath is where the apiserver --encryption-provider-config lives, relative to the global area
+	ConfigPath = "/etc/kubernetes/encryption-config.yaml"
+
+	apiVersion = "apiserver.config.k8s.io/v1"
+	kind       = "EncryptionConfiguration"
+
+	identityProvider = "identity"
+	secretSize       = 32
+)
+
+var (
+	// TODO return value rather than use global
+	Changed = false
+
+	// Providers lists the supported encrypting providers along with the key sizes they accept
+	Providers = map[string][]int{
+		"aescbc":    {16, 24, 32},
+		"aesgcm":    {16, 24, 32},
+		"secretbox": {32},
+	}
+)
+
+// Reset clears the outcome of a previous run.
+func Reset() {
+	Changed = false
+}
+
+// EncryptionConfig controls what the encryption configuration holds and how its keys are rotated
+type EncryptionConfig struct {
+	// Provider new keys are created for. Keys of other providers are kept for decryption only.
+	Provider string
+	// Resources encrypted at rest
+	Resources []string
+	// Rotate adds a new key on top, demoting the current one to decryption only
+	Rotate bool
+	// Retire drops every key but the current one. Only safe once everything stored was rewritten with it,
+	// never done in a run adding a key.
+	Retire bool
+}
+
+type Key struct {
+	Name   string
+	Secret string
+}
+
+type Provider struct {
+	Name string
+	Keys []Key
+}
+
+// Configuration is the part of an EncryptionConfiguration we manage: a single set of resources
+// encrypted by the first key of the first provider. The identity provider always comes last so
+// data written before encryption was enabled can still be read.
+type Configuration struct {
+	Resources []string
+	Providers []Provider
+}
+
+// Render returns the EncryptionConfiguration manifest
+func (c *Configuration) Render() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "apiVersion: %s\n", apiVersion)
+	fmt.Fprintf(&b, "kind: %s\n", kind)
+	fmt.Fprintf(&b, "resources:\n")
+	fmt.Fprintf(&b, "  - resources:\n")
+	for _, resource := range c.Resources {
+		fmt.Fprintf(&b, "      - %s\n", resource)
+	}
+	fmt.Fprintf(&b, "    providers:\n")
+	for _, provider := range c.Providers {
+		fmt.Fprintf(&b, "      - %s:\n", provider.Name)
+		fmt.Fprintf(&b, "          keys:\n")
+		for _, key := range provider.Keys {
+			fmt.Fprintf(&b, "            - name: %s\n", key.Name)
+			fmt.Fprintf(&b, "              secret: %s\n", key.Secret)
+		}
+	}
+	fmt.Fprintf(&b, "      - %s: {}\n", identityProvider)
+	return b.Bytes()
+}
+
+// Parse reads back a configuration as written by Render. Anything we did not write is
+// refused rather than guessed at: losing a key means losing the data it encrypted.
+func Parse(content []byte) (c *Configuration, err error) {
+	c = &Configuration{}
+	section := ""
+	identity := false
+	for idx, line := range strings.Split(string(content), "\n") {
+		field := strings.TrimSpace(line)
+		if field == "" {
+			continue
+		}
+		if identity {
+			return nil, fmt.Errorf("line %d: nothing is expected after the %s provider", idx+1, identityProvider)
+		}
+		switch {
+		case field == "apiVersion: "+apiVersion, field == "kind: "+kind, field == "resources:" && section == "":
+		case field == "- resources:" && section == "":
+			section = "resources"
+		case field == "providers:" && section == "resources":
+			section = "providers"
+		case section == "resources" && strings.HasPrefix(field, "- "):
+			c.Resources = append(c.Resources, strings.TrimPrefix(field, "- "))
+		case section == "providers" && field == "- "+identityProvider+": {}":
+			identity = true
+		case section == "providers" && strings.HasPrefix(field, "- ") && strings.HasSuffix(field, ":"):
+			c.Providers = append(c.Providers, Provider{Name: strings.TrimSuffix(strings.TrimPrefix(field, "- "), ":")})
+		case section == "providers" && field == "keys:" && len(c.Providers) > 0:
+		case section == "providers" && strings.HasPrefix(field, "- name: ") && len(c.Providers) > 0:
+			provider := &c.Providers[len(c.Providers)-1]
+			provider.Keys = append(provider.Keys, Key{Name: strings.TrimPrefix(field, "- name: ")})
+		case section == "providers" && strings.HasPrefix(field, "secret: ") && len(c.Providers) > 0 && len(c.Providers[len(c.Providers)-1].Keys) > 0:
+			provider := &c.Providers[len(c.Providers)-1]
+			provider.Keys[len(provider.Keys)-1].Secret = strings.TrimPrefix(field, "secret: ")
+		default:
+			return nil, fmt.Errorf("line %d: unexpected %q", idx+1, field)
+		}
+	}
+	if !identity {
+		return nil, fmt.Errorf("%s provider missing", identityProvider)
+	}
+	return c, c.Validate()
+}
+
+// Validate checks every provider and key can actually be used by the apiserver
+func (c *Configuration) Validate() (err error) {
+	if len(c.Resources) == 0 {
+		return fmt.Errorf("no resources to encrypt")
+	}
+	if len(c.Providers) == 0 {
+		return fmt.Errorf("no encrypting provider")
+	}
+	names := make(map[string]struct{})
+	for _, provider := range c.Providers {
+		sizes, ok := Providers[provider.Name]
+		if !ok {
+			return fmt.Errorf("unsupported provider %q", provider.Name)
+		}
+		if len(provider.Keys) == 0 {
+			return fmt.Errorf("provider %q has no keys", provider.Name)
+		}
+		for _, key := range provider.Keys {
+			if _, ok := names[key.Name]; ok || key.Name == "" {
+				return fmt.Errorf("provider %q: invalid or duplicate key name %q", provider.Name, key.Name)
+			}
+			names[key.Name] = struct{}{}
+			secret, err := base64.StdEncoding.DecodeString(key.Secret)
+			if err != nil {
+				return fmt.Errorf("provider %q: key %q is not valid base64: %v", provider.Name, key.Name, err)
+			}
+			if !validSize(sizes, len(secret)) {
+				return fmt.Errorf("provider %q: key %q has invalid size %d", provider.Name, key.Name, len(secret))
+			}
+		}
+	}
+	return nil
+}
+
+func validSize(sizes []int, size int) bool {
+	for _, s := range sizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// AddKey puts a new key for provider on top, every key there was before is kept for decryption
+func (c *Configuration) AddKey(provider string, now time.Time) (err error) {
+	if _, ok := Providers[provider]; !ok {
+		return fmt.Errorf("unsupported provider %q", provider)
+	}
+	secret := make([]byte, secretSize)
+	if _, err = rand.Read(secret); err != nil {
+		return err
+	}
+	key := Key{
+		Name:   c.keyName(now),
+		Secret: base64.StdEncoding.EncodeToString(secret),
+	}
+	if len(c.Providers) > 0 && c.Providers[0].Name == provider {
+		c.Providers[0].Keys = append([]Key{key}, c.Providers[0].Keys...)
+		return nil
+	}
+	c.Providers = append([]Provider{{Name: provider, Keys: []Key{key}}}, c.Providers...)
+	return nil
+}
+
+// keyName derives a unique key name from the time the key is created
+func (c *Configuration) keyName(now time.Time) string {
+	used := make(map[string]struct{})
+	for _, provider := range c.Providers {
+		for _, key := range provider.Keys {
+			used[key.Name] = struct{}{}
+		}
+	}
+	name := "key-" + now.UTC().Format("20060102T150405Z")
+	for n := 1; ; n++ {
+		if _, ok := used[name]; !ok {
+			return name
+		}
+		name = fmt.Sprintf("key-%s-%d", now.UTC().Format("20060102T150405Z"), n)
+	}
+}
+
+// Retire keeps only the key new data is encrypted with
+func (c *Configuration) Retire() {
+	if len(c.Providers) == 0 || len(c.Providers[0].Keys) == 0 {
+		return
+	}
+	c.Providers = []Provider{{Name: c.Providers[0].Name, Keys: c.Providers[0].Keys[:1]}}
+}
+
+// StoredFiles returns the storage paths of every file this package manages.
+func StoredFiles() (files []string) {
+	return []string{path.Join(storage.GlobalPath, ConfigPath)}
+}
+
+func writeConfig(GlobalCfg config.GlobalConfig, content []byte, reason string) (err error) {
+	writePath := path.Join(storage.GlobalPath, ConfigPath)
+	if err = GlobalCfg.History.Save(writePath, reason); err != nil {
+		return err
+	}
+	if err = GlobalCfg.WriteDriver.Write(writePath, content); err != nil {
+		return fmt.Errorf("error writing encryption configuration: %v", err)
+	}
+	return nil
+}
+
+// CheckCreateConfig makes sure the encryption configuration exists, is valid and matches EncCfg.
+// Unlike certificates and keys a broken configuration is never regenerated: the keys in there
+// are the only way to read back what the apiserver stored.
+func CheckCreateConfig(GlobalCfg config.GlobalConfig, EncCfg EncryptionConfig) (err error) {
+	readPath := path.Join(storage.GlobalPath, ConfigPath)
+	now := time.Now()
+
+	failed := ""
+	current, err := GlobalCfg.ReadDriver.Read(readPath)
+	cfg := &Configuration{}
+	if storage.IsNotExist(err) {
+		failed = "encryption configuration missing"
+	} else if err != nil {
+		return fmt.Errorf("error loading encryption configuration: %v", err)
+	} else if cfg, err = Parse(current); err != nil {
+		fmt.Printf("ENC ERROR  : [%-30s] [%-50s] => %q\n", "", ConfigPath, err.Error())
+		return fmt.Errorf("invalid encryption configuration %s, fix or remove it: %v", readPath, err)
+	}
+
+	cfg.Resources = EncCfg.Resources
+	switch {
+	case failed != "":
+	case EncCfg.Rotate:
+		failed = "rotation requested"
+	case cfg.Providers[0].Name != EncCfg.Provider:
+		failed = fmt.Sprintf("provider is %s, %s requested", cfg.Providers[0].Name, EncCfg.Provider)
+	}
+	if failed != "" {
+		if len(cfg.Providers) == 0 {
+			fmt.Printf("ENC ERROR  : [%-30s] [%-50s] => %q\n", "", ConfigPath, failed)
+		} else {
+			fmt.Printf("ENC ROTATE : [%-30s] [%-50s] => %q\n", "", ConfigPath, failed)
+		}
+		if err = cfg.AddKey(EncCfg.Provider, now); err != nil {
+			return err
+		}
+	}
+	switch {
+	case !EncCfg.Retire:
+	case failed != "":
+		// nothing is encrypted with the key added by this very run yet, the old ones are still needed
+		fmt.Printf("ENC KEEP   : [%-30s] [%-50s] => %q\n", "", ConfigPath, "key added by this run, old keys not retired")
+	default:
+		cfg.Retire()
+	}
+	if err = cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid encryption configuration: %v", err)
+	}
+
+	content := cfg.Render()
+	if failed == "" && bytes.Equal(content, current) {
+		fmt.Printf("ENC OK     : [%-30s] [%-50s]\n", "", ConfigPath)
+		if !GlobalCfg.Materialize {
+			return nil
+		}
+		stored, err := GlobalCfg.WriteDriver.Read(readPath)
+		if err == nil && bytes.Equal(stored, content) {
+			return nil
+		}
+		if err = writeConfig(GlobalCfg, content, "materialized from source"); err != nil {
+			return err
+		}
+		fmt.Printf("ENC COPIED : [%-30s] [%-50s]\n", "", ConfigPath)
+		Changed = true
+		return nil
+	}
+	if failed == "" {
+		failed = "configuration changed"
+	}
+	if err = writeConfig(GlobalCfg, content, failed); err != nil {
+		return err
+	}
+	fmt.Printf("ENC WRITTEN: [%-30s] [%-50s]\n", "", ConfigPath)
+	Changed = true
+	return nil
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubeencrypt
+
+import (
+	"bytes"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderParse(t *testing.T) {
+	cfg := &Configuration{Resources: []string{"secrets", "configmaps"}}
+	now := time.Now()
+	for _, provider := range []string{"aescbc", "aescbc", "secretbox"} {
+		if err := cfg.AddKey(provider, now); err != nil {
+			t.Fatalf("AddKey(%q) error = %v", provider, err)
+		}
+	}
+	if len(cfg.Providers) != 2 || cfg.Providers[0].Name != "secretbox" || len(cfg.Providers[1].Keys) != 2 {
+		t.Fatalf("AddKey() providers = %+v", cfg.Providers)
+	}
+
+	content := cfg.Render()
+	parsed, err := Parse(content)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if !bytes.Equal(parsed.Render(), content) {
+		t.Errorf("Parse() does not round trip:\n%s\n%s", parsed.Render(), content)
+	}
+
+	cfg.Retire()
+	if len(cfg.Providers) != 1 || len(cfg.Providers[0].Keys) != 1 {
+		t.Errorf("Retire() providers = %+v", cfg.Providers)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	cfg := &Configuration{Resources: []string{"secrets"}}
+	_ = cfg.AddKey("aesgcm", time.Now())
+	valid := string(cfg.Render())
+
+	tests := map[string]string{
+		"no identity":      valid[:len(valid)-len("      - identity: {}\n")],
+		"unknown field":    valid + "extra: true\n",
+		"short key":        strings.Replace(valid, cfg.Providers[0].Keys[0].Secret, "c2hvcnQ=", 1),
+		"unknown provider": strings.Replace(valid, "- aesgcm:", "- kms:", 1),
+	}
+	for name, content := range tests {
+		if _, err := Parse([]byte(content)); err == nil {
+			t.Errorf("%s: Parse() should fail", name)
+		}
+	}
+}
+
+func TestCheckCreateConfig(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-kubeencrypt")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	encCfg := EncryptionConfig{Provider: "aescbc", Resources: []string{"secrets"}}
+	configPath := path.Join(storage.GlobalPath, ConfigPath)
+
+	if err = CheckCreateConfig(cfg, encCfg); err != nil {
+		t.Fatalf("CheckCreateConfig() error = %v", err)
+	}
+	first, _ := drv.Read(configPath)
+	if err = CheckCreateConfig(cfg, encCfg); err != nil {
+		t.Fatalf("CheckCreateConfig() error = %v", err)
+	}
+	if second, _ := drv.Read(configPath); !bytes.Equal(first, second) {
+		t.Errorf("valid configuration was rewritten")
+	}
+
+	encCfg.Rotate = true
+	if err = CheckCreateConfig(cfg, encCfg); err != nil {
+		t.Fatalf("CheckCreateConfig() error = %v", err)
+	}
+	content, _ := drv.Read(configPath)
+	rotated, err := Parse(content)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if len(rotated.Providers[0].Keys) != 2 {
+		t.Errorf("rotation should keep the previous key, got %+v", rotated.Providers)
+	}
+
+	// retiring along with a rotation would drop the key everything stored is encrypted with
+	encCfg.Retire = true
+	if err = CheckCreateConfig(cfg, encCfg); err != nil {
+		t.Fatalf("CheckCreateConfig() error = %v", err)
+	}
+	content, _ = drv.Read(configPath)
+	if retired, err := Parse(content); err != nil || len(retired.Providers[0].Keys) != 3 {
+		t.Errorf("rotating and retiring at once should keep the old keys, got %+v, %v", retired, err)
+	}
+	encCfg.Rotate = false
+	if err = CheckCreateConfig(cfg, encCfg); err != nil {
+		t.Fatalf("CheckCreateConfig() error = %v", err)
+	}
+	content, _ = drv.Read(configPath)
+	if retired, err := Parse(content); err != nil || len(retired.Providers[0].Keys) != 1 {
+		t.Errorf("retiring should keep only the current key, got %+v, %v", retired, err)
+	}
+	encCfg.Retire = false
+
+	// a broken configuration is never replaced
+	_ = drv.Write(configPath, []byte("garbage\n"))
+	if err = CheckCreateConfig(cfg, encCfg); err == nil {
+		t.Errorf("CheckCreateConfig() should fail on an invalid configuration")
+	}
+	if content, _ = drv.Read(configPath); string(content) != "garbage\n" {
+		t.Errorf("invalid configuration was overwritten")
+	}
+}
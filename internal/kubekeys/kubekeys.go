@@ -19,10 +19,13 @@ package kubekeys
 
 import (
 	"bytes"
+	"encoding/pem"
 	"fmt"
 	"github.com/stefan-kiss/genkubessl/internal/config"
 	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
 	"path/filepath"
+	"time"
 )
 
 type KubeKeyTemplate struct {
@@ -31,9 +34,12 @@ type KubeKeyTemplate struct {
 }
 
 type KubeKey struct {
-	key         interface{}
-	keyPrivPEM  []byte
+	key        interface{}
+	keyPrivPEM []byte
+	// keyPubPEM is the public key bundle as stored: the public key of key first,
+	// followed by the ones of the keys it replaced that are still in their grace period
 	keyPubPEM   []byte
+	retired     []*pem.Block
 	templateIdx int
 	readPath    string
 	writePath   string
@@ -48,8 +54,23 @@ const (
 	// storage related // hardcoded for now
 	GlobalPath = "global"
 	NodesPath  = "nodes"
+
+	// RetiredHeader marks public keys of replaced signing keys in the bundle with the time they were replaced
+	RetiredHeader = "Genkubessl-Retired"
 )
 
+// KeyConfig controls how key pairs are rotated
+type KeyConfig struct {
+	// Rotate replaces the signing keys even if they pass every check
+	Rotate bool
+	// Grace is how long the public keys of replaced signing keys are kept in the bundle,
+	// so tokens they signed keep verifying. 0 drops them right away.
+	Grace time.Duration
+	// KeyType of the signing keys, as accepted by sslutil.NewPrivateKey.
+	// A key of another type gets replaced. Empty keeps the type of the current key (RSA for new ones).
+	KeyType string
+}
+
 var (
 	// TODO return value rather than use global
 	Changed = false
@@ -62,6 +83,40 @@ var (
 	AllKubeKeys []*KubeKey
 )
 
+// Reset forgets the keys of a previous run so CheckCreateKeys can run again within the same process.
+func Reset() {
+	Changed = false
+	AllKubeKeys = nil
+}
+
+// Paths returns the storage paths of every key pair, relative to the global area and without extension
+func Paths() (paths []string) {
+	for _, tpl := range KubeKeyTemplates {
+		paths = append(paths, tpl.path)
+	}
+	return paths
+}
+
+// CheckPair verifies the current public key of bundle belongs to the private key in privPEM
+func CheckPair(privPEM []byte, bundle []byte) (err error) {
+	key, err := sslutil.ParsePrivateKeyPEM(privPEM)
+	if err != nil {
+		return fmt.Errorf("invalid private key: %v", err)
+	}
+	current, _ := splitBundle(bundle)
+	if current == nil {
+		return fmt.Errorf("no public key found")
+	}
+	pubPEM, err := sslutil.EncodePublicKeyPEM(sslutil.PublicKey(key))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pubPEM, pem.EncodeToMemory(current)) {
+		return fmt.Errorf("public and private keys do not match")
+	}
+	return nil
+}
+
 func MakeKeyFromTemplate(GlobalCfg config.GlobalConfig, tpl KubeKeyTemplate, idx int) (kubeKey KubeKey, err error) {
 
 	var readPath, writePath string
@@ -91,34 +146,123 @@ func renderKeys(GlobalCfg config.GlobalConfig) (err error) {
 	return nil
 }
 
-func genKey(k *KubeKey) (err error) {
-	k.key, err = sslutil.NewPrivateKey("")
+func genKey(k *KubeKey, keyType string) (err error) {
+	k.key, err = sslutil.NewPrivateKey(keyType)
+	if err != nil {
+		return err
+	}
+	if k.key == nil {
+		return fmt.Errorf("cannot generate private key of type %q", keyType)
+	}
 	return nil
 }
 
 func genPEM(k *KubeKey) (err error) {
 
-	pub := sslutil.PublicKey(k.key)
-	k.keyPubPEM, _ = sslutil.EncodePublicKeyPEM(pub)
+	k.keyPubPEM, _ = bundlePEM(k)
 	k.keyPrivPEM, _ = sslutil.MarshalPrivateKeyToPEM(k.key)
 	return nil
 }
 
-func writeCerts(GlobalCfg config.GlobalConfig, key *KubeKey) (err error) {
-
-	err = GlobalCfg.WriteDriver.Write(key.writePath+".pub", key.keyPubPEM)
+// bundlePEM encodes the public key of k followed by the retired ones
+func bundlePEM(k *KubeKey) (bundle []byte, err error) {
+	bundle, err = sslutil.EncodePublicKeyPEM(sslutil.PublicKey(k.key))
 	if err != nil {
-		return fmt.Errorf("error writing file for public key")
+		return nil, err
 	}
-	err = GlobalCfg.WriteDriver.Write(key.writePath+".key", key.keyPrivPEM)
+	for _, block := range k.retired {
+		bundle = append(bundle, pem.EncodeToMemory(block)...)
+	}
+	return bundle, nil
+}
+
+// splitBundle returns the first public key of a bundle and every one following it
+func splitBundle(bundle []byte) (current *pem.Block, retired []*pem.Block) {
+	for {
+		var block *pem.Block
+		block, bundle = pem.Decode(bundle)
+		if block == nil {
+			return current, retired
+		}
+		if current == nil {
+			current = block
+			continue
+		}
+		retired = append(retired, block)
+	}
+}
+
+// retire marks the public key of a replaced signing key with the time it got replaced
+func retire(block *pem.Block, now time.Time) *pem.Block {
+	return &pem.Block{
+		Type:    block.Type,
+		Headers: map[string]string{RetiredHeader: now.UTC().Format(time.RFC3339)},
+		Bytes:   block.Bytes,
+	}
+}
+
+// expireRetired drops the retired public keys whose grace period is over.
+// Keys without a (valid) retirement time were not put there by us and are left alone.
+func expireRetired(retired []*pem.Block, grace time.Duration, now time.Time) (kept []*pem.Block, expired []*pem.Block) {
+	for _, block := range retired {
+		retiredAt, err := time.Parse(time.RFC3339, block.Headers[RetiredHeader])
+		if err == nil && !now.Before(retiredAt.Add(grace)) {
+			expired = append(expired, block)
+			continue
+		}
+		kept = append(kept, block)
+	}
+	return kept, expired
+}
+
+// writeCerts writes the private and public key as one unit so they can never get out of sync
+func writeCerts(GlobalCfg config.GlobalConfig, key *KubeKey, reason string) (err error) {
+
+	for _, ext := range []string{".pub", ".key"} {
+		if err = GlobalCfg.History.Save(key.writePath+ext, reason); err != nil {
+			return err
+		}
+	}
+	err = GlobalCfg.WriteDriver.WriteBatch(map[string][]byte{
+		key.writePath + ".pub": key.keyPubPEM,
+		key.writePath + ".key": key.keyPrivPEM,
+	})
 	if err != nil {
-		return fmt.Errorf("error writing file for private key")
+		return fmt.Errorf("error writing files for key pair: %v", err)
 	}
 	return nil
 }
 
-func CheckCreateKeys(GlobalCfg config.GlobalConfig) (err error) {
+// StoredFiles returns the storage paths of every rendered key pair.
+func StoredFiles() (files []string) {
+	for _, key := range AllKubeKeys {
+		files = append(files, key.writePath+".key", key.writePath+".pub")
+	}
+	return files
+}
+
+// materialize copies a valid key pair read from the source storage into the destination
+// unless the destination already holds the exact same keys.
+func materialize(GlobalCfg config.GlobalConfig, key *KubeKey) (copied bool, err error) {
+	dstPrivPEM, privErr := GlobalCfg.WriteDriver.Read(key.writePath + ".key")
+	dstPubPEM, pubErr := GlobalCfg.WriteDriver.Read(key.writePath + ".pub")
+	if privErr == nil && pubErr == nil && bytes.Equal(dstPrivPEM, key.keyPrivPEM) && bytes.Equal(dstPubPEM, key.keyPubPEM) {
+		return false, nil
+	}
+	if err = writeCerts(GlobalCfg, key, "materialized from source"); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func CheckCreateKeys(GlobalCfg config.GlobalConfig, KeyCfg KeyConfig) (err error) {
 
+	// kube-apiserver only verifies service account tokens signed with RSA or ECDSA keys
+	if KeyCfg.KeyType == "ED25519" {
+		return fmt.Errorf("service account keys can not be of type %s", KeyCfg.KeyType)
+	}
+
+	now := time.Now()
 	_ = renderKeys(GlobalCfg)
 	for _, key := range AllKubeKeys {
 
@@ -130,18 +274,26 @@ func CheckCreateKeys(GlobalCfg config.GlobalConfig) (err error) {
 			key.failed = "ForceRegen"
 		}
 
+		// whatever the outcome of the checks, the public keys published so far stay around for their grace period
+		var current *pem.Block
+		if bundle, err := GlobalCfg.ReadDriver.Read(key.readPath + ".pub"); err == nil {
+			current, key.retired = splitBundle(bundle)
+		}
+		var expired []*pem.Block
+		key.retired, expired = expireRetired(key.retired, KeyCfg.Grace, now)
+
 		if key.failed == "" {
 
 			key.keyPrivPEM, err = GlobalCfg.ReadDriver.Read(key.readPath + ".key")
 			if err != nil {
-				key.failed = "error loading public key"
+				key.failed = storage.ReadFailure("private key", err)
 			}
 		}
 
 		if key.failed == "" {
 			key.keyPubPEM, err = GlobalCfg.ReadDriver.Read(key.readPath + ".pub")
 			if err != nil {
-				key.failed = "error private key"
+				key.failed = storage.ReadFailure("public key", err)
 			}
 		}
 
@@ -156,16 +308,34 @@ func CheckCreateKeys(GlobalCfg config.GlobalConfig) (err error) {
 		if key.failed == "" {
 			pub := sslutil.PublicKey(key.key)
 			tempPEM, _ := sslutil.EncodePublicKeyPEM(pub)
-			if !bytes.Equal(tempPEM, key.keyPubPEM) {
+			if current == nil || !bytes.Equal(tempPEM, pem.EncodeToMemory(current)) {
 				key.failed = "error public and private keys do not match"
 			}
 		}
 
-		if key.failed != "" {
+		keyType := KeyCfg.KeyType
+		if key.failed == "" && keyType != "" && sslutil.KeyType(key.key) != keyType {
+			key.failed = fmt.Sprintf("key type is %s, %s requested", sslutil.KeyType(key.key), keyType)
+		}
+		if keyType == "" && key.key != nil {
+			keyType = sslutil.KeyType(key.key)
+		}
+
+		for _, block := range expired {
+			fmt.Printf("KEY EXPIRE : [%-30s] [%-50s] => %q\n", "", keyname+".pub", "retired at "+block.Headers[RetiredHeader])
+		}
+
+		if key.failed == "" && KeyCfg.Rotate {
+			key.failed = "rotation requested"
+			fmt.Printf("KEY ROTATE : [%-30s] [%-50s]\n", "", keyname)
+		} else if key.failed != "" {
 			fmt.Printf("KEY ERROR  : [%-30s] [%-50s] => %q\n", "", keyname, key.failed)
 		}
 		if ForceRegen || (key.failed != "" && OverWrite) {
-			err = genKey(key)
+			if current != nil && KeyCfg.Grace > 0 {
+				key.retired = append([]*pem.Block{retire(current, now)}, key.retired...)
+			}
+			err = genKey(key, keyType)
 			if err != nil {
 				return err
 			}
@@ -174,7 +344,7 @@ func CheckCreateKeys(GlobalCfg config.GlobalConfig) (err error) {
 				return err
 			}
 
-			err = writeCerts(GlobalCfg, key)
+			err = writeCerts(GlobalCfg, key, key.failed)
 			if err != nil {
 				return err
 			}
@@ -182,6 +352,26 @@ func CheckCreateKeys(GlobalCfg config.GlobalConfig) (err error) {
 			Changed = true
 		} else if key.failed == "" {
 			fmt.Printf("KEY OK     : [%-30s] [%-50s]\n", "", keyname)
+			if len(expired) > 0 {
+				key.keyPubPEM, _ = bundlePEM(key)
+				if err = writeCerts(GlobalCfg, key, "retired public keys expired"); err != nil {
+					return err
+				}
+				fmt.Printf("KEY WRITTEN: [%-30s] [%-50s]\n", "", keyname+".pub")
+				Changed = true
+				continue
+			}
+			if !GlobalCfg.Materialize {
+				continue
+			}
+			copied, err := materialize(GlobalCfg, key)
+			if err != nil {
+				return err
+			}
+			if copied {
+				fmt.Printf("KEY COPIED : [%-30s] [%-50s]\n", "", keyname)
+				Changed = true
+			}
 			continue
 		} else {
 			fmt.Printf("%t %q %t\n", ForceRegen, key.failed, OverWrite)
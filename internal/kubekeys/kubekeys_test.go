@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package kubekeys
+
+import (
+	"encoding/pem"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+const saPath = "global/etc/kubernetes/pki/sa"
+
+func checkKeys(t *testing.T, cfg config.GlobalConfig, keyCfg KeyConfig) (priv []byte, bundle []byte) {
+	t.Helper()
+	AllKubeKeys = nil
+	if err := CheckCreateKeys(cfg, keyCfg); err != nil {
+		t.Fatalf("CheckCreateKeys() error = %v", err)
+	}
+	priv, err := cfg.ReadDriver.Read(saPath + ".key")
+	if err != nil {
+		t.Fatalf("cant read private key: %v", err)
+	}
+	bundle, err = cfg.ReadDriver.Read(saPath + ".pub")
+	if err != nil {
+		t.Fatalf("cant read public keys: %v", err)
+	}
+	return priv, bundle
+}
+
+func TestCheckCreateKeysRotation(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-kubekeys")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+
+	priv1, bundle1 := checkKeys(t, cfg, KeyConfig{Grace: time.Hour})
+	if _, retired := splitBundle(bundle1); len(retired) != 0 {
+		t.Errorf("new key pair has %d retired public keys", len(retired))
+	}
+	priv, bundle := checkKeys(t, cfg, KeyConfig{Grace: time.Hour})
+	if string(priv) != string(priv1) || string(bundle) != string(bundle1) {
+		t.Errorf("valid key pair was replaced")
+	}
+
+	priv2, bundle2 := checkKeys(t, cfg, KeyConfig{Rotate: true, Grace: time.Hour, KeyType: "P256"})
+	if string(priv2) == string(priv1) {
+		t.Fatalf("key was not rotated")
+	}
+	key, err := sslutil.ParsePrivateKeyPEM(priv2)
+	if err != nil || sslutil.KeyType(key) != "P256" {
+		t.Errorf("rotated key type = %q, %v", sslutil.KeyType(key), err)
+	}
+	current, retired := splitBundle(bundle2)
+	old, _ := splitBundle(bundle1)
+	if current == nil || len(retired) != 1 || string(retired[0].Bytes) != string(old.Bytes) {
+		t.Fatalf("previous public key not kept after rotation: %s", bundle2)
+	}
+	if retired[0].Headers[RetiredHeader] == "" {
+		t.Errorf("retired public key lacks the %s header", RetiredHeader)
+	}
+
+	// the grace period is over: the old public key goes, the signing key stays
+	priv, bundle = checkKeys(t, cfg, KeyConfig{Grace: 0})
+	if string(priv) != string(priv2) {
+		t.Errorf("signing key was replaced when expiring retired keys")
+	}
+	if _, retired = splitBundle(bundle); len(retired) != 0 {
+		t.Errorf("expired public key still in the bundle: %s", bundle)
+	}
+}
+
+func TestExpireRetired(t *testing.T) {
+	now := time.Now()
+	block, _ := splitBundle([]byte("-----BEGIN PUBLIC KEY-----\nAAAA\n-----END PUBLIC KEY-----\n"))
+	recent := retire(block, now.Add(-time.Hour))
+	old := retire(block, now.Add(-48*time.Hour))
+	foreign := block
+
+	kept, expired := expireRetired([]*pem.Block{recent, old, foreign}, 24*time.Hour, now)
+	if len(kept) != 2 || kept[0] != recent || kept[1] != foreign {
+		t.Errorf("expireRetired() kept %v", kept)
+	}
+	if len(expired) != 1 || expired[0] != old {
+		t.Errorf("expireRetired() expired %v", expired)
+	}
+}
+
+func TestCheckCreateKeysMaterialize(t *testing.T) {
+	defer Reset()
+	src, err := ioutil.TempDir("", "genkubessl-kubekeys-src")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "genkubessl-kubekeys-dst")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dst)
+	srcDrv := file.NewStoreFile(src)
+	dstDrv := file.NewStoreFile(dst)
+	priv, bundle := checkKeys(t, config.GlobalConfig{WriteDriver: srcDrv, ReadDriver: srcDrv}, KeyConfig{})
+
+	cfg := config.GlobalConfig{WriteDriver: dstDrv, ReadDriver: srcDrv}
+	Reset()
+	checkKeys(t, cfg, KeyConfig{})
+	if exists, _ := dstDrv.Exists(saPath + ".key"); exists || Changed {
+		t.Fatalf("valid keys copied to the destination without materialize")
+	}
+
+	cfg.Materialize = true
+	for run, wantChanged := range []bool{true, false} {
+		Reset()
+		checkKeys(t, cfg, KeyConfig{})
+		if Changed != wantChanged {
+			t.Errorf("run %d: Changed = %t, want %t", run, Changed, wantChanged)
+		}
+		dstPriv, _ := dstDrv.Read(saPath + ".key")
+		dstBundle, _ := dstDrv.Read(saPath + ".pub")
+		if string(dstPriv) != string(priv) || string(dstBundle) != string(bundle) {
+			t.Errorf("run %d: destination does not hold the source keys", run)
+		}
+	}
+}
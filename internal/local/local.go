@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package local
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultLockFile is where local mode keeps its lock, relative to the node root
+	DefaultLockFile = "var/lib/genkubessl/genkubessl.lock"
+)
+
+var (
+	// TODO return value rather than use global
+	Changed = false
+
+	// name prefixes of the container and overlay network interfaces DetectIPs skips, their addresses come and go
+	VirtualInterfaces = []string{
+		"docker", "br-", "veth", "cni", "flannel", "cali", "tunl", "vxlan", "cilium", "lxc", "weave", "kube-ipvs",
+		"virbr", "podman",
+	}
+
+	// global files each role needs on the node itself, relative to the global area
+	RoleGlobalFiles = map[string][]string{
+		"masters": {
+			"/etc/kubernetes/pki/ca.crt",
+			"/etc/kubernetes/pki/ca.key",
+			"/etc/kubernetes/pki/front-proxy-ca.crt",
+			"/etc/kubernetes/pki/front-proxy-ca.key",
+			"/etc/kubernetes/pki/etcd/ca.crt",
+			"/etc/kubernetes/pki/etcd/ca.key",
+			"/etc/kubernetes/pki/sa.key",
+			"/etc/kubernetes/pki/sa.pub",
+			"/etc/kubernetes/encryption-config.yaml",
+		},
+		"workers": {
+			"/etc/kubernetes/pki/ca.crt",
+		},
+		"etcd": {
+			"/etc/kubernetes/pki/etcd/ca.crt",
+		},
+		// not a role, workers using kubelet TLS bootstrapping
+		"bootstrap": {
+			"/etc/kubernetes/bootstrap-kubelet.conf",
+		},
+	}
+)
+
+// StoreLocal maps the storage layout onto a single node:
+// nodes/<Node>/... is read from and written to the node filesystem (Root) while
+// global/... is read from the shared storage and can not be written to.
+type StoreLocal struct {
+	Node   string
+	Root   storage.StoreDrv
+	Shared storage.StoreDrv
+}
+
+func NewStoreLocal(node string, root storage.StoreDrv, shared storage.StoreDrv) *StoreLocal {
+	return &StoreLocal{
+		Node:   node,
+		Root:   root,
+		Shared: shared,
+	}
+}
+
+// route returns the driver and the path within it that filePath maps to
+func (s *StoreLocal) route(filePath string) (drv storage.StoreDrv, mapped string, err error) {
+	nodePrefix := path.Join(storage.NodesPath, s.Node) + "/"
+	switch {
+	case strings.HasPrefix(filePath, nodePrefix):
+		return s.Root, strings.TrimPrefix(filePath, nodePrefix), nil
+	case strings.HasPrefix(filePath, storage.GlobalPath+"/"):
+		return s.Shared, filePath, nil
+	default:
+		return nil, "", fmt.Errorf("path %q is outside of node %q and the global area", filePath, s.Node)
+	}
+}
+
+func (s *StoreLocal) writable(filePath string) (mapped string, err error) {
+	drv, mapped, err := s.route(filePath)
+	if err != nil {
+		return "", err
+	}
+	if drv != s.Root {
+		return "", fmt.Errorf("cannot write %q: only node files are written in local mode", filePath)
+	}
+	return mapped, nil
+}
+
+func (s *StoreLocal) Read(filePath string) (content []byte, err error) {
+	drv, mapped, err := s.route(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return drv.Read(mapped)
+}
+
+func (s *StoreLocal) Write(filePath string, content []byte) (err error) {
+	mapped, err := s.writable(filePath)
+	if err != nil {
+		return err
+	}
+	return s.Root.Write(mapped, content)
+}
+
+func (s *StoreLocal) WriteBatch(files map[string][]byte) (err error) {
+	batch := make(map[string][]byte, len(files))
+	for filePath, content := range files {
+		mapped, err := s.writable(filePath)
+		if err != nil {
+			return err
+		}
+		batch[mapped] = content
+	}
+	return s.Root.WriteBatch(batch)
+}
+
+func (s *StoreLocal) Apply(writes map[string][]byte, deletes []string) (err error) {
+	batch := make(map[string][]byte, len(writes))
+	for filePath, content := range writes {
+		mapped, err := s.writable(filePath)
+		if err != nil {
+			return err
+		}
+		batch[mapped] = content
+	}
+	mappedDeletes := make([]string, 0, len(deletes))
+	for _, filePath := range deletes {
+		mapped, err := s.writable(filePath)
+		if err != nil {
+			return err
+		}
+		mappedDeletes = append(mappedDeletes, mapped)
+	}
+	return s.Root.Apply(batch, mappedDeletes)
+}
+
+// List is only supported for the global area, listing the node root would mean walking "/"
+func (s *StoreLocal) List(dirPath string) (files []string, err error) {
+	if dirPath != storage.GlobalPath && !strings.HasPrefix(dirPath, storage.GlobalPath+"/") {
+		return nil, fmt.Errorf("cannot list %q in local mode", dirPath)
+	}
+	return s.Shared.List(dirPath)
+}
+
+func (s *StoreLocal) Exists(filePath string) (exists bool, err error) {
+	drv, mapped, err := s.route(filePath)
+	if err != nil {
+		return false, err
+	}
+	return drv.Exists(mapped)
+}
+
+func (s *StoreLocal) Stat(filePath string) (info os.FileInfo, err error) {
+	drv, mapped, err := s.route(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return drv.Stat(mapped)
+}
+
+func (s *StoreLocal) Delete(filePath string) (err error) {
+	mapped, err := s.writable(filePath)
+	if err != nil {
+		return err
+	}
+	return s.Root.Delete(mapped)
+}
+
+// Lock only locks the node, the shared storage is merely read
+func (s *StoreLocal) Lock(owner string, timeout time.Duration) (release func() error, err error) {
+	return s.Root.Lock(owner, timeout)
+}
+
+func (s *StoreLocal) SetConfigValue(key string, value string) (err error) {
+	return s.Root.SetConfigValue(key, value)
+}
+
+func (s *StoreLocal) LoadConfig(filepath string) (err error) {
+	return s.Root.LoadConfig(filepath)
+}
+
+// detectInterface tells whether DetectIPs looks at the interface called name: one of names when given,
+// any interface but the virtual ones otherwise
+func detectInterface(name string, names []string) bool {
+	if len(names) > 0 {
+		for _, wanted := range names {
+			if name == wanted {
+				return true
+			}
+		}
+		return false
+	}
+	for _, prefix := range VirtualInterfaces {
+		if strings.HasPrefix(name, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// DetectIPs returns the global unicast addresses of the interfaces that are up: the ones called names,
+// or all of them but the VirtualInterfaces when names is empty.
+func DetectIPs(names []string) (ips []string, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || !detectInterface(iface.Name, names) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || !ipnet.IP.IsGlobalUnicast() {
+				continue
+			}
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	sort.Strings(ips)
+	return ips, nil
+}
+
+// GlobalFiles returns the global files (relative to the global area) needed by a node with the given roles
+func GlobalFiles(roles []string) (files []string) {
+	seen := make(map[string]struct{})
+	for _, role := range roles {
+		for _, file := range RoleGlobalFiles[role] {
+			if _, ok := seen[file]; !ok {
+				seen[file] = struct{}{}
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// Install copies the global files a node needs from the shared storage onto the node.
+func Install(drv *StoreLocal, roles []string) (err error) {
+	for _, file := range GlobalFiles(roles) {
+		content, err := drv.Shared.Read(path.Join(storage.GlobalPath, file))
+		if err != nil {
+			return err
+		}
+		mapped := strings.TrimPrefix(file, "/")
+		current, err := drv.Root.Read(mapped)
+		if err == nil && bytes.Equal(current, content) {
+			fmt.Printf("FILE OK    : [%-30s] [%-50s]\n", drv.Node, file)
+			continue
+		}
+		if err = drv.Root.Write(mapped, content); err != nil {
+			return err
+		}
+		fmt.Printf("FILE COPIED: [%-30s] [%-50s]\n", drv.Node, file)
+		Changed = true
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package local
+
+import (
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStoreLocal(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-local")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	root := file.NewStoreFile(filepath.Join(tmp, "root"))
+	shared := file.NewStoreFile(filepath.Join(tmp, "shared"))
+	_ = shared.Write("global/etc/kubernetes/pki/ca.crt", []byte("ca"))
+	drv := NewStoreLocal("w1", root, shared)
+
+	if err = drv.Write("nodes/w1/etc/kubernetes/pki/kubelet.crt", []byte("kubelet")); err != nil {
+		t.Fatalf("Write() of node file error = %v", err)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(tmp, "root", "etc/kubernetes/pki/kubelet.crt"))
+	if err != nil || string(content) != "kubelet" {
+		t.Errorf("node file not written to the node root: %q, %v", content, err)
+	}
+	if err = drv.Write("global/etc/kubernetes/pki/ca.crt", []byte("new ca")); err == nil {
+		t.Errorf("Write() of a global file should fail")
+	}
+	if err = drv.Write("nodes/w2/etc/kubernetes/pki/kubelet.crt", []byte("other")); err == nil {
+		t.Errorf("Write() for another node should fail")
+	}
+	if content, err = drv.Read("global/etc/kubernetes/pki/ca.crt"); err != nil || string(content) != "ca" {
+		t.Errorf("Read() of global file = %q, %v", content, err)
+	}
+
+	if err = Install(drv, []string{"workers"}); err != nil {
+		t.Fatalf("Install() error = %v", err)
+	}
+	if content, err = root.Read("etc/kubernetes/pki/ca.crt"); err != nil || string(content) != "ca" {
+		t.Errorf("Install() did not copy ca.crt: %q, %v", content, err)
+	}
+}
+
+func TestGlobalFiles(t *testing.T) {
+	want := []string{"/etc/kubernetes/pki/ca.crt", "/etc/kubernetes/pki/etcd/ca.crt"}
+	if got := GlobalFiles([]string{"workers", "etcd"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("GlobalFiles() = %v, want %v", got, want)
+	}
+}
+
+func TestDetectInterface(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		names []string
+		want  bool
+	}{
+		{"eth0", nil, true},
+		{"ens192", nil, true},
+		{"docker0", nil, false},
+		{"cni0", nil, false},
+		{"flannel.1", nil, false},
+		{"cali8a1f2b3c4d5", nil, false},
+		{"docker0", []string{"eth0", "docker0"}, true},
+		{"eth1", []string{"eth0"}, false},
+	} {
+		if got := detectInterface(tt.name, tt.names); got != tt.want {
+			t.Errorf("detectInterface(%q, %v) = %t, want %t", tt.name, tt.names, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package manifest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/history"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"sort"
+)
+
+const (
+	// ManifestPath is where the manifest of the last run is kept, next to the global and nodes areas
+	ManifestPath = "manifest.json"
+
+	StatusCreated   = "created"
+	StatusReplaced  = "replaced"
+	StatusUnchanged = "unchanged"
+)
+
+// File is a file of a node (or of the global area) as left by the run
+type File struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+	Status string `json:"status"`
+	// Reason the file was written for, the check it failed. Empty for unchanged files.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Node lists the files of a node, or of the global area
+type Node struct {
+	Roles   []string `json:"roles,omitempty"`
+	Changed bool     `json:"changed"`
+	Files   []File   `json:"files"`
+}
+
+// Manifest describes the outcome of a run, written as manifest.json
+type Manifest struct {
+	// Generation is the history generation holding what the run replaced, 0 when nothing changed
+	Generation int              `json:"generation,omitempty"`
+	Changed    bool             `json:"changed"`
+	Global     Node             `json:"global"`
+	Nodes      map[string]*Node `json:"nodes"`
+}
+
+// Build describes every file in expected (the StoredFiles of the pipeline) along with the files the run
+// recorded in GlobalCfg.History. The files the run wrote are read back from the WriteDriver, the others
+// from the ReadDriver: without Materialize a separate destination only holds what changed.
+//
+// The reason of a written file is the check it failed: CheckCreateCerts and CheckCreateKeys hand their
+// failed state to the history as they write. The history is used rather than that state as it also
+// records what encryption, bootstrap, materialize and prune wrote, which keep no failed state of their own.
+func Build(GlobalCfg config.GlobalConfig, expected []string, hosts kubecerts.KubeHostsAll) (m Manifest, err error) {
+	written := make(map[string]history.Entry)
+	if g := GlobalCfg.History; g != nil {
+		for _, entry := range g.Files {
+			written[entry.Path] = entry
+			expected = append(expected, entry.Path)
+		}
+		if len(g.Files) > 0 {
+			m.Generation = g.Generation
+		}
+	}
+	sort.Strings(expected)
+
+	m.Nodes = make(map[string]*Node)
+	seen := make(map[string]struct{})
+	for _, storagePath := range expected {
+		if _, ok := seen[storagePath]; ok {
+			continue
+		}
+		seen[storagePath] = struct{}{}
+		nodeName, filePath, ok := storage.SplitPath(storagePath)
+		if !ok {
+			continue
+		}
+		entry, changed := written[storagePath]
+		drv := GlobalCfg.ReadDriver
+		if changed {
+			drv = GlobalCfg.WriteDriver
+		}
+		content, err := drv.Read(storagePath)
+		if storage.IsNotExist(err) {
+			// removed by the run (pruned), nothing to sync
+			continue
+		}
+		if err != nil {
+			return m, fmt.Errorf("error reading %s for the manifest: %v", storagePath, err)
+		}
+		sum := sha256.Sum256(content)
+		file := File{Path: filePath, SHA256: hex.EncodeToString(sum[:]), Status: StatusUnchanged}
+		if changed {
+			file.Status = StatusReplaced
+			if !entry.Existed {
+				file.Status = StatusCreated
+			}
+			file.Reason = entry.Reason
+		}
+
+		node := &m.Global
+		if nodeName != "" {
+			if node, ok = m.Nodes[nodeName]; !ok {
+				node = &Node{Roles: kubecerts.NodeRoles(hosts, nodeName)}
+				m.Nodes[nodeName] = node
+			}
+		}
+		node.Files = append(node.Files, file)
+		if file.Status != StatusUnchanged {
+			node.Changed = true
+			m.Changed = true
+		}
+	}
+	return m, nil
+}
+
+// Write stores the manifest unless the stored one is identical already
+func Write(drv storage.StoreDrv, m Manifest) (written bool, err error) {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return false, err
+	}
+	content = append(content, '\n')
+	current, err := drv.Read(ManifestPath)
+	if err == nil && bytes.Equal(current, content) {
+		return false, nil
+	}
+	if err != nil && !storage.IsNotExist(err) {
+		return false, err
+	}
+	return true, drv.Write(ManifestPath, content)
+}
+
+// Load reads the manifest of the last run
+func Load(drv storage.StoreDrv) (m Manifest, err error) {
+	content, err := drv.Read(ManifestPath)
+	if err != nil {
+		return m, err
+	}
+	if err = json.Unmarshal(content, &m); err != nil {
+		return m, fmt.Errorf("invalid manifest %s: %v", ManifestPath, err)
+	}
+	return m, nil
+}
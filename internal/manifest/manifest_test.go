@@ -0,0 +1,155 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/history"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func checksum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBuildAndWrite(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-manifest")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	err = drv.WriteBatch(map[string][]byte{
+		"global/etc/kubernetes/pki/ca.crt":          []byte("ca"),
+		"nodes/m1/etc/kubernetes/pki/apiserver.crt": []byte("apiserver"),
+		"nodes/w1/etc/kubernetes/pki/kubelet.crt":   []byte("kubelet"),
+		"nodes/w1/etc/kubernetes/pki/kubelet.key":   []byte("kubelet key"),
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+	expected := []string{
+		"global/etc/kubernetes/pki/ca.crt",
+		"nodes/m1/etc/kubernetes/pki/apiserver.crt",
+		"nodes/w1/etc/kubernetes/pki/kubelet.crt",
+		"nodes/w1/etc/kubernetes/pki/kubelet.key",
+		// pruned
+		"nodes/w9/etc/kubernetes/pki/kubelet.crt",
+	}
+	g := &history.Generation{Meta: history.Meta{Generation: 4, Files: []history.Entry{
+		{Path: "nodes/w1/etc/kubernetes/pki/kubelet.crt", Reason: "cert expires within 240h0m0s", Existed: true},
+		{Path: "nodes/w1/etc/kubernetes/pki/kubelet.key", Reason: "cert expires within 240h0m0s", Existed: false},
+	}}}
+	hosts := kubecerts.KubeHostsAll{"masters": {"m1": nil}, "workers": {"w1": nil}}
+
+	m, err := Build(config.GlobalConfig{WriteDriver: drv, ReadDriver: drv, History: g}, expected, hosts)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	want := Manifest{
+		Generation: 4,
+		Changed:    true,
+		Global: Node{Files: []File{
+			{Path: "/etc/kubernetes/pki/ca.crt", SHA256: checksum("ca"), Status: StatusUnchanged},
+		}},
+		Nodes: map[string]*Node{
+			"m1": {Roles: []string{"masters"}, Files: []File{
+				{Path: "/etc/kubernetes/pki/apiserver.crt", SHA256: checksum("apiserver"), Status: StatusUnchanged},
+			}},
+			"w1": {Roles: []string{"workers"}, Changed: true, Files: []File{
+				{Path: "/etc/kubernetes/pki/kubelet.crt", SHA256: checksum("kubelet"), Status: StatusReplaced, Reason: "cert expires within 240h0m0s"},
+				{Path: "/etc/kubernetes/pki/kubelet.key", SHA256: checksum("kubelet key"), Status: StatusCreated, Reason: "cert expires within 240h0m0s"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Build() = %+v, want %+v", m, want)
+	}
+
+	if written, err := Write(drv, m); err != nil || !written {
+		t.Fatalf("Write() = %t, %v, want the manifest written", written, err)
+	}
+	if written, err := Write(drv, m); err != nil || written {
+		t.Errorf("Write() = %t, %v, want the identical manifest left alone", written, err)
+	}
+	loaded, err := Load(drv)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if !reflect.DeepEqual(loaded, want) {
+		t.Errorf("Load() = %+v, want %+v", loaded, want)
+	}
+}
+
+func TestBuildSeparateDestination(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-manifest")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	src := file.NewStoreFile(filepath.Join(tmp, "src"))
+	dst := file.NewStoreFile(filepath.Join(tmp, "dst"))
+	err = src.WriteBatch(map[string][]byte{
+		"global/etc/kubernetes/pki/ca.crt":        []byte("ca"),
+		"nodes/w1/etc/kubernetes/pki/kubelet.crt": []byte("old kubelet"),
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+	// without materialize the destination only gets what the run wrote
+	if err = dst.Write("nodes/w1/etc/kubernetes/pki/kubelet.crt", []byte("kubelet")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	expected := []string{
+		"global/etc/kubernetes/pki/ca.crt",
+		"nodes/w1/etc/kubernetes/pki/kubelet.crt",
+	}
+	g := &history.Generation{Meta: history.Meta{Generation: 1, Files: []history.Entry{
+		{Path: "nodes/w1/etc/kubernetes/pki/kubelet.crt", Reason: "cert expires within 240h0m0s", Existed: true},
+	}}}
+	hosts := kubecerts.KubeHostsAll{"workers": {"w1": nil}}
+
+	m, err := Build(config.GlobalConfig{WriteDriver: dst, ReadDriver: src, History: g}, expected, hosts)
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+	want := Manifest{
+		Generation: 1,
+		Changed:    true,
+		Global: Node{Files: []File{
+			{Path: "/etc/kubernetes/pki/ca.crt", SHA256: checksum("ca"), Status: StatusUnchanged},
+		}},
+		Nodes: map[string]*Node{
+			"w1": {Roles: []string{"workers"}, Changed: true, Files: []File{
+				{Path: "/etc/kubernetes/pki/kubelet.crt", SHA256: checksum("kubelet"), Status: StatusReplaced, Reason: "cert expires within 240h0m0s"},
+			}},
+		},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("Build() = %+v, want %+v", m, want)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/kubekeys"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"k8s.io/client-go/util/cert"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// ContentType of the text exposition format
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// family is a gauge and its samples, rendered in the Prometheus text exposition format
+type family struct {
+	name    string
+	help    string
+	samples []sample
+}
+
+type sample struct {
+	labels [][2]string
+	value  float64
+}
+
+func (f *family) add(value float64, labels ...string) {
+	s := sample{value: value}
+	for idx := 0; idx+1 < len(labels); idx += 2 {
+		s.labels = append(s.labels, [2]string{labels[idx], labels[idx+1]})
+	}
+	f.samples = append(f.samples, s)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (f *family) render(buf *bytes.Buffer) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", f.name, f.help, f.name)
+	for _, s := range f.samples {
+		buf.WriteString(f.name)
+		if len(s.labels) > 0 {
+			parts := make([]string, 0, len(s.labels))
+			for _, label := range s.labels {
+				parts = append(parts, fmt.Sprintf(`%s="%s"`, label[0], labelEscaper.Replace(label[1])))
+			}
+			buf.WriteString("{" + strings.Join(parts, ",") + "}")
+		}
+		fmt.Fprintf(buf, " %g\n", s.value)
+	}
+}
+
+func boolValue(ok bool) float64 {
+	if ok {
+		return 1
+	}
+	return 0
+}
+
+type collector struct {
+	drv storage.StoreDrv
+	now time.Time
+
+	certNotAfter  family
+	certNotBefore family
+	certValid     family
+	caNotAfter    family
+	caValid       family
+	saValid       family
+	saPublicKeys  family
+	generated     family
+}
+
+func newCollector(drv storage.StoreDrv, now time.Time) *collector {
+	return &collector{
+		drv:           drv,
+		now:           now,
+		certNotAfter:  family{name: "genkubessl_cert_not_after_seconds", help: "Expiry of the certificate as a unix timestamp."},
+		certNotBefore: family{name: "genkubessl_cert_not_before_seconds", help: "Start of the validity of the certificate as a unix timestamp."},
+		certValid:     family{name: "genkubessl_cert_valid", help: "1 if the certificate is within its validity, signed by its issuer and matches its private key."},
+		caNotAfter:    family{name: "genkubessl_ca_not_after_seconds", help: "Expiry of the certificate authority as a unix timestamp."},
+		caValid:       family{name: "genkubessl_ca_valid", help: "1 if the certificate authority is within its validity, self signed and matches its private key."},
+		saValid:       family{name: "genkubessl_sa_key_valid", help: "1 if the service account signing key matches the current public key."},
+		saPublicKeys:  family{name: "genkubessl_sa_public_keys", help: "Number of public keys published for service account token verification, retired ones included."},
+		generated:     family{name: "genkubessl_metrics_generated_seconds", help: "When these metrics were collected as a unix timestamp."},
+	}
+}
+
+// load reads a cert and its key with the storage readers. The cert alone is returned when the key
+// is missing or does not load, keyErr tells why.
+func (c *collector) load(storagePath string) (crt *x509.Certificate, key interface{}, keyErr error, err error) {
+	certPEM, err := c.drv.Read(storagePath)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyPEM, keyErr := c.drv.Read(strings.TrimSuffix(storagePath, ".crt") + ".key")
+	if keyErr == nil {
+		if crt, key, keyErr = sslutil.LoadCrtAndKeyFromPEM(certPEM, keyPEM); keyErr == nil {
+			return crt, key, nil, nil
+		}
+	}
+	certs, err := cert.ParseCertsPEM(certPEM)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return certs[0], nil, keyErr, nil
+}
+
+func (c *collector) within(crt *x509.Certificate) bool {
+	return !c.now.Before(crt.NotBefore) && !c.now.After(crt.NotAfter)
+}
+
+func (c *collector) collectCerts() (err error) {
+	files, err := storage.ListFiles(c.drv)
+	if err != nil {
+		return err
+	}
+	global := make(map[string]struct{})
+	for _, file := range files {
+		if file.Node == "" {
+			global[file.Path] = struct{}{}
+		}
+	}
+
+	type loaded struct {
+		file  storage.StoredFile
+		crt   *x509.Certificate
+		keyOK bool
+	}
+	var certs []loaded
+	cas := make(map[string]*x509.Certificate)
+	for _, file := range files {
+		// node copies of global files are the global ones
+		if _, ok := global[file.Path]; path.Ext(file.Path) != ".crt" || (ok && file.Node != "") {
+			continue
+		}
+		crt, key, keyErr, err := c.load(file.StoragePath)
+		if err != nil {
+			// not a certificate we can tell anything about
+			continue
+		}
+		keyOK := keyErr == nil && sslutil.KeyMatchesCrt(crt, key) == nil
+		certs = append(certs, loaded{file, crt, keyOK})
+		if file.Node == "" && crt.IsCA {
+			cas[string(crt.RawSubject)] = crt
+		}
+	}
+
+	for _, l := range certs {
+		crtPath := strings.TrimSuffix(l.file.Path, ".crt")
+		if l.crt.IsCA && l.file.Node == "" {
+			valid := l.keyOK && c.within(l.crt) && l.crt.CheckSignatureFrom(l.crt) == nil
+			c.caNotAfter.add(float64(l.crt.NotAfter.Unix()), "path", crtPath, "cn", l.crt.Subject.CommonName)
+			c.caValid.add(boolValue(valid), "path", crtPath, "cn", l.crt.Subject.CommonName)
+			continue
+		}
+		issuer, ok := cas[string(l.crt.RawIssuer)]
+		valid := ok && l.keyOK && c.within(l.crt) && l.crt.CheckSignatureFrom(issuer) == nil
+		labels := []string{"node", l.file.Node, "path", crtPath, "cn", l.crt.Subject.CommonName, "issuer", l.crt.Issuer.CommonName}
+		c.certNotAfter.add(float64(l.crt.NotAfter.Unix()), labels...)
+		c.certNotBefore.add(float64(l.crt.NotBefore.Unix()), labels...)
+		c.certValid.add(boolValue(valid), labels...)
+	}
+	return nil
+}
+
+func (c *collector) collectKeys() {
+	for _, keyPath := range kubekeys.Paths() {
+		storagePath := path.Join(storage.GlobalPath, keyPath)
+		privPEM, privErr := c.drv.Read(storagePath + ".key")
+		bundle, pubErr := c.drv.Read(storagePath + ".pub")
+		if storage.IsNotExist(privErr) && storage.IsNotExist(pubErr) {
+			continue
+		}
+		valid := privErr == nil && pubErr == nil && kubekeys.CheckPair(privPEM, bundle) == nil
+		c.saValid.add(boolValue(valid), "path", keyPath)
+
+		count := 0
+		for rest := bundle; ; count++ {
+			var block *pem.Block
+			if block, rest = pem.Decode(rest); block == nil {
+				break
+			}
+		}
+		c.saPublicKeys.add(float64(count), "path", keyPath)
+	}
+}
+
+// Collect returns the metrics of every certificate, CA and service account key in storage
+// in the Prometheus text exposition format.
+func Collect(drv storage.StoreDrv) (content []byte, err error) {
+	c := newCollector(drv, time.Now())
+	if err = c.collectCerts(); err != nil {
+		return nil, err
+	}
+	c.collectKeys()
+	c.generated.add(float64(c.now.Unix()))
+
+	var buf bytes.Buffer
+	for _, f := range []*family{&c.certNotAfter, &c.certNotBefore, &c.certValid, &c.caNotAfter, &c.caValid, &c.saValid, &c.saPublicKeys, &c.generated} {
+		sort.SliceStable(f.samples, func(i, j int) bool {
+			return fmt.Sprint(f.samples[i].labels) < fmt.Sprint(f.samples[j].labels)
+		})
+		f.render(&buf)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package metrics
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/testutil"
+	"strings"
+	"testing"
+)
+
+func TestCollect(t *testing.T) {
+	drv, cleanup := testutil.TempStore(t)
+	defer cleanup()
+
+	ca := testutil.NewCA(t, "kubernetes")
+	testutil.Store(t, drv, "global/etc/kubernetes/pki/ca", ca)
+	if err := drv.Write("nodes/m1/etc/kubernetes/pki/ca.crt", sslutil.EncodeCertPEM(ca.Crt)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	apiserver := testutil.Issue(t, ca, "kube-apiserver", []string{"m1"}, x509.ExtKeyUsageServerAuth)
+	testutil.Store(t, drv, "nodes/m1/etc/kubernetes/pki/apiserver", apiserver)
+	// a key that does not belong to the cert
+	otherKey, _ := sslutil.NewPrivateKey("")
+	testutil.Store(t, drv, "nodes/m2/etc/kubernetes/pki/apiserver", testutil.Pair{Crt: apiserver.Crt, Key: otherKey})
+
+	saKey, _ := sslutil.NewPrivateKey("")
+	testutil.StoreSA(t, drv, saKey, saKey)
+
+	content, err := Collect(drv)
+	if err != nil {
+		t.Fatalf("Collect() error = %v", err)
+	}
+	got := string(content)
+
+	want := []string{
+		"# TYPE genkubessl_cert_not_after_seconds gauge\n",
+		fmt.Sprintf(`genkubessl_cert_not_after_seconds{node="m1",path="/etc/kubernetes/pki/apiserver",cn="kube-apiserver",issuer="kubernetes"} %g`+"\n", float64(apiserver.Crt.NotAfter.Unix())),
+		`genkubessl_cert_valid{node="m1",path="/etc/kubernetes/pki/apiserver",cn="kube-apiserver",issuer="kubernetes"} 1` + "\n",
+		`genkubessl_cert_valid{node="m2",path="/etc/kubernetes/pki/apiserver",cn="kube-apiserver",issuer="kubernetes"} 0` + "\n",
+		fmt.Sprintf(`genkubessl_ca_not_after_seconds{path="/etc/kubernetes/pki/ca",cn="kubernetes"} %g`+"\n", float64(ca.Crt.NotAfter.Unix())),
+		`genkubessl_ca_valid{path="/etc/kubernetes/pki/ca",cn="kubernetes"} 1` + "\n",
+		`genkubessl_sa_key_valid{path="/etc/kubernetes/pki/sa"} 1` + "\n",
+		`genkubessl_sa_public_keys{path="/etc/kubernetes/pki/sa"} 1` + "\n",
+	}
+	for _, line := range want {
+		if !strings.Contains(got, line) {
+			t.Errorf("Collect() missing %q in:\n%s", line, got)
+		}
+	}
+	// the node copy of the CA is the global one
+	if strings.Contains(got, `node="m1",path="/etc/kubernetes/pki/ca"`) {
+		t.Errorf("Collect() reported the node copy of the CA:\n%s", got)
+	}
+}
+
+func TestRenderEscapesLabels(t *testing.T) {
+	f := family{name: "test", help: "help"}
+	f.add(1, "cn", "a\"b\\c\nd")
+	var buf bytes.Buffer
+	f.render(&buf)
+	want := "# HELP test help\n# TYPE test gauge\ntest{cn=\"a\\\"b\\\\c\\nd\"} 1\n"
+	if buf.String() != want {
+		t.Errorf("render() = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,250 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package probe
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"k8s.io/client-go/util/cert"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// probe results
+	Match       = "match"
+	Stale       = "stale"
+	Expired     = "expired"
+	OtherCA     = "other CA"
+	Unreachable = "unreachable"
+)
+
+// Endpoint is a TLS port serving a cert genkubessl writes
+type Endpoint struct {
+	Name  string
+	Roles []string
+	Port  int
+	// Served is the cert the endpoint should serve, stored with each node
+	Served string
+	// CA signing Served
+	CA string
+	// Client is the cert presented to the endpoint, stored globally or with the node probed
+	Client       string
+	ClientGlobal bool
+}
+
+var (
+	Endpoints = []Endpoint{
+		{
+			Name:         "apiserver",
+			Roles:        []string{"masters"},
+			Port:         6443,
+			Served:       "/etc/kubernetes/pki/apiserver",
+			CA:           "/etc/kubernetes/pki/ca",
+			Client:       "/etc/kubernetes/pki/admin",
+			ClientGlobal: true,
+		},
+		{
+			Name:         "kubelet",
+			Roles:        []string{"masters", "workers"},
+			Port:         10250,
+			Served:       "/var/lib/kubelet/pki/kubelet",
+			CA:           "/etc/kubernetes/pki/ca",
+			Client:       "/etc/kubernetes/pki/admin",
+			ClientGlobal: true,
+		},
+		{
+			// the peer cert carries client auth as well and is signed by the etcd CA
+			Name:   "etcd",
+			Roles:  []string{"etcd"},
+			Port:   2379,
+			Served: "/etc/kubernetes/pki/etcd/server",
+			CA:     "/etc/kubernetes/pki/etcd/ca",
+			Client: "/etc/kubernetes/pki/etcd/peer",
+		},
+		{
+			Name:   "etcd-peer",
+			Roles:  []string{"etcd"},
+			Port:   2380,
+			Served: "/etc/kubernetes/pki/etcd/peer",
+			CA:     "/etc/kubernetes/pki/etcd/ca",
+			Client: "/etc/kubernetes/pki/etcd/peer",
+		},
+	}
+)
+
+// Target is an endpoint of a node
+type Target struct {
+	Node     string
+	Endpoint Endpoint
+	Address  string
+}
+
+// Result of probing a target, Status is one of Match, Stale, Expired, OtherCA or Unreachable
+type Result struct {
+	Target Target
+	Status string
+	Detail string
+}
+
+// address returns the first IP address among the alt names of node, its name when there is none
+func address(sans []string, node string) string {
+	for _, san := range sans {
+		if ip := net.ParseIP(san); ip != nil && !ip.IsLoopback() {
+			return ip.String()
+		}
+	}
+	return node
+}
+
+// Targets returns every endpoint of every node in the cluster definition, sorted by node
+func Targets(hosts kubecerts.KubeHostsAll) (targets []Target) {
+	for _, endpoint := range Endpoints {
+		seen := make(map[string]struct{})
+		for _, role := range endpoint.Roles {
+			for node, sans := range hosts[role] {
+				if _, ok := seen[node]; ok {
+					continue
+				}
+				seen[node] = struct{}{}
+				targets = append(targets, Target{
+					Node:     node,
+					Endpoint: endpoint,
+					Address:  net.JoinHostPort(address(sans, node), strconv.Itoa(endpoint.Port)),
+				})
+			}
+		}
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Node < targets[j].Node })
+	return targets
+}
+
+func readCert(drv storage.StoreDrv, filePath string) (crt *x509.Certificate, err error) {
+	content, err := drv.Read(filePath + ".crt")
+	if err != nil {
+		return nil, err
+	}
+	certs, err := cert.ParseCertsPEM(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate %s: %v", filePath, err)
+	}
+	return certs[0], nil
+}
+
+func readPair(drv storage.StoreDrv, filePath string) (pair tls.Certificate, err error) {
+	certPEM, err := drv.Read(filePath + ".crt")
+	if err != nil {
+		return pair, err
+	}
+	keyPEM, err := drv.Read(filePath + ".key")
+	if err != nil {
+		return pair, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
+// Classify compares the cert served with the stored one and the CA that should have signed it
+func Classify(served *x509.Certificate, stored *x509.Certificate, ca *x509.Certificate, now time.Time) (status string, detail string) {
+	switch {
+	case now.After(served.NotAfter):
+		return Expired, fmt.Sprintf("served cert expired on %s", served.NotAfter.UTC().Format(time.RFC3339))
+	case now.Before(served.NotBefore):
+		return Expired, fmt.Sprintf("served cert not valid before %s", served.NotBefore.UTC().Format(time.RFC3339))
+	case stored != nil && bytes.Equal(served.Raw, stored.Raw):
+		return Match, ""
+	case served.CheckSignatureFrom(ca) == nil:
+		detail = fmt.Sprintf("served cert serial %s issued %s", served.SerialNumber, served.NotBefore.UTC().Format(time.RFC3339))
+		if stored != nil {
+			detail += fmt.Sprintf(", stored one serial %s issued %s", stored.SerialNumber, stored.NotBefore.UTC().Format(time.RFC3339))
+		}
+		return Stale, detail
+	default:
+		return OtherCA, fmt.Sprintf("served cert issued by %q is not signed by %s", served.Issuer.CommonName, ca.Subject.CommonName)
+	}
+}
+
+// Probe dials target presenting the client cert from storage and classifies the cert it serves.
+// Chains are not verified during the handshake, finding out what is served is the whole point.
+func Probe(drv storage.StoreDrv, target Target, timeout time.Duration) (result Result, err error) {
+	result.Target = target
+	endpoint := target.Endpoint
+	nodePath := path.Join(storage.NodesPath, target.Node)
+
+	ca, err := readCert(drv, path.Join(storage.GlobalPath, endpoint.CA))
+	if err != nil {
+		return result, err
+	}
+	stored, err := readCert(drv, path.Join(nodePath, endpoint.Served))
+	if err != nil && !storage.IsNotExist(err) {
+		return result, err
+	}
+	clientPath := path.Join(nodePath, endpoint.Client)
+	if endpoint.ClientGlobal {
+		clientPath = path.Join(storage.GlobalPath, endpoint.Client)
+	}
+	client, err := readPair(drv, clientPath)
+	if err != nil {
+		return result, fmt.Errorf("cannot load client cert %s: %v", clientPath, err)
+	}
+
+	host, _, _ := net.SplitHostPort(target.Address)
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", target.Address, &tls.Config{
+		Certificates:       []tls.Certificate{client},
+		ServerName:         host,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		result.Status, result.Detail = Unreachable, err.Error()
+		return result, nil
+	}
+	defer conn.Close()
+	peers := conn.ConnectionState().PeerCertificates
+	if len(peers) == 0 {
+		result.Status, result.Detail = Unreachable, "no certificate served"
+		return result, nil
+	}
+	result.Status, result.Detail = Classify(peers[0], stored, ca, time.Now())
+	return result, nil
+}
+
+// Execute probes every target, printing and returning the results.
+// err is only set when storage lacks what is needed to probe.
+func Execute(drv storage.StoreDrv, targets []Target, timeout time.Duration) (results []Result, err error) {
+	for _, target := range targets {
+		result, err := Probe(drv, target, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("probing %s of %s: %v", target.Endpoint.Name, target.Node, err)
+		}
+		what := target.Endpoint.Name + " " + target.Address
+		if result.Status == Match {
+			fmt.Printf("PROBE OK   : [%-30s] [%-50s] => %q\n", target.Node, what, result.Status)
+		} else {
+			fmt.Printf("PROBE FAIL : [%-30s] [%-50s] => %q\n", target.Node, what, result.Status+": "+result.Detail)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
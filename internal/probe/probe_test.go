@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package probe
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/testutil"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func issue(t *testing.T, ca testutil.Pair, cn string) testutil.Pair {
+	return testutil.Issue(t, ca, cn, []string{"127.0.0.1"}, x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth)
+}
+
+// serve starts a TLS server serving p and requiring a client cert
+func serve(t *testing.T, p testutil.Pair) *httptest.Server {
+	keyPEM, _ := sslutil.MarshalPrivateKeyToPEM(p.Key)
+	tlsCert, err := tls.X509KeyPair(sslutil.EncodeCertPEM(p.Crt), keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	// probes hang up right after the handshake
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{tlsCert}, ClientAuth: tls.RequireAnyClientCert}
+	server.StartTLS()
+	return server
+}
+
+func TestProbe(t *testing.T) {
+	drv, cleanup := testutil.TempStore(t)
+	defer cleanup()
+
+	ca := testutil.NewCA(t, "kubernetes")
+	testutil.Store(t, drv, "global/etc/kubernetes/pki/ca", ca)
+	testutil.Store(t, drv, "global/etc/kubernetes/pki/admin", issue(t, ca, "kubernetes-admin"))
+	stored := issue(t, ca, "kube-apiserver")
+	testutil.Store(t, drv, "nodes/m1/etc/kubernetes/pki/apiserver", stored)
+
+	closed, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := closed.Addr().String()
+	closed.Close()
+
+	tests := map[string]struct {
+		served testutil.Pair
+		want   string
+	}{
+		"same cert":   {stored, Match},
+		"older cert":  {issue(t, ca, "kube-apiserver"), Stale},
+		"other CA":    {issue(t, testutil.NewCA(t, "other"), "kube-apiserver"), OtherCA},
+		"unreachable": {want: Unreachable},
+	}
+	for name, test := range tests {
+		address := closedAddr
+		if test.served.Crt != nil {
+			server := serve(t, test.served)
+			defer server.Close()
+			address = server.Listener.Addr().String()
+		}
+		target := Target{Node: "m1", Endpoint: Endpoints[0], Address: address}
+		result, err := Probe(drv, target, time.Second)
+		if err != nil {
+			t.Fatalf("%s: Probe() error = %v", name, err)
+		}
+		if result.Status != test.want {
+			t.Errorf("%s: Probe() = %q (%s), want %q", name, result.Status, result.Detail, test.want)
+		}
+	}
+}
+
+func TestClassifyExpired(t *testing.T) {
+	ca := testutil.NewCA(t, "kubernetes")
+	served := issue(t, ca, "kube-apiserver")
+	if status, _ := Classify(served.Crt, served.Crt, ca.Crt, served.Crt.NotAfter.Add(time.Minute)); status != Expired {
+		t.Errorf("Classify() = %q, want %q", status, Expired)
+	}
+}
+
+func TestTargets(t *testing.T) {
+	hosts := kubecerts.KubeHostsAll{
+		"masters": {"m1": {"m1.example.org", "10.0.0.1"}},
+		"workers": {"w1": nil},
+		"etcd":    {"m1": {"10.0.0.1"}},
+	}
+	var got []string
+	for _, target := range Targets(hosts) {
+		got = append(got, target.Node+" "+target.Endpoint.Name+" "+target.Address)
+	}
+	want := []string{
+		"m1 apiserver 10.0.0.1:6443",
+		"m1 kubelet 10.0.0.1:10250",
+		"m1 etcd 10.0.0.1:2379",
+		"m1 etcd-peer 10.0.0.1:2380",
+		"w1 kubelet w1:10250",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Targets() = %v, want %v", got, want)
+	}
+	for idx := range want {
+		if got[idx] != want[idx] {
+			t.Errorf("Targets()[%d] = %q, want %q", idx, got[idx], want[idx])
+		}
+	}
+}
@@ -0,0 +1,251 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package prune
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/webhookcerts"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ArchivePath = "archive"
+
+	CRLBlockType = "X509 CRL"
+
+	// how long a CRL we emit is valid for
+	CRLValidity = sslutil.Duration365d
+)
+
+var (
+	// TODO return value rather than use global
+	Changed = false
+
+	// Protected lists the storage path prefixes managed by other commands, never orphans
+	Protected = []string{
+		path.Join(storage.GlobalPath, webhookcerts.WebhooksPath) + "/",
+	}
+)
+
+// Reset clears the outcome of a previous run.
+func Reset() {
+	Changed = false
+}
+
+type Orphans struct {
+	// node names present in storage but not in the cluster definition
+	Nodes []string
+	// every orphaned file, including the ones belonging to orphaned nodes
+	Files []string
+}
+
+// nodeOf returns the node a storage path belongs to, or "" for global files
+func nodeOf(filePath string) string {
+	parts := strings.SplitN(filePath, "/", 3)
+	if len(parts) < 3 || parts[0] != storage.NodesPath {
+		return ""
+	}
+	return parts[1]
+}
+
+// crlPath is where the revocation list of a CA is kept, next to its cert and key
+func crlPath(ca kubecerts.CertificateAuthority) string {
+	return ca.WritePath + ".crl"
+}
+
+func protected(filePath string) bool {
+	for _, prefix := range Protected {
+		if strings.HasPrefix(filePath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// FindOrphans compares the files in storage with the expected ones.
+// Only the global and nodes areas are considered.
+func FindOrphans(drv storage.StoreDrv, expected []string) (orphans Orphans, err error) {
+	expectedFiles := make(map[string]struct{})
+	expectedNodes := make(map[string]struct{})
+	for _, file := range expected {
+		expectedFiles[file] = struct{}{}
+		if node := nodeOf(file); node != "" {
+			expectedNodes[node] = struct{}{}
+		}
+	}
+
+	orphanNodes := make(map[string]struct{})
+	for _, area := range []string{storage.GlobalPath, storage.NodesPath} {
+		stored, err := drv.List(area)
+		if err != nil {
+			return orphans, err
+		}
+		for _, file := range stored {
+			if _, ok := expectedFiles[file]; ok || protected(file) {
+				continue
+			}
+			orphans.Files = append(orphans.Files, file)
+			if node := nodeOf(file); node != "" {
+				if _, ok := expectedNodes[node]; !ok {
+					orphanNodes[node] = struct{}{}
+				}
+			}
+		}
+	}
+	for node := range orphanNodes {
+		orphans.Nodes = append(orphans.Nodes, node)
+	}
+	sort.Strings(orphans.Nodes)
+	return orphans, nil
+}
+
+// Archive moves files into archive/<stamp>/ keeping their relative path.
+func Archive(drv storage.StoreDrv, files []string, stamp string) (err error) {
+	for _, file := range files {
+		content, err := drv.Read(file)
+		if err != nil {
+			return err
+		}
+		err = drv.Write(path.Join(ArchivePath, stamp, file), content)
+		if err != nil {
+			return fmt.Errorf("error archiving file %q: %v", file, err)
+		}
+		err = drv.Delete(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Revoke adds every orphaned certificate to the revocation list of the CA that issued it.
+// Certificates not issued by one of our CA's are skipped.
+func Revoke(drv storage.StoreDrv, files []string, cas []kubecerts.CertificateAuthority) (revoked []string, err error) {
+	now := time.Now()
+	toRevoke := make(map[int][]pkix.RevokedCertificate)
+
+	for _, file := range files {
+		if path.Ext(file) != ".crt" {
+			continue
+		}
+		content, err := drv.Read(file)
+		if err != nil {
+			return revoked, err
+		}
+		block, _ := pem.Decode(content)
+		if block == nil || block.Type != sslutil.CertificateBlockType {
+			continue
+		}
+		crt, err := x509.ParseCertificate(block.Bytes)
+		if err != nil || crt.IsCA {
+			continue
+		}
+		for idx, ca := range cas {
+			if ca.Cert == nil || crt.CheckSignatureFrom(ca.Cert) != nil {
+				continue
+			}
+			toRevoke[idx] = append(toRevoke[idx], pkix.RevokedCertificate{
+				SerialNumber:   crt.SerialNumber,
+				RevocationTime: now.UTC(),
+			})
+			revoked = append(revoked, file)
+			break
+		}
+	}
+
+	for idx, entries := range toRevoke {
+		if err = appendCRL(drv, cas[idx], entries, now); err != nil {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+// appendCRL re-issues the CRL of a CA with entries added to the ones already revoked.
+// A CRL signed by a previous incarnation of the CA is discarded.
+func appendCRL(drv storage.StoreDrv, ca kubecerts.CertificateAuthority, entries []pkix.RevokedCertificate, now time.Time) (err error) {
+	content, err := drv.Read(crlPath(ca))
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if crl, err := x509.ParseCRL(content); err == nil && ca.Cert.CheckCRLSignature(crl) == nil {
+			entries = append(crl.TBSCertList.RevokedCertificates, entries...)
+		}
+	}
+
+	der, err := ca.Cert.CreateCRL(rand.Reader, ca.Key, entries, now.UTC(), now.Add(CRLValidity).UTC())
+	if err != nil {
+		return fmt.Errorf("error creating CRL for %q: %v", ca.WritePath, err)
+	}
+	return drv.Write(crlPath(ca), pem.EncodeToMemory(&pem.Block{Type: CRLBlockType, Bytes: der}))
+}
+
+// Execute lists (and unless listOnly is set, archives) everything in the destination
+// storage that is not part of the current cluster definition.
+func Execute(GlobalCfg config.GlobalConfig, expected []string, listOnly bool, revoke bool) (err error) {
+	cas := kubecerts.CertificateAuthorities()
+	for _, ca := range cas {
+		expected = append(expected, crlPath(ca))
+	}
+
+	drv := GlobalCfg.WriteDriver
+	orphans, err := FindOrphans(drv, expected)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range orphans.Nodes {
+		fmt.Printf("ORPHAN NODE: [%-30s]\n", node)
+	}
+	for _, file := range orphans.Files {
+		fmt.Printf("ORPHAN FILE: [%-30s] [%-50s]\n", nodeOf(file), file)
+	}
+	if listOnly || len(orphans.Files) == 0 {
+		return nil
+	}
+
+	if revoke {
+		revoked, err := Revoke(drv, orphans.Files, cas)
+		if err != nil {
+			return err
+		}
+		for _, file := range revoked {
+			fmt.Printf("REVOKED    : [%-30s] [%-50s]\n", nodeOf(file), file)
+		}
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405Z")
+	if err = Archive(drv, orphans.Files, stamp); err != nil {
+		return err
+	}
+	fmt.Printf("ARCHIVED   : [%-30s] [%-50s]\n", "", path.Join(ArchivePath, stamp))
+	Changed = true
+	return nil
+}
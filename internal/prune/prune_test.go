@@ -0,0 +1,82 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package prune
+
+import (
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestFindOrphansAndArchive(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-prune")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	drv := file.NewStoreFile(root)
+	expected := []string{
+		"global/etc/kubernetes/pki/ca.crt",
+		"nodes/w1/etc/kubernetes/pki/kubelet.crt",
+	}
+	stored := append([]string{
+		"global/etc/kubernetes/pki/users/alice.crt",
+		"nodes/w1/etc/kubernetes/pki/old.crt",
+		"nodes/w2/etc/kubernetes/pki/kubelet.crt",
+		"global/webhooks/ns/svc/tls.crt",
+	}, expected...)
+	for _, name := range stored {
+		if err = drv.Write(name, []byte(name)); err != nil {
+			t.Fatalf("Write(%q) error = %v", name, err)
+		}
+	}
+
+	orphans, err := FindOrphans(drv, expected)
+	if err != nil {
+		t.Fatalf("FindOrphans() error = %v", err)
+	}
+	if want := []string{"w2"}; !reflect.DeepEqual(orphans.Nodes, want) {
+		t.Errorf("FindOrphans() nodes = %v, want %v", orphans.Nodes, want)
+	}
+	wantFiles := []string{
+		"global/etc/kubernetes/pki/users/alice.crt",
+		"nodes/w1/etc/kubernetes/pki/old.crt",
+		"nodes/w2/etc/kubernetes/pki/kubelet.crt",
+	}
+	if !reflect.DeepEqual(orphans.Files, wantFiles) {
+		t.Errorf("FindOrphans() files = %v, want %v", orphans.Files, wantFiles)
+	}
+
+	if err = Archive(drv, orphans.Files, "stamp"); err != nil {
+		t.Fatalf("Archive() error = %v", err)
+	}
+	for _, name := range wantFiles {
+		if exists, _ := drv.Exists(name); exists {
+			t.Errorf("Archive() left %q in place", name)
+		}
+		if content, err := drv.Read("archive/stamp/" + name); err != nil || string(content) != name {
+			t.Errorf("Archive() did not move %q: %v", name, err)
+		}
+	}
+	if orphans, _ = FindOrphans(drv, expected); len(orphans.Files) != 0 {
+		t.Errorf("FindOrphans() after Archive() = %v", orphans.Files)
+	}
+}
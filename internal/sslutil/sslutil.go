@@ -18,8 +18,10 @@
 package sslutil
 
 import (
+	"bytes"
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
@@ -32,6 +34,8 @@ import (
 	"math"
 	"math/big"
 	"net"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -68,14 +72,73 @@ type CertConf struct {
 	PostalCode         []string `json:"PostalCode"`
 	AltNames           AltNames `json:"AltNames"`
 	Usages             []x509.ExtKeyUsage
+	// NameConstraints only apply to CA's
+	NameConstraints NameConstraints `json:"NameConstraints"`
 }
 
-// AltNames contains the domain names and IP addresses that will be added
+// NameConstraints restrict the names a CA can issue certificates for (RFC 5280 4.2.1.10).
+// A name kind without any permitted entry is not restricted beyond the excluded ones.
+type NameConstraints struct {
+	PermittedDNSDomains []string     `json:"PermittedDNSDomains"`
+	ExcludedDNSDomains  []string     `json:"ExcludedDNSDomains"`
+	PermittedIPRanges   []*net.IPNet `json:"PermittedIPRanges"`
+	ExcludedIPRanges    []*net.IPNet `json:"ExcludedIPRanges"`
+}
+
+func (nc NameConstraints) Empty() bool {
+	return len(nc.PermittedDNSDomains) == 0 && len(nc.ExcludedDNSDomains) == 0 &&
+		len(nc.PermittedIPRanges) == 0 && len(nc.ExcludedIPRanges) == 0
+}
+
+// AltNames contains the domain names, IP addresses, URIs and email addresses that will be added
 // to the API Server's x509 certificate SubAltNames field. The values will
 // be passed directly to the x509.Certificate object.
 type AltNames struct {
-	DNSNames []string `json:"DNSNames"`
-	IPs      []net.IP `json:"IPs"`
+	DNSNames       []string   `json:"DNSNames"`
+	IPs            []net.IP   `json:"IPs"`
+	URIs           []*url.URL `json:"URIs"`
+	EmailAddresses []string   `json:"EmailAddresses"`
+}
+
+// SubjectAltName kinds, see SanKind
+const (
+	SanDNS   = "DNS"
+	SanIP    = "IP"
+	SanURI   = "URI"
+	SanEmail = "EMAIL"
+)
+
+// SanKind tells which SubjectAltName field name goes into:
+// anything with a scheme ("spiffe://...") is an URI, anything else with an "@" an email address.
+func SanKind(name string) string {
+	switch {
+	case net.ParseIP(name) != nil:
+		return SanIP
+	case strings.Contains(name, "://"):
+		return SanURI
+	case strings.Contains(name, "@"):
+		return SanEmail
+	default:
+		return SanDNS
+	}
+}
+
+// NormalizeSans returns names the way they read back from a certificate (see GetAllSans)
+// so definitions can be compared to existing certificates.
+func NormalizeSans(names []string) (sans []string) {
+	sans = make([]string, 0, len(names))
+	for _, name := range names {
+		switch SanKind(name) {
+		case SanIP:
+			name = net.ParseIP(name).String()
+		case SanURI:
+			if uri, err := url.Parse(name); err == nil {
+				name = uri.String()
+			}
+		}
+		sans = append(sans, name)
+	}
+	return sans
 }
 
 func NewCertConfig(validity int, commonname string, organization []string, altnames []string) *CertConf {
@@ -100,15 +163,26 @@ func NewCertConfig(validity int, commonname string, organization []string, altna
 	// ip's and names should be unique regardless of input
 	netips := make([]net.IP, 0)
 	dnsnames := make([]string, 0)
+	uris := make([]*url.URL, 0)
+	emails := make([]string, 0)
 
 	mapToUniq := make(map[string]bool)
 
 	for _, name := range altnames {
 		if _, ok := mapToUniq[name]; !ok {
 			mapToUniq[name] = true
-			if netip := net.ParseIP(name); netip != nil {
-				netips = append(netips, netip)
-			} else {
+			switch SanKind(name) {
+			case SanIP:
+				netips = append(netips, net.ParseIP(name))
+			case SanURI:
+				// names are validated before reaching us, an unparsable URI is dropped
+				// and the cert is reissued on the next run as its alt names do not match
+				if uri, err := url.Parse(name); err == nil {
+					uris = append(uris, uri)
+				}
+			case SanEmail:
+				emails = append(emails, name)
+			default:
 				dnsnames = append(dnsnames, name)
 			}
 		}
@@ -116,6 +190,8 @@ func NewCertConfig(validity int, commonname string, organization []string, altna
 
 	template.AltNames.IPs = append(template.AltNames.IPs, netips...)
 	template.AltNames.DNSNames = append(template.AltNames.DNSNames, dnsnames...)
+	template.AltNames.URIs = append(template.AltNames.URIs, uris...)
+	template.AltNames.EmailAddresses = append(template.AltNames.EmailAddresses, emails...)
 
 	return &template
 }
@@ -143,6 +219,13 @@ func SelfSignedCaKey(cfg CertConf, caKey interface{}) (*x509.Certificate, interf
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 	}
+	if !cfg.NameConstraints.Empty() {
+		tmpl.PermittedDNSDomainsCritical = true
+		tmpl.PermittedDNSDomains = cfg.NameConstraints.PermittedDNSDomains
+		tmpl.ExcludedDNSDomains = cfg.NameConstraints.ExcludedDNSDomains
+		tmpl.PermittedIPRanges = cfg.NameConstraints.PermittedIPRanges
+		tmpl.ExcludedIPRanges = cfg.NameConstraints.ExcludedIPRanges
+	}
 
 	certDERBytes, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, PublicKey(caKey), caKey)
 	if err != nil {
@@ -157,7 +240,7 @@ func NewPrivateKey(keytype string) (interface{}, error) {
 	var priv interface{}
 	var err error
 	switch keytype {
-	case "":
+	case "", "RSA":
 		priv, err = rsa.GenerateKey(rand.Reader, rsaBits)
 	case "P224":
 		priv, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
@@ -167,6 +250,8 @@ func NewPrivateKey(keytype string) (interface{}, error) {
 		priv, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
 	case "P521":
 		priv, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "ED25519":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
 	default:
 		fmt.Printf("Unrecognized elliptic curve: %s", keytype)
 		return nil, nil
@@ -184,11 +269,27 @@ func PublicKey(priv interface{}) interface{} {
 		return &k.PublicKey
 	case *ecdsa.PrivateKey:
 		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
 	default:
 		return nil
 	}
 }
 
+// KeyType names the type of a private key the way NewPrivateKey expects it: "RSA", "P256", "ED25519", ...
+func KeyType(priv interface{}) string {
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		return "RSA"
+	case *ecdsa.PrivateKey:
+		return strings.Replace(k.Curve.Params().Name, "-", "", -1)
+	case ed25519.PrivateKey:
+		return "ED25519"
+	default:
+		return ""
+	}
+}
+
 func SelfSignedCertKey(cfg CertConf, caCertificate *x509.Certificate, caKey, certKey interface{}) (*x509.Certificate, interface{}, error) {
 	validFrom := time.Now().Add(-time.Hour) // valid an hour earlier to avoid flakes due to clock skew
 	//maxAge := cfg.Validity          // one year self-signed certs
@@ -225,6 +326,8 @@ func SelfSignedCertKey(cfg CertConf, caCertificate *x509.Certificate, caKey, cer
 
 	template.IPAddresses = append(template.IPAddresses, cfg.AltNames.IPs...)
 	template.DNSNames = append(template.DNSNames, cfg.AltNames.DNSNames...)
+	template.URIs = append(template.URIs, cfg.AltNames.URIs...)
+	template.EmailAddresses = append(template.EmailAddresses, cfg.AltNames.EmailAddresses...)
 
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, caCertificate, PublicKey(certKey), caKey)
 	if err != nil {
@@ -268,8 +371,8 @@ func EncodePublicKeyPEM(key crypto.PublicKey) ([]byte, error) {
 	return pem.EncodeToMemory(&block), nil
 }
 
-// MarshalPrivateKeyToPEM converts a known private key type of RSA or ECDSA to
-// a PEM encoded block or returns an error.
+// MarshalPrivateKeyToPEM converts a known private key type of RSA, ECDSA or Ed25519 to
+// a PEM encoded block or returns an error. Ed25519 keys only come in PKCS#8.
 func MarshalPrivateKeyToPEM(privateKey crypto.PrivateKey) ([]byte, error) {
 	switch t := privateKey.(type) {
 	case *ecdsa.PrivateKey:
@@ -288,6 +391,16 @@ func MarshalPrivateKeyToPEM(privateKey crypto.PrivateKey) ([]byte, error) {
 			Bytes: x509.MarshalPKCS1PrivateKey(t),
 		}
 		return pem.EncodeToMemory(block), nil
+	case ed25519.PrivateKey:
+		derBytes, err := x509.MarshalPKCS8PrivateKey(t)
+		if err != nil {
+			return nil, err
+		}
+		block := &pem.Block{
+			Type:  PrivateKeyBlockType,
+			Bytes: derBytes,
+		}
+		return pem.EncodeToMemory(block), nil
 	default:
 		return nil, fmt.Errorf("private key is not a recognized type: %T", privateKey)
 	}
@@ -315,7 +428,7 @@ func ParsePrivateKeyPEM(keyData []byte) (interface{}, error) {
 				return key, nil
 			}
 		case PrivateKeyBlockType:
-			// RSA or ECDSA Private Key in unencrypted PKCS#8 format
+			// RSA, ECDSA or Ed25519 Private Key in unencrypted PKCS#8 format
 			if key, err := x509.ParsePKCS8PrivateKey(privateKeyPemBlock.Bytes); err == nil {
 				return key, nil
 			}
@@ -326,22 +439,47 @@ func ParsePrivateKeyPEM(keyData []byte) (interface{}, error) {
 	}
 
 	// we read all the PEM blocks and didn't recognize one
-	return nil, fmt.Errorf("data does not contain a valid RSA or ECDSA private key")
+	return nil, fmt.Errorf("data does not contain a valid RSA, ECDSA or Ed25519 private key")
 }
 
+// VerifyCrtSignature verifies a self signed cert (a CA) was signed by key: the signature checks out
+// against the public key in the cert and that public key is the one of key.
 func VerifyCrtSignature(crt *x509.Certificate, key interface{}) (err error) {
-	err = crt.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature)
-	if err != nil {
-		fmt.Printf("CheckSignature ORIG: %q\n", err)
+	if err = crt.CheckSignatureFrom(crt); err != nil {
 		return err
 	}
-	certcopy := *crt
-	certcopy.PublicKey = PublicKey(key)
+	return KeyMatchesCrt(crt, key)
+}
 
-	err = crt.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature)
-	if err != nil {
-		fmt.Printf("CheckSignature COPY: %q\n	", err)
-		return err
+// KeyMatchesCrt verifies key is the private key of the public key crt carries
+func KeyMatchesCrt(crt *x509.Certificate, key interface{}) (err error) {
+	switch pub := crt.PublicKey.(type) {
+	case *rsa.PublicKey:
+		priv, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("certificate has a RSA public key, private key is %T", key)
+		}
+		if pub.N.Cmp(priv.N) != 0 || pub.E != priv.E {
+			return fmt.Errorf("private key does not match the certificate")
+		}
+	case *ecdsa.PublicKey:
+		priv, ok := key.(*ecdsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("certificate has an ECDSA public key, private key is %T", key)
+		}
+		if pub.Curve != priv.Curve || pub.X.Cmp(priv.X) != 0 || pub.Y.Cmp(priv.Y) != 0 {
+			return fmt.Errorf("private key does not match the certificate")
+		}
+	case ed25519.PublicKey:
+		priv, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return fmt.Errorf("certificate has an Ed25519 public key, private key is %T", key)
+		}
+		if !bytes.Equal(pub, priv.Public().(ed25519.PublicKey)) {
+			return fmt.Errorf("private key does not match the certificate")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", crt.PublicKey)
 	}
 	return nil
 }
@@ -379,5 +517,57 @@ func GetAllSans(crt *x509.Certificate) (sans []string) {
 	sans = append(sans, crt.DNSNames...)
 	ipStrings := ipsToStrings(crt.IPAddresses)
 	sans = append(sans, ipStrings...)
+	for _, uri := range crt.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, crt.EmailAddresses...)
 	return sans
 }
+
+// matchDomain reports whether name is within domain: the domain itself or one of its subdomains.
+// A domain starting with a dot only matches subdomains.
+func matchDomain(name string, domain string) bool {
+	name = strings.ToLower(name)
+	domain = strings.ToLower(domain)
+	if strings.HasPrefix(domain, ".") {
+		return strings.HasSuffix(name, domain)
+	}
+	return name == domain || strings.HasSuffix(name, "."+domain)
+}
+
+func matchIPRange(ip net.IP, ranges []*net.IPNet) bool {
+	for _, ipnet := range ranges {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckNameConstraints verifies the alt names do not violate the name constraints of ca,
+// so a cert is refused before being issued rather than failing verification later on.
+func CheckNameConstraints(ca *x509.Certificate, altNames AltNames) (err error) {
+	for _, name := range altNames.DNSNames {
+		permitted := len(ca.PermittedDNSDomains) == 0
+		for _, domain := range ca.PermittedDNSDomains {
+			permitted = permitted || matchDomain(name, domain)
+		}
+		if !permitted {
+			return fmt.Errorf("%q is not within the permitted DNS domains %v of CA %q", name, ca.PermittedDNSDomains, ca.Subject.CommonName)
+		}
+		for _, domain := range ca.ExcludedDNSDomains {
+			if matchDomain(name, domain) {
+				return fmt.Errorf("%q is within the excluded DNS domain %q of CA %q", name, domain, ca.Subject.CommonName)
+			}
+		}
+	}
+	for _, ip := range altNames.IPs {
+		if len(ca.PermittedIPRanges) > 0 && !matchIPRange(ip, ca.PermittedIPRanges) {
+			return fmt.Errorf("%s is not within the permitted IP ranges %v of CA %q", ip, ca.PermittedIPRanges, ca.Subject.CommonName)
+		}
+		if matchIPRange(ip, ca.ExcludedIPRanges) {
+			return fmt.Errorf("%s is within the excluded IP ranges %v of CA %q", ip, ca.ExcludedIPRanges, ca.Subject.CommonName)
+		}
+	}
+	return nil
+}
@@ -18,6 +18,11 @@
 package sslutil
 
 import (
+	"crypto/x509"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -27,3 +32,160 @@ func TestNewPrivateKey(t *testing.T) {
 		t.Errorf("NewPrivateKey failed")
 	}
 }
+
+func TestKeyType(t *testing.T) {
+	for _, keytype := range []string{"RSA", "P256", "P384", "ED25519"} {
+		key, err := NewPrivateKey(keytype)
+		if err != nil || key == nil {
+			t.Fatalf("NewPrivateKey(%q) failed: %v", keytype, err)
+		}
+		if got := KeyType(key); got != keytype {
+			t.Errorf("KeyType() = %q, want %q", got, keytype)
+		}
+	}
+}
+
+func TestAltNamesRoundTrip(t *testing.T) {
+	names := []string{
+		"node1.example.org",
+		"*.apps.example.org",
+		"10.0.0.1",
+		"fd00::1",
+		"spiffe://cluster.local/ns/default/sa/web",
+		"bob@example.org",
+		"10.0.0.1",
+	}
+	cfg := NewCertConfig(365, "node1", nil, names)
+	if len(cfg.AltNames.DNSNames) != 2 || len(cfg.AltNames.IPs) != 2 ||
+		len(cfg.AltNames.URIs) != 1 || len(cfg.AltNames.EmailAddresses) != 1 {
+		t.Fatalf("NewCertConfig() alt names = %+v", cfg.AltNames)
+	}
+
+	ca, caKey, err := SelfSignedCaKey(CertConf{CommonName: "ca"}, nil)
+	if err != nil {
+		t.Fatalf("SelfSignedCaKey() error = %v", err)
+	}
+	crt, _, err := SelfSignedCertKey(*cfg, ca, caKey, nil)
+	if err != nil {
+		t.Fatalf("SelfSignedCertKey() error = %v", err)
+	}
+	got := GetAllSans(crt)
+	want := NormalizeSans(names[:len(names)-1])
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAllSans() = %v, want %v", got, want)
+	}
+}
+
+func TestSanKind(t *testing.T) {
+	tests := map[string]string{
+		"node1.example.org":  SanDNS,
+		"*.example.org":      SanDNS,
+		"10.0.0.1":           SanIP,
+		"fd00::1":            SanIP,
+		"spiffe://a/b":       SanURI,
+		"https://u@host/":    SanURI,
+		"bob@example.org":    SanEmail,
+		"FD00:0:0:0:0:0:0:1": SanIP,
+	}
+	for name, want := range tests {
+		if got := SanKind(name); got != want {
+			t.Errorf("SanKind(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNameConstraints(t *testing.T) {
+	_, permitted, _ := net.ParseCIDR("10.0.0.0/24")
+	_, excluded, _ := net.ParseCIDR("10.0.0.128/25")
+	cfg := CertConf{CommonName: "ca", NameConstraints: NameConstraints{
+		PermittedDNSDomains: []string{"example.org", "localhost"},
+		ExcludedDNSDomains:  []string{"evil.example.org"},
+		PermittedIPRanges:   []*net.IPNet{permitted},
+		ExcludedIPRanges:    []*net.IPNet{excluded},
+	}}
+	ca, caKey, err := SelfSignedCaKey(cfg, nil)
+	if err != nil {
+		t.Fatalf("SelfSignedCaKey() error = %v", err)
+	}
+	if !ca.PermittedDNSDomainsCritical || len(ca.PermittedDNSDomains) != 2 || len(ca.ExcludedIPRanges) != 1 {
+		t.Fatalf("CA name constraints not set: %v %v", ca.PermittedDNSDomains, ca.ExcludedIPRanges)
+	}
+
+	tests := map[string]bool{
+		"node1.example.org":      true,
+		"example.org":            true,
+		"*.apps.example.org":     true,
+		"localhost":              true,
+		"10.0.0.1":               true,
+		"spiffe://other.org/a":   true,
+		"node1.other.org":        false,
+		"notexample.org":         false,
+		"x.evil.example.org":     false,
+		"10.0.0.200":             false,
+		"10.0.1.1":               false,
+		"fd00::1":                false,
+		"bob@unconstrained.kind": true,
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	for name, ok := range tests {
+		leafCfg := NewCertConfig(0, "leaf", nil, []string{name})
+		err := CheckNameConstraints(ca, leafCfg.AltNames)
+		if (err == nil) != ok {
+			t.Errorf("CheckNameConstraints(%q) error = %v, want ok %v", name, err, ok)
+			continue
+		}
+		if !ok || strings.HasPrefix(name, "*") {
+			continue
+		}
+		// what we let through has to pass verification as well
+		leaf, _, err := SelfSignedCertKey(*leafCfg, ca, caKey, nil)
+		if err != nil {
+			t.Fatalf("SelfSignedCertKey() error = %v", err)
+		}
+		if _, err = leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+			t.Errorf("verifying %q: %v", name, err)
+		}
+	}
+}
+
+func TestKeyMatchesCrt(t *testing.T) {
+	for _, keytype := range []string{"RSA", "P256", "ED25519"} {
+		key, _ := NewPrivateKey(keytype)
+		other, _ := NewPrivateKey(keytype)
+		crt, _, err := SelfSignedCaKey(CertConf{CommonName: "ca"}, key)
+		if err != nil {
+			t.Fatalf("SelfSignedCaKey() error = %v", err)
+		}
+		if err = KeyMatchesCrt(crt, key); err != nil {
+			t.Errorf("KeyMatchesCrt(%s) error = %v", keytype, err)
+		}
+		if err = KeyMatchesCrt(crt, other); err == nil {
+			t.Errorf("KeyMatchesCrt(%s) should fail for another key", keytype)
+		}
+		if err = VerifyCrtSignature(crt, other); err == nil {
+			t.Errorf("VerifyCrtSignature(%s) should fail for another key", keytype)
+		}
+
+		// keys survive a round trip through PEM
+		keyPEM, err := MarshalPrivateKeyToPEM(key)
+		if err != nil {
+			t.Fatalf("MarshalPrivateKeyToPEM(%s) error = %v", keytype, err)
+		}
+		_, parsed, err := LoadCrtAndKeyFromPEM(EncodeCertPEM(crt), keyPEM)
+		if err != nil {
+			t.Fatalf("LoadCrtAndKeyFromPEM(%s) error = %v", keytype, err)
+		}
+		if err = VerifyCrtSignature(crt, parsed); err != nil {
+			t.Errorf("VerifyCrtSignature(%s) error = %v", keytype, err)
+		}
+	}
+	rsaKey, _ := NewPrivateKey("RSA")
+	ecKey, _ := NewPrivateKey("P256")
+	crt, _, _ := SelfSignedCaKey(CertConf{CommonName: "ca"}, rsaKey)
+	if err := KeyMatchesCrt(crt, ecKey); err == nil {
+		t.Errorf("KeyMatchesCrt() should fail for a key of another type")
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"path"
+	"strconv"
+)
+
+const (
+	// EncryptedBlockType is the pem.Block.Type used for sealed files.
+	EncryptedBlockType = "GENKUBESSL ENCRYPTED DATA"
+
+	cryptCipher = "AES-256-GCM"
+	cryptKDF    = "PBKDF2-SHA256"
+
+	cryptKeyLen        = 32
+	cryptSaltLen       = 16
+	cryptKDFIterations = 100000
+)
+
+// StoreCrypt wraps another driver and seals files with AES-GCM before they
+// reach it. Only files whose extension is listed in Extensions (private keys,
+// manifests and kubeconfigs carrying secrets by default) are sealed, everything else
+// (certificates, public keys) is passed through in clear.
+type StoreCrypt struct {
+	StoreDrv
+	Extensions []string
+
+	passphrase []byte
+	salt       []byte
+	keys       map[string][]byte
+}
+
+func NewStoreCrypt(backend StoreDrv, passphrase []byte) *StoreCrypt {
+	return &StoreCrypt{
+		StoreDrv:   backend,
+		Extensions: []string{".key", ".yaml", ".conf"},
+		passphrase: passphrase,
+		keys:       make(map[string][]byte),
+	}
+}
+
+func (s *StoreCrypt) sealed(filePath string) bool {
+	ext := path.Ext(filePath)
+	for _, e := range s.Extensions {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+// deriveKey caches derived keys by salt. Writes reuse a single salt for the
+// lifetime of the driver so the (deliberately slow) KDF only runs once per run.
+func (s *StoreCrypt) deriveKey(salt []byte) []byte {
+	if key, ok := s.keys[string(salt)]; ok {
+		return key
+	}
+	key := pbkdf2SHA256(s.passphrase, salt, cryptKDFIterations, cryptKeyLen)
+	s.keys[string(salt)] = key
+	return key
+}
+
+func (s *StoreCrypt) Read(filePath string) (content []byte, err error) {
+	content, err = s.StoreDrv.Read(filePath)
+	if err != nil || !s.sealed(filePath) {
+		return content, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil || block.Type != EncryptedBlockType {
+		// not sealed yet (written before encryption was enabled), hand it over as is
+		return content, nil
+	}
+	content, err = s.open(block)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt file: %s: %v", filePath, err)
+	}
+	return content, nil
+}
+
+// Unsealed tells whether a file that gets sealed on write is still stored in clear,
+// written before encryption was enabled. Read hands such files over as they are.
+func (s *StoreCrypt) Unsealed(filePath string) (bool, error) {
+	if !s.sealed(filePath) {
+		return false, nil
+	}
+	content, err := s.StoreDrv.Read(filePath)
+	if err != nil {
+		return false, err
+	}
+	block, _ := pem.Decode(content)
+	return block == nil || block.Type != EncryptedBlockType, nil
+}
+
+func (s *StoreCrypt) Write(filePath string, content []byte) (err error) {
+	if !s.sealed(filePath) {
+		return s.StoreDrv.Write(filePath, content)
+	}
+	sealed, err := s.seal(content)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt file: %s: %v", filePath, err)
+	}
+	return s.StoreDrv.Write(filePath, sealed)
+}
+
+func (s *StoreCrypt) WriteBatch(files map[string][]byte) (err error) {
+	return s.Apply(files, nil)
+}
+
+func (s *StoreCrypt) Apply(writes map[string][]byte, deletes []string) (err error) {
+	batch := make(map[string][]byte, len(writes))
+	for filePath, content := range writes {
+		if s.sealed(filePath) {
+			if content, err = s.seal(content); err != nil {
+				return fmt.Errorf("cannot encrypt file: %s: %v", filePath, err)
+			}
+		}
+		batch[filePath] = content
+	}
+	return s.StoreDrv.Apply(batch, deletes)
+}
+
+func (s *StoreCrypt) seal(content []byte) ([]byte, error) {
+	if s.salt == nil {
+		s.salt = make([]byte, cryptSaltLen)
+		if _, err := rand.Read(s.salt); err != nil {
+			return nil, err
+		}
+	}
+	aead, err := newGCM(s.deriveKey(s.salt))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	block := &pem.Block{
+		Type: EncryptedBlockType,
+		Headers: map[string]string{
+			"Cipher":     cryptCipher,
+			"KDF":        cryptKDF,
+			"Iterations": strconv.Itoa(cryptKDFIterations),
+			"Salt":       hex.EncodeToString(s.salt),
+			"Nonce":      hex.EncodeToString(nonce),
+		},
+		Bytes: aead.Seal(nil, nonce, content, nil),
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+func (s *StoreCrypt) open(block *pem.Block) ([]byte, error) {
+	if block.Headers["Cipher"] != cryptCipher || block.Headers["KDF"] != cryptKDF {
+		return nil, fmt.Errorf("unsupported cipher %q or kdf %q", block.Headers["Cipher"], block.Headers["KDF"])
+	}
+	if block.Headers["Iterations"] != strconv.Itoa(cryptKDFIterations) {
+		return nil, fmt.Errorf("unsupported kdf iterations %q", block.Headers["Iterations"])
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt: %v", err)
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce: %v", err)
+	}
+	aead, err := newGCM(s.deriveKey(salt))
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("invalid nonce length: %d", len(nonce))
+	}
+	return aead.Open(nil, nonce, block.Bytes, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	blockCipher, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blockCipher)
+}
+
+// pbkdf2SHA256 implements PBKDF2 (RFC 8018) with HMAC-SHA256.
+// golang.org/x/crypto is not vendored so we carry our own few lines.
+func pbkdf2SHA256(password, salt []byte, iter, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLen := prf.Size()
+	numBlocks := (keyLen + hashLen - 1) / hashLen
+
+	var buf [4]byte
+	dk := make([]byte, 0, numBlocks*hashLen)
+	u := make([]byte, hashLen)
+	for block := 1; block <= numBlocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf[:], uint32(block))
+		prf.Write(buf[:])
+		dk = prf.Sum(dk)
+		t := dk[len(dk)-hashLen:]
+		copy(u, t)
+
+		for n := 2; n <= iter; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = u[:0]
+			u = prf.Sum(u)
+			for x := range u {
+				t[x] ^= u[x]
+			}
+		}
+	}
+	return dk[:keyLen]
+}
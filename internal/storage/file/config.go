@@ -0,0 +1,167 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SetConfigValue sets one driver option. Keys are the lower cased field names:
+// makeroot, makedirs, rootdirmode, dirmode, filemode, certmode, keymode, pubmode, owner, group, lockfile.
+// Modes are octal (e.g. 0640).
+func (s *StoreFile) SetConfigValue(key string, value string) (err error) {
+	var modes = map[string]*os.FileMode{
+		"rootdirmode": &s.RootDirMode,
+		"dirmode":     &s.DirMode,
+		"filemode":    &s.FileMode,
+		"certmode":    &s.CertMode,
+		"keymode":     &s.KeyMode,
+		"pubmode":     &s.PubMode,
+	}
+	key = strings.ToLower(key)
+
+	if field, ok := modes[key]; ok {
+		mode, err := parseMode(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for file storage option %q: %v", key, err)
+		}
+		*field = mode
+		return nil
+	}
+
+	switch key {
+	case "makeroot", "makedirs":
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for file storage option %q: %v", key, err)
+		}
+		if key == "makeroot" {
+			s.MakeRoot = flag
+		} else {
+			s.MakeDirs = flag
+		}
+	case "owner":
+		if _, err = lookupUser(value); err != nil {
+			return fmt.Errorf("invalid value for file storage option %q: %v", key, err)
+		}
+		s.Owner = value
+	case "group":
+		if _, err = lookupGroup(value); err != nil {
+			return fmt.Errorf("invalid value for file storage option %q: %v", key, err)
+		}
+		s.Group = value
+	case "lockfile":
+		if value == "" || filepath.IsAbs(value) {
+			return fmt.Errorf("invalid value for file storage option %q: must be relative to the storage root", key)
+		}
+		s.LockFile = value
+	default:
+		return fmt.Errorf("unknown file storage option: %q", key)
+	}
+	return nil
+}
+
+// LoadConfig reads options from a file holding one key=value pair per line.
+// Empty lines and lines starting with # are ignored.
+func (s *StoreFile) LoadConfig(filepath string) (err error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return fmt.Errorf("cannot read file storage config: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("%s:%d: expected key=value", filepath, lineNo)
+		}
+		err = s.SetConfigValue(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", filepath, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func parseMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode > 0777 {
+		return 0, fmt.Errorf("mode out of range: %s", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// lookupUser accepts either a user name or a numeric uid
+func lookupUser(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGroup accepts either a group name or a numeric gid
+func lookupGroup(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// chown applies Owner and Group (when set) to path
+func (s *StoreFile) chown(path string) (err error) {
+	if s.Owner == "" && s.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if s.Owner != "" {
+		if uid, err = lookupUser(s.Owner); err != nil {
+			return fmt.Errorf("cannot resolve owner %q: %v", s.Owner, err)
+		}
+	}
+	if s.Group != "" {
+		if gid, err = lookupGroup(s.Group); err != nil {
+			return fmt.Errorf("cannot resolve group %q: %v", s.Group, err)
+		}
+	}
+	if err = os.Lchown(path, uid, gid); err != nil {
+		return fmt.Errorf("cannot change ownership of %s: %v", path, err)
+	}
+	return nil
+}
@@ -18,12 +18,15 @@
 package file
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 )
 
 type StoreFile struct {
@@ -32,9 +35,21 @@ type StoreFile struct {
 	MakeDirs    bool
 	RootDirMode os.FileMode
 	DirMode     os.FileMode
-	FileMode    os.FileMode
-	Owner       string
-	Group       string
+	// FileMode is used for files that are neither certificates nor keys
+	FileMode os.FileMode
+	// CertMode is used for certificates (*.crt)
+	CertMode os.FileMode
+	// KeyMode is used for private keys (*.key)
+	KeyMode os.FileMode
+	// PubMode is used for public keys (*.pub)
+	PubMode os.FileMode
+	// Owner and Group are user / group names or numeric id's. Empty means leave as is.
+	Owner string
+	Group string
+	// LockFile is the path, relative to RootPath, of the file used by Lock
+	LockFile string
+	// TxnDir is the directory, relative to RootPath, batches are staged in by Apply
+	TxnDir string
 }
 
 func NewStoreFile(rootPath string) *StoreFile {
@@ -46,19 +61,63 @@ func NewStoreFile(rootPath string) *StoreFile {
 		RootDirMode: 0755,
 		DirMode:     0755,
 		FileMode:    0600,
+		CertMode:    0644,
+		KeyMode:     0600,
+		PubMode:     0644,
 		Owner:       "",
 		Group:       "",
+		LockFile:    DefaultLockFile,
+		TxnDir:      DefaultTxnDir,
 	}
 }
 
+// fileMode returns the mode a file should be written with based on its extension
+func (s *StoreFile) fileMode(filePath string) os.FileMode {
+	switch filepath.Ext(filePath) {
+	case ".crt":
+		return s.CertMode
+	case ".key":
+		return s.KeyMode
+	case ".pub":
+		return s.PubMode
+	default:
+		return s.FileMode
+	}
+}
+
+// makeDir creates directory (if allowed) and applies mode and ownership
+// to every directory it had to create
+func (s *StoreFile) makeDir(directory string, makeIt bool, mode os.FileMode) (err error) {
+	var created []string
+	for dir := filepath.Clean(directory); ; dir = filepath.Dir(dir) {
+		if _, err = os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+			break
+		}
+		created = append(created, dir)
+	}
+
+	if err = checkMakeDir(directory, makeIt, mode); err != nil {
+		return err
+	}
+	for _, dir := range created {
+		// MkdirAll is subject to umask
+		if err = os.Chmod(dir, mode); err != nil {
+			return err
+		}
+		if err = s.chown(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func checkMakeDir(directory string, makeIt bool, mode os.FileMode) (err error) {
 	if _, err = os.Stat(directory); err != nil {
 		if !makeIt {
 			return fmt.Errorf("base directory does not exist we are set not to create it: %s :%v\n", directory, err)
 		}
-		err = os.MkdirAll(directory, mode)
-		if err != nil {
-			log.Fatalf("cant make dir: %q\n", directory)
+		if err = os.MkdirAll(directory, mode); err != nil {
+			return fmt.Errorf("cant make dir: %q: %v", directory, err)
 		}
 	}
 	return nil
@@ -69,47 +128,136 @@ func (s *StoreFile) Read(filePath string) (content []byte, err error) {
 	fullpath := path.Join(s.RootPath, filePath)
 
 	if _, err := os.Stat(fullpath); err != nil {
-		return nil, fmt.Errorf("cannot read file: %s", fullpath)
+		return nil, fmt.Errorf("cannot read file: %s: %w", fullpath, err)
 	}
 
 	return ioutil.ReadFile(fullpath)
 }
 
-func (s *StoreFile) Write(filePath string, content []byte) (err error) {
-	//dirmode, err := strconv.ParseUint(s.config["dirmode"], 8, 32)
-	//if err != nil {
-	//	dirmode = 0755
-	//}
-
-	//filemode, err := strconv.ParseUint(s.config["filemode"], 8, 32)
-	//if err != nil {
-	//	filemode = 0600
-	//}
-	err = checkMakeDir(s.RootPath, s.MakeRoot, s.RootDirMode)
-	if err != nil {
-		return err
+// List returns the paths (relative to RootPath and using forward slashes) of
+// all regular files found under dirPath, recursively and sorted.
+// A missing directory is not an error, it simply holds no files.
+func (s *StoreFile) List(dirPath string) (files []string, err error) {
+	fullpath := filepath.Join(s.RootPath, dirPath)
+
+	if _, err = os.Stat(fullpath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cannot list directory: %s: %w", fullpath, err)
 	}
-	fileFullPath := filepath.Join(s.RootPath, filePath)
-	fileDirPath := filepath.Dir(fileFullPath)
-	err = checkMakeDir(fileDirPath, s.MakeDirs, s.DirMode)
+
+	err = filepath.Walk(fullpath, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(s.RootPath, walkPath)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(relPath))
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("cannot list directory: %s: %w", fullpath, err)
 	}
+	sort.Strings(files)
+	return files, nil
+}
 
-	if _, err := os.Stat(fileFullPath); err != nil {
-		err = os.Remove(fileFullPath)
+func (s *StoreFile) Exists(filePath string) (exists bool, err error) {
+	_, err = s.Stat(filePath)
+	if err == nil {
+		return true, nil
 	}
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return false, err
+}
+
+func (s *StoreFile) Stat(filePath string) (info os.FileInfo, err error) {
+	fullpath := filepath.Join(s.RootPath, filePath)
+
+	info, err = os.Stat(fullpath)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("cannot stat file: %s: %w", fullpath, err)
+	}
+	return info, nil
+}
+
+// Delete removes a file along with any parent directories it leaves empty
+// so that pruned nodes do not linger around as empty directory trees.
+func (s *StoreFile) Delete(filePath string) (err error) {
+	fullpath := filepath.Join(s.RootPath, filePath)
+
+	if err = os.Remove(fullpath); err != nil {
+		return fmt.Errorf("cannot delete file: %s: %w", fullpath, err)
+	}
+	root := filepath.Clean(s.RootPath)
+	for dir := filepath.Dir(fullpath); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// fails (and stops us) as soon as a directory is not empty
+		if os.Remove(dir) != nil {
+			break
+		}
 	}
+	return nil
+}
 
-	return ioutil.WriteFile(fileFullPath, content, s.FileMode)
+func (s *StoreFile) Write(filePath string, content []byte) (err error) {
+	return s.WriteBatch(map[string][]byte{filePath: content})
 }
 
-func (s *StoreFile) SetConfigValue(key string, value string) {
-	return
+// WriteBatch writes every file in a single batch, see Apply
+func (s *StoreFile) WriteBatch(files map[string][]byte) (err error) {
+	return s.Apply(files, nil)
 }
 
-func (s *StoreFile) LoadConfig(filepath string) (err error) {
+// writeFile creates filePath, which must not exist yet, with content and the final mode and
+// ownership already applied and fsyncs it.
+func (s *StoreFile) writeFile(filePath string, content []byte, mode os.FileMode) (err error) {
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(filePath)
+		}
+	}()
+
+	if _, err = f.Write(content); err != nil {
+		return err
+	}
+	// the file is created with 0600, explicitly set what was asked for
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	if err = s.chown(filePath); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable. Directories can not be fsync-ed on windows.
+func syncDir(dir string) (err error) {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("cannot sync directory: %s: %v", dir, err)
+	}
 	return nil
 }
@@ -1,8 +1,14 @@
 package file
 
 import (
+	"errors"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const TestDirPath = "test/will-be-deleted"
@@ -27,6 +33,15 @@ func Test_checkMakeDir(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "directory under a file, create it true",
+			args: args{
+				directory: "file.go/sub",
+				makeIt:    true,
+				mode:      0755,
+			},
+			wantErr: true,
+		},
 	}
 	err := os.RemoveAll(TestDirPath)
 	if err != nil {
@@ -40,3 +55,239 @@ func Test_checkMakeDir(t *testing.T) {
 		})
 	}
 }
+
+func TestStoreFileOperations(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-file")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStoreFile(root)
+	for _, name := range []string{"nodes/b/etc/b.crt", "global/ca.crt", "nodes/a/etc/a.crt"} {
+		if err = s.Write(name, []byte(name)); err != nil {
+			t.Fatalf("Write(%q) error = %v", name, err)
+		}
+	}
+
+	files, err := s.List("nodes")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if want := []string{"nodes/a/etc/a.crt", "nodes/b/etc/b.crt"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("List() = %v, want %v", files, want)
+	}
+	if files, err = s.List("missing"); err != nil || len(files) != 0 {
+		t.Errorf("List() on missing dir = %v, %v", files, err)
+	}
+
+	if exists, err := s.Exists("global/ca.crt"); !exists || err != nil {
+		t.Errorf("Exists() = %t, %v, want true", exists, err)
+	}
+	if info, err := s.Stat("global/ca.crt"); err != nil || info.Size() != int64(len("global/ca.crt")) {
+		t.Errorf("Stat() = %v, %v", info, err)
+	}
+
+	if err = s.Delete("global/ca.crt"); err != nil {
+		t.Errorf("Delete() error = %v", err)
+	}
+	if exists, err := s.Exists("global/ca.crt"); exists || err != nil {
+		t.Errorf("Exists() after Delete() = %t, %v, want false", exists, err)
+	}
+	if _, err = s.Read("global/ca.crt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Read() of deleted file error = %v, want not exist", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "global")); !os.IsNotExist(err) {
+		t.Errorf("Delete() should remove empty parent directories")
+	}
+	if _, err = os.Stat(root); err != nil {
+		t.Errorf("Delete() must not remove the root directory: %v", err)
+	}
+}
+
+func TestStoreFileModes(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-file")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStoreFile(root)
+	for key, value := range map[string]string{"certmode": "0640", "keymode": "0400", "dirmode": "0750"} {
+		if err = s.SetConfigValue(key, value); err != nil {
+			t.Fatalf("SetConfigValue(%q, %q) error = %v", key, value, err)
+		}
+	}
+	if err = s.SetConfigValue("keymode", "999"); err == nil {
+		t.Errorf("SetConfigValue() should reject invalid modes")
+	}
+	if err = s.SetConfigValue("unknown", "1"); err == nil {
+		t.Errorf("SetConfigValue() should reject unknown options")
+	}
+
+	wantModes := map[string]os.FileMode{
+		"global/pki/ca.crt": 0640,
+		"global/pki/ca.key": 0400,
+		"global/pki/sa.pub": 0644,
+		"global/pki/other":  0600,
+		"global/pki":        0750 | os.ModeDir,
+	}
+	for _, name := range []string{"global/pki/ca.crt", "global/pki/ca.key", "global/pki/sa.pub", "global/pki/other"} {
+		if err = s.Write(name, []byte(name)); err != nil {
+			t.Fatalf("Write(%q) error = %v", name, err)
+		}
+	}
+	for name, want := range wantModes {
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatalf("Stat(%q) error = %v", name, err)
+		}
+		if info.Mode() != want {
+			t.Errorf("mode of %q = %v, want %v", name, info.Mode(), want)
+		}
+	}
+}
+
+func TestStoreFileWriteBatch(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-file")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStoreFile(root)
+	if err = s.Write("global/ca.crt", []byte("old")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	err = s.WriteBatch(map[string][]byte{
+		"global/ca.crt": []byte("new crt"),
+		"global/ca.key": []byte("new key"),
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+	for name, want := range map[string]string{"global/ca.crt": "new crt", "global/ca.key": "new key"} {
+		if content, err := s.Read(name); err != nil || string(content) != want {
+			t.Errorf("Read(%q) = %q, %v, want %q", name, content, err, want)
+		}
+	}
+	// no temporary files are left behind
+	if files, _ := s.List("global"); !reflect.DeepEqual(files, []string{"global/ca.crt", "global/ca.key"}) {
+		t.Errorf("List() after WriteBatch() = %v", files)
+	}
+}
+
+func TestStoreFileApply(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-file")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStoreFile(root)
+	if err = s.WriteBatch(map[string][]byte{"global/ca.crt": []byte("old"), "nodes/w1/kubelet.crt": []byte("w1")}); err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+	if err = s.Apply(map[string][]byte{"global/ca.crt": []byte("new")}, []string{"nodes/w1/kubelet.crt"}); err != nil {
+		t.Fatalf("Apply() error = %v", err)
+	}
+	if content, err := s.Read("global/ca.crt"); err != nil || string(content) != "new" {
+		t.Errorf("Read() = %q, %v, want the new content", content, err)
+	}
+	if _, err = os.Stat(filepath.Join(root, "nodes")); !os.IsNotExist(err) {
+		t.Errorf("deleted node left behind: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(root, DefaultTxnDir)); !os.IsNotExist(err) {
+		t.Errorf("transaction directory left behind: %v", err)
+	}
+}
+
+func TestStoreFileRecover(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-file")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+	s := NewStoreFile(root)
+	if err = s.WriteBatch(map[string][]byte{"global/ca.crt": []byte("old crt"), "global/old.key": []byte("old")}); err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+	txnDir := filepath.Join(root, DefaultTxnDir)
+	stage := func(files map[string]string) {
+		if err := os.Mkdir(txnDir, 0700); err != nil {
+			t.Fatalf("Mkdir() error = %v", err)
+		}
+		for name, content := range files {
+			if err := ioutil.WriteFile(filepath.Join(txnDir, name), []byte(content), 0600); err != nil {
+				t.Fatalf("WriteFile() error = %v", err)
+			}
+		}
+	}
+
+	// a crash before the journal was written: nothing happened
+	stage(map[string]string{"0": "new crt"})
+	release, err := s.Lock("test", time.Second)
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	_ = release()
+	if content, _ := s.Read("global/ca.crt"); string(content) != "old crt" {
+		t.Errorf("Read() = %q after an uncommitted batch, want the old content", content)
+	}
+	if _, err = os.Stat(txnDir); !os.IsNotExist(err) {
+		t.Errorf("uncommitted batch left behind: %v", err)
+	}
+
+	// a crash after the first rename of a committed batch: the rest is applied
+	stage(map[string]string{
+		"1":         "new key",
+		journalFile: `{"writes":{"0":"global/ca.crt","1":"global/ca.key"},"deletes":["global/old.key"]}`,
+	})
+	if err = ioutil.WriteFile(filepath.Join(root, "global/ca.crt"), []byte("new crt"), 0644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	release, err = s.Lock("test", time.Second)
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+	_ = release()
+	if files, _ := s.List("global"); !reflect.DeepEqual(files, []string{"global/ca.crt", "global/ca.key"}) {
+		t.Errorf("List() after recovery = %v", files)
+	}
+	for name, want := range map[string]string{"global/ca.crt": "new crt", "global/ca.key": "new key"} {
+		if content, err := s.Read(name); err != nil || string(content) != want {
+			t.Errorf("Read(%q) = %q, %v, want %q", name, content, err, want)
+		}
+	}
+	if _, err = os.Stat(txnDir); !os.IsNotExist(err) {
+		t.Errorf("journal left behind: %v", err)
+	}
+}
+
+func TestStoreFileLock(t *testing.T) {
+	root, err := ioutil.TempDir("", "genkubessl-file")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	s := NewStoreFile(root)
+	release, err := s.Lock("first holder", time.Second)
+	if err != nil {
+		t.Fatalf("Lock() error = %v", err)
+	}
+
+	_, err = NewStoreFile(root).Lock("second holder", 200*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "first holder") {
+		t.Errorf("Lock() on locked storage error = %v, want it to name the holder", err)
+	}
+
+	if err = release(); err != nil {
+		t.Fatalf("release() error = %v", err)
+	}
+	release, err = NewStoreFile(root).Lock("second holder", time.Second)
+	if err != nil {
+		t.Fatalf("Lock() after release error = %v", err)
+	}
+	_ = release()
+}
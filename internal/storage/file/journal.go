@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+const (
+	// DefaultTxnDir is created in RootPath and holds the files of a batch until all of them are applied
+	DefaultTxnDir = ".genkubessl.txn"
+
+	journalFile = "journal.json"
+)
+
+// journal is what a batch does once every file of it is staged. Once written it is applied in full,
+// again after a crash if need be.
+type journal struct {
+	// Writes maps staged files, relative to the transaction directory, to their destination
+	Writes  map[string]string `json:"writes"`
+	Deletes []string          `json:"deletes"`
+}
+
+// Apply writes and deletes files as a single change. Every file is first written and fsync-ed in the
+// transaction directory, then the journal listing the batch is written: this is the point the batch is
+// committed at, before it nothing was changed. The journal is applied next and removed once done.
+// A crash while applying it leaves the journal behind, Lock and Apply complete it before anything else.
+func (s *StoreFile) Apply(writes map[string][]byte, deletes []string) (err error) {
+	err = s.makeDir(s.RootPath, s.MakeRoot, s.RootDirMode)
+	if err != nil {
+		return err
+	}
+	if err = s.Recover(); err != nil {
+		return err
+	}
+	txnDir := filepath.Join(s.RootPath, s.TxnDir)
+	if err = os.Mkdir(txnDir, 0700); err != nil {
+		return fmt.Errorf("cannot create transaction directory: %s: %v", txnDir, err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			_ = os.RemoveAll(txnDir)
+		}
+	}()
+
+	names := make([]string, 0, len(writes))
+	for filePath := range writes {
+		names = append(names, filePath)
+	}
+	sort.Strings(names)
+
+	j := journal{Writes: make(map[string]string), Deletes: deletes}
+	for idx, filePath := range names {
+		fileFullPath := filepath.Join(s.RootPath, filePath)
+		err = s.makeDir(filepath.Dir(fileFullPath), s.MakeDirs, s.DirMode)
+		if err != nil {
+			return err
+		}
+		staged := strconv.Itoa(idx)
+		err = s.writeFile(filepath.Join(txnDir, staged), writes[filePath], s.fileMode(filePath))
+		if err != nil {
+			return fmt.Errorf("cannot write file: %s: %v", fileFullPath, err)
+		}
+		j.Writes[staged] = filePath
+	}
+	content, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	journalPath := filepath.Join(txnDir, journalFile)
+	if err = s.writeFile(journalPath+".tmp", content, 0600); err != nil {
+		return fmt.Errorf("cannot write journal: %s: %v", journalPath, err)
+	}
+	if err = os.Rename(journalPath+".tmp", journalPath); err != nil {
+		return fmt.Errorf("cannot write journal: %s: %v", journalPath, err)
+	}
+	if err = syncDir(txnDir); err != nil {
+		return err
+	}
+	committed = true
+	return s.replay(j)
+}
+
+// Recover completes the batch a crash interrupted, if any. A batch that did not get as far as its
+// journal is dropped: none of its files were applied.
+func (s *StoreFile) Recover() (err error) {
+	txnDir := filepath.Join(s.RootPath, s.TxnDir)
+	content, err := ioutil.ReadFile(filepath.Join(txnDir, journalFile))
+	if os.IsNotExist(err) {
+		if err = os.RemoveAll(txnDir); err != nil {
+			return fmt.Errorf("cannot remove unfinished batch: %s: %v", txnDir, err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read journal: %s: %v", txnDir, err)
+	}
+	var j journal
+	if err = json.Unmarshal(content, &j); err != nil {
+		return fmt.Errorf("invalid journal: %s: %v", txnDir, err)
+	}
+	if err = s.replay(j); err != nil {
+		return fmt.Errorf("cannot complete interrupted batch: %v", err)
+	}
+	return nil
+}
+
+// replay applies a journal. Steps already done before a crash are skipped: staged files that are gone
+// were renamed into place and files that are gone were deleted.
+func (s *StoreFile) replay(j journal) (err error) {
+	txnDir := filepath.Join(s.RootPath, s.TxnDir)
+	staged := make([]string, 0, len(j.Writes))
+	for name := range j.Writes {
+		staged = append(staged, name)
+	}
+	sort.Strings(staged)
+
+	dirs := make(map[string]struct{})
+	for _, name := range staged {
+		fileFullPath := filepath.Join(s.RootPath, j.Writes[name])
+		err = os.Rename(filepath.Join(txnDir, name), fileFullPath)
+		if os.IsNotExist(err) {
+			if _, statErr := os.Stat(fileFullPath); statErr == nil {
+				continue
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write file: %s: %v", fileFullPath, err)
+		}
+		dirs[filepath.Dir(fileFullPath)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err = syncDir(dir); err != nil {
+			return err
+		}
+	}
+	for _, filePath := range j.Deletes {
+		if err = s.Delete(filePath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err = os.RemoveAll(txnDir); err != nil {
+		return fmt.Errorf("cannot remove transaction directory: %s: %v", txnDir, err)
+	}
+	return syncDir(s.RootPath)
+}
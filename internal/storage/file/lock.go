@@ -0,0 +1,76 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package file
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// DefaultLockFile is created in RootPath and holds the description of the current lock holder
+	DefaultLockFile = ".genkubessl.lock"
+
+	lockPollInterval = 100 * time.Millisecond
+)
+
+// Lock takes an exclusive lock on the whole storage, waiting at most timeout for it.
+// owner is recorded in the lock file so that a process that times out can tell who holds it.
+func (s *StoreFile) Lock(owner string, timeout time.Duration) (release func() error, err error) {
+	err = s.makeDir(s.RootPath, s.MakeRoot, s.RootDirMode)
+	if err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(s.RootPath, s.LockFile)
+	err = s.makeDir(filepath.Dir(lockPath), s.MakeDirs, s.DirMode)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		f, locked, err := tryLock(lockPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot lock storage: %s: %v", lockPath, err)
+		}
+		if locked {
+			if err = f.Truncate(0); err == nil {
+				_, err = f.WriteAt([]byte(owner+"\n"), 0)
+			}
+			if err != nil {
+				_ = unlock(f, lockPath)
+				return nil, fmt.Errorf("cannot lock storage: %s: %v", lockPath, err)
+			}
+			// a run interrupted by a crash is completed before the next one looks at the storage
+			if err = s.Recover(); err != nil {
+				_ = unlock(f, lockPath)
+				return nil, err
+			}
+			return func() error { return unlock(f, lockPath) }, nil
+		}
+		if time.Now().After(deadline) {
+			holder, _ := ioutil.ReadFile(lockPath)
+			return nil, fmt.Errorf("storage %s is locked by %q: gave up after %v",
+				s.RootPath, string(bytes.TrimSpace(holder)), timeout)
+		}
+		time.Sleep(lockPollInterval)
+	}
+}
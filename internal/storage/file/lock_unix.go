@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package file
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLock takes an exclusive flock on the lock file without blocking.
+// The kernel drops the lock when the process dies so a crashed run never leaves it behind.
+func tryLock(lockPath string) (f *os.File, locked bool, err error) {
+	f, err = os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, false, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, false, nil
+	}
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func unlock(f *os.File, lockPath string) error {
+	// the file itself stays, removing it would race with a waiting process
+	// that already has it open
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_UN); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,43 @@
+//go:build windows
+// +build windows
+
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package file
+
+import (
+	"os"
+)
+
+// tryLock creates the lock file exclusively. Unlike flock the lock survives a crash,
+// in which case the lock file has to be removed by hand.
+func tryLock(lockPath string) (f *os.File, locked bool, err error) {
+	f, err = os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+	if os.IsExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+func unlock(f *os.File, lockPath string) error {
+	f.Close()
+	return os.Remove(lockPath)
+}
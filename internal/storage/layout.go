@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// storage related // hardcoded for now
+	GlobalPath = "global"
+	NodesPath  = "nodes"
+)
+
+// StoredFile is a file of the global area (Node "") or of a node
+type StoredFile struct {
+	Node string
+	// Path within the area, "/etc/kubernetes/pki/ca.crt"
+	Path string
+	// StoragePath is the path in storage, "global/etc/kubernetes/pki/ca.crt"
+	StoragePath string
+}
+
+// SplitPath returns the node a storage path belongs to (empty for the global area) and the path within
+// the area. ok is false for paths outside of both areas.
+func SplitPath(storagePath string) (node string, filePath string, ok bool) {
+	parts := strings.SplitN(storagePath, "/", 3)
+	switch {
+	case parts[0] == GlobalPath && len(parts) > 1:
+		return "", "/" + strings.Join(parts[1:], "/"), true
+	case parts[0] == NodesPath && len(parts) == 3:
+		return parts[1], "/" + parts[2], true
+	}
+	return "", "", false
+}
+
+// ListFiles returns every file in the global and nodes areas, sorted by storage path
+func ListFiles(drv StoreDrv) (files []StoredFile, err error) {
+	for _, area := range []string{GlobalPath, NodesPath} {
+		stored, err := drv.List(area)
+		if err != nil {
+			return nil, err
+		}
+		for _, storagePath := range stored {
+			node, filePath, ok := SplitPath(storagePath)
+			if !ok {
+				continue
+			}
+			files = append(files, StoredFile{Node: node, Path: filePath, StoragePath: storagePath})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].StoragePath < files[j].StoragePath })
+	return files, nil
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListFiles(t *testing.T) {
+	store := newMemStore()
+	for _, filePath := range []string{
+		"nodes/m1/etc/kubernetes/pki/apiserver.crt",
+		"global/etc/kubernetes/pki/ca.crt",
+		"history/1/meta.json",
+		"manifest.json",
+		"nodes/stray",
+	} {
+		_ = store.Write(filePath, []byte("content"))
+	}
+	files, err := ListFiles(store)
+	if err != nil {
+		t.Fatalf("ListFiles() error = %v", err)
+	}
+	want := []StoredFile{
+		{Path: "/etc/kubernetes/pki/ca.crt", StoragePath: "global/etc/kubernetes/pki/ca.crt"},
+		{Node: "m1", Path: "/etc/kubernetes/pki/apiserver.crt", StoragePath: "nodes/m1/etc/kubernetes/pki/apiserver.crt"},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("ListFiles() = %+v, want %+v", files, want)
+	}
+	if _, _, ok := SplitPath("archive/20200101/nodes/m1/etc/kubernetes/pki/apiserver.crt"); ok {
+		t.Errorf("SplitPath() accepted a path outside of the global and nodes areas")
+	}
+}
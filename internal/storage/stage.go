@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StoreStage wraps another driver and keeps every change in memory until Commit is called.
+// Reads see the staged changes. This allows a whole run to either land in full or not at all.
+type StoreStage struct {
+	StoreDrv
+
+	writes  map[string][]byte
+	deletes map[string]struct{}
+}
+
+func NewStoreStage(backend StoreDrv) *StoreStage {
+	return &StoreStage{
+		StoreDrv: backend,
+		writes:   make(map[string][]byte),
+		deletes:  make(map[string]struct{}),
+	}
+}
+
+func (s *StoreStage) Write(filePath string, content []byte) (err error) {
+	delete(s.deletes, filePath)
+	s.writes[filePath] = append([]byte{}, content...)
+	return nil
+}
+
+func (s *StoreStage) WriteBatch(files map[string][]byte) (err error) {
+	for filePath, content := range files {
+		_ = s.Write(filePath, content)
+	}
+	return nil
+}
+
+func (s *StoreStage) Read(filePath string) (content []byte, err error) {
+	if content, ok := s.writes[filePath]; ok {
+		return append([]byte{}, content...), nil
+	}
+	if _, ok := s.deletes[filePath]; ok {
+		return nil, fmt.Errorf("cannot read file: %s: %w", filePath, os.ErrNotExist)
+	}
+	return s.StoreDrv.Read(filePath)
+}
+
+func (s *StoreStage) Delete(filePath string) (err error) {
+	exists, err := s.Exists(filePath)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("cannot delete file: %s: %w", filePath, os.ErrNotExist)
+	}
+	delete(s.writes, filePath)
+	s.deletes[filePath] = struct{}{}
+	return nil
+}
+
+func (s *StoreStage) Exists(filePath string) (exists bool, err error) {
+	if _, ok := s.writes[filePath]; ok {
+		return true, nil
+	}
+	if _, ok := s.deletes[filePath]; ok {
+		return false, nil
+	}
+	return s.StoreDrv.Exists(filePath)
+}
+
+func (s *StoreStage) Stat(filePath string) (info os.FileInfo, err error) {
+	if content, ok := s.writes[filePath]; ok {
+		return stagedFileInfo{name: path.Base(filePath), size: int64(len(content))}, nil
+	}
+	if _, ok := s.deletes[filePath]; ok {
+		return nil, fmt.Errorf("cannot stat file: %s: %w", filePath, os.ErrNotExist)
+	}
+	return s.StoreDrv.Stat(filePath)
+}
+
+func (s *StoreStage) List(dirPath string) (files []string, err error) {
+	stored, err := s.StoreDrv.List(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	for _, filePath := range stored {
+		_, deleted := s.deletes[filePath]
+		_, written := s.writes[filePath]
+		if !deleted && !written {
+			files = append(files, filePath)
+		}
+	}
+	prefix := ""
+	if dir := path.Clean(dirPath); dir != "." {
+		prefix = dir + "/"
+	}
+	for filePath := range s.writes {
+		if strings.HasPrefix(filePath, prefix) {
+			files = append(files, filePath)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Pending reports whether there is anything left to commit.
+func (s *StoreStage) Pending() bool {
+	return len(s.writes) > 0 || len(s.deletes) > 0
+}
+
+// Apply stages the writes and deletions, they reach the backend on Commit.
+func (s *StoreStage) Apply(writes map[string][]byte, deletes []string) (err error) {
+	for _, filePath := range deletes {
+		if err = s.Delete(filePath); err != nil {
+			return err
+		}
+	}
+	return s.WriteBatch(writes)
+}
+
+// Commit hands every staged write and deletion to the backend as a single batch.
+func (s *StoreStage) Commit() (err error) {
+	if !s.Pending() {
+		return nil
+	}
+	deletes := make([]string, 0, len(s.deletes))
+	for filePath := range s.deletes {
+		deletes = append(deletes, filePath)
+	}
+	sort.Strings(deletes)
+	if err = s.StoreDrv.Apply(s.writes, deletes); err != nil {
+		return err
+	}
+	s.Discard()
+	return nil
+}
+
+// Discard drops everything staged so far.
+func (s *StoreStage) Discard() {
+	s.writes = make(map[string][]byte)
+	s.deletes = make(map[string]struct{})
+}
+
+type stagedFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi stagedFileInfo) Name() string       { return fi.name }
+func (fi stagedFileInfo) Size() int64        { return fi.size }
+func (fi stagedFileInfo) Mode() os.FileMode  { return 0600 }
+func (fi stagedFileInfo) ModTime() time.Time { return time.Now() }
+func (fi stagedFileInfo) IsDir() bool        { return false }
+func (fi stagedFileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,67 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStoreStage(t *testing.T) {
+	mem := newMemStore()
+	mem.files["global/old.crt"] = []byte("old")
+	mem.files["global/gone.crt"] = []byte("gone")
+
+	stage := NewStoreStage(mem)
+	_ = stage.WriteBatch(map[string][]byte{"global/new.crt": []byte("new"), "global/new.key": []byte("key")})
+	_ = stage.Write("global/old.crt", []byte("replaced"))
+	if err := stage.Delete("global/gone.crt"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := stage.Delete("global/missing.crt"); !IsNotExist(err) {
+		t.Errorf("Delete() of missing file error = %v, want not exist", err)
+	}
+
+	if len(mem.files) != 2 || string(mem.files["global/old.crt"]) != "old" {
+		t.Fatalf("backend modified before Commit(): %v", mem.files)
+	}
+	if content, err := stage.Read("global/old.crt"); err != nil || string(content) != "replaced" {
+		t.Errorf("Read() = %q, %v, want staged content", content, err)
+	}
+	if _, err := stage.Read("global/gone.crt"); !IsNotExist(err) {
+		t.Errorf("Read() of staged deletion error = %v, want not exist", err)
+	}
+	files, _ := stage.List("global")
+	if want := []string{"global/new.crt", "global/new.key", "global/old.crt"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("List() = %v, want %v", files, want)
+	}
+
+	if err := stage.Commit(); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if stage.Pending() {
+		t.Errorf("Pending() after Commit() = true")
+	}
+	files, _ = mem.List("global")
+	if want := []string{"global/new.crt", "global/new.key", "global/old.crt"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("backend after Commit() = %v, want %v", files, want)
+	}
+	if string(mem.files["global/old.crt"]) != "replaced" {
+		t.Errorf("backend content after Commit() = %q", mem.files["global/old.crt"])
+	}
+}
@@ -18,29 +18,113 @@
 package storage
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/stefan-kiss/genkubessl/internal/storage/file"
-	"log"
+	"io/ioutil"
 	"net/url"
+	"os"
+	"time"
 )
 
 type StoreDrv interface {
 	Write(filePath string, cert []byte) (err error)
 	Read(filePath string) (cert []byte, err error)
-	SetConfigValue(key string, value string)
+	// WriteBatch writes several files at once, as Apply does
+	WriteBatch(files map[string][]byte) (err error)
+	// Apply writes and deletes files as a single change: either all of it lands or none of it does,
+	// a crash included (the file driver completes an interrupted batch the next time it is locked)
+	Apply(writes map[string][]byte, deletes []string) (err error)
+	// List returns all files stored under dirPath, recursively, relative to the storage root
+	List(dirPath string) (files []string, err error)
+	Exists(filePath string) (exists bool, err error)
+	Stat(filePath string) (info os.FileInfo, err error)
+	Delete(filePath string) (err error)
+	// Lock takes an exclusive lock on the whole storage (flock for files, a lease for
+	// remote backends), waiting at most timeout. The returned function releases it.
+	Lock(owner string, timeout time.Duration) (release func() error, err error)
+	SetConfigValue(key string, value string) (err error)
 	LoadConfig(filepath string) (err error)
 }
 
+// IsNotExist reports whether err is caused by a missing file, as opposed to
+// one that exists but could not be read. Drivers must wrap os.ErrNotExist.
+func IsNotExist(err error) bool {
+	return errors.Is(err, os.ErrNotExist)
+}
+
+// ReadFailure describes why `what` could not be read, telling a missing file apart from one we could not read.
+// Used as the reason a file gets written.
+func ReadFailure(what string, err error) string {
+	if IsNotExist(err) {
+		return what + " missing"
+	}
+	return fmt.Sprintf("error loading %s: %v", what, err)
+}
+
 func GetStorage(storageURL string) (storage StoreDrv, err error) {
 
 	parsedURL, err := url.Parse(storageURL)
 	if err != nil {
-		log.Fatalf("unable to parse url: %v error:", err)
+		return nil, fmt.Errorf("unable to parse url: %v", err)
 	}
 	switch parsedURL.Scheme {
 	case "", "file":
-		return file.NewStoreFile(parsedURL.Path), nil
+		storage = file.NewStoreFile(parsedURL.Path)
 	default:
 		return nil, fmt.Errorf("unknown storage: %q", storageURL)
 	}
+
+	query := parsedURL.Query()
+	if err = configure(storage, query); err != nil {
+		return nil, err
+	}
+	return withEncryption(storage, query)
+}
+
+// configure loads the driver config file given as config=<path> (if any)
+// and then applies the remaining query parameters as driver options.
+func configure(storage StoreDrv, query url.Values) (err error) {
+	if configFile := query.Get("config"); configFile != "" {
+		if err = storage.LoadConfig(configFile); err != nil {
+			return err
+		}
+	}
+	for key, values := range query {
+		switch key {
+		case "config", "keyfile", "passenv":
+			continue
+		}
+		for _, value := range values {
+			if err = storage.SetConfigValue(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// withEncryption wraps the driver in a StoreCrypt when the url asks for it
+// either through a key file (keyfile=/path) or an environment variable
+// holding the passphrase (passenv=NAME).
+func withEncryption(storage StoreDrv, query url.Values) (StoreDrv, error) {
+	var passphrase []byte
+
+	switch {
+	case query.Get("keyfile") != "":
+		content, err := ioutil.ReadFile(query.Get("keyfile"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to read encryption key file: %v", err)
+		}
+		passphrase = bytes.TrimSpace(content)
+	case query.Get("passenv") != "":
+		passphrase = []byte(os.Getenv(query.Get("passenv")))
+	default:
+		return storage, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("encryption requested but passphrase is empty")
+	}
+	return NewStoreCrypt(storage, passphrase), nil
 }
@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package storage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memStore is an in memory StoreDrv used to test the driver wrappers.
+type memStore struct {
+	files map[string][]byte
+}
+
+func newMemStore() *memStore {
+	return &memStore{files: make(map[string][]byte)}
+}
+
+func (m *memStore) Write(filePath string, content []byte) (err error) {
+	m.files[filePath] = append([]byte{}, content...)
+	return nil
+}
+
+func (m *memStore) Read(filePath string) (content []byte, err error) {
+	content, ok := m.files[filePath]
+	if !ok {
+		return nil, fmt.Errorf("cannot read file: %s: %w", filePath, os.ErrNotExist)
+	}
+	return content, nil
+}
+
+func (m *memStore) WriteBatch(files map[string][]byte) (err error) {
+	for filePath, content := range files {
+		m.files[filePath] = append([]byte{}, content...)
+	}
+	return nil
+}
+
+func (m *memStore) Apply(writes map[string][]byte, deletes []string) (err error) {
+	for _, filePath := range deletes {
+		delete(m.files, filePath)
+	}
+	return m.WriteBatch(writes)
+}
+
+func (m *memStore) List(dirPath string) (files []string, err error) {
+	for name := range m.files {
+		if strings.HasPrefix(name, dirPath) {
+			files = append(files, name)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+func (m *memStore) Exists(filePath string) (exists bool, err error) {
+	_, exists = m.files[filePath]
+	return exists, nil
+}
+
+func (m *memStore) Stat(filePath string) (info os.FileInfo, err error) {
+	content, ok := m.files[filePath]
+	if !ok {
+		return nil, fmt.Errorf("cannot stat file: %s: %w", filePath, os.ErrNotExist)
+	}
+	return stagedFileInfo{name: filePath, size: int64(len(content))}, nil
+}
+
+func (m *memStore) Delete(filePath string) (err error) {
+	if _, ok := m.files[filePath]; !ok {
+		return fmt.Errorf("cannot delete file: %s: %w", filePath, os.ErrNotExist)
+	}
+	delete(m.files, filePath)
+	return nil
+}
+
+func (m *memStore) Lock(owner string, timeout time.Duration) (release func() error, err error) {
+	return func() error { return nil }, nil
+}
+
+func (m *memStore) SetConfigValue(key string, value string) (err error) { return nil }
+
+func (m *memStore) LoadConfig(filepath string) (err error) { return nil }
+
+func TestReadFailure(t *testing.T) {
+	store := newMemStore()
+	_, err := store.Read("global/ca.key")
+	if got := ReadFailure("private key", err); got != "private key missing" {
+		t.Errorf("ReadFailure() = %q, want %q", got, "private key missing")
+	}
+	err = fmt.Errorf("cannot read file: %s: %w", "global/ca.key", os.ErrPermission)
+	if got := ReadFailure("private key", err); !strings.HasPrefix(got, "error loading private key: ") {
+		t.Errorf("ReadFailure() = %q, want the read error", got)
+	}
+}
+
+func TestGetStorage(t *testing.T) {
+	tests := map[string]bool{
+		"/tmp/genkubessl":        false,
+		"file:///tmp/genkubessl": false,
+		"s3://bucket/path":       true,
+		"file://%zz/genkubessl":  true,
+	}
+	for storageURL, wantErr := range tests {
+		if _, err := GetStorage(storageURL); (err != nil) != wantErr {
+			t.Errorf("GetStorage(%q) error = %v, wantErr %v", storageURL, err, wantErr)
+		}
+	}
+}
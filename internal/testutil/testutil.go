@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+// Package testutil holds the fixtures shared by the tests of several packages. Only tests import it.
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Pair is a cert along with its private key
+type Pair struct {
+	Crt *x509.Certificate
+	Key interface{}
+}
+
+// TempStore returns a file storage rooted in a new temporary directory and the function removing it
+func TempStore(t *testing.T) (drv *file.StoreFile, cleanup func()) {
+	t.Helper()
+	root, err := ioutil.TempDir("", "genkubessl-test")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	return file.NewStoreFile(root), func() { _ = os.RemoveAll(root) }
+}
+
+// NewCA creates a self signed CA
+func NewCA(t *testing.T, cn string) Pair {
+	t.Helper()
+	crt, key, err := sslutil.SelfSignedCaKey(sslutil.CertConf{CommonName: cn}, nil)
+	if err != nil {
+		t.Fatalf("SelfSignedCaKey() error = %v", err)
+	}
+	return Pair{crt, key}
+}
+
+// Issue creates a cert signed by ca
+func Issue(t *testing.T, ca Pair, cn string, sans []string, usages ...x509.ExtKeyUsage) Pair {
+	t.Helper()
+	cfg := sslutil.NewCertConfig(0, cn, nil, sans)
+	cfg.Usages = usages
+	crt, key, err := sslutil.SelfSignedCertKey(*cfg, ca.Crt, ca.Key, nil)
+	if err != nil {
+		t.Fatalf("SelfSignedCertKey() error = %v", err)
+	}
+	return Pair{crt, key}
+}
+
+// Store writes the cert and key of p as filePath.crt and filePath.key
+func Store(t *testing.T, drv storage.StoreDrv, filePath string, p Pair) {
+	t.Helper()
+	keyPEM, err := sslutil.MarshalPrivateKeyToPEM(p.Key)
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyToPEM() error = %v", err)
+	}
+	err = drv.WriteBatch(map[string][]byte{
+		filePath + ".crt": sslutil.EncodeCertPEM(p.Crt),
+		filePath + ".key": keyPEM,
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+}
+
+// Load reads back what Store wrote
+func Load(t *testing.T, drv storage.StoreDrv, filePath string) Pair {
+	t.Helper()
+	certPEM, err := drv.Read(filePath + ".crt")
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	keyPEM, err := drv.Read(filePath + ".key")
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	crt, key, err := sslutil.LoadCrtAndKeyFromPEM(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("LoadCrtAndKeyFromPEM() error = %v", err)
+	}
+	return Pair{crt, key}
+}
+
+// StoreSA writes key as the service account signing key and the public part of pubKey as the only
+// public key, two different keys make a mismatching pair
+func StoreSA(t *testing.T, drv storage.StoreDrv, key interface{}, pubKey interface{}) {
+	t.Helper()
+	keyPEM, err := sslutil.MarshalPrivateKeyToPEM(key)
+	if err != nil {
+		t.Fatalf("MarshalPrivateKeyToPEM() error = %v", err)
+	}
+	pubPEM, err := sslutil.EncodePublicKeyPEM(sslutil.PublicKey(pubKey))
+	if err != nil {
+		t.Fatalf("EncodePublicKeyPEM() error = %v", err)
+	}
+	err = drv.WriteBatch(map[string][]byte{
+		"global/etc/kubernetes/pki/sa.key": keyPEM,
+		"global/etc/kubernetes/pki/sa.pub": pubPEM,
+	})
+	if err != nil {
+		t.Fatalf("WriteBatch() error = %v", err)
+	}
+}
+
+// WithoutUsages reissues p, signed by ca, without any extended key usage: the way genkubessl
+// issued certs before it set them.
+func WithoutUsages(t *testing.T, ca Pair, p Pair) Pair {
+	t.Helper()
+	template := *p.Crt
+	template.ExtKeyUsage = nil
+	der, err := x509.CreateCertificate(rand.Reader, &template, ca.Crt, sslutil.PublicKey(p.Key), ca.Key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	return Pair{crt, p.Key}
+}
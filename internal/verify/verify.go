@@ -0,0 +1,315 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package verify
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/kubekeys"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/webhookcerts"
+	"k8s.io/client-go/util/cert"
+	"path"
+	"strings"
+	"time"
+)
+
+// VerifyConfig controls what verify expects to find
+type VerifyConfig struct {
+	// Templates declares extra certificates, as given to kubecerts
+	Templates []kubecerts.CertTemplateConfig
+	// MinValid reports certificates expiring sooner than that
+	MinValid time.Duration
+}
+
+// Finding is a single problem found in storage
+type Finding struct {
+	Node    string
+	Path    string
+	Problem string
+}
+
+type auditor struct {
+	drv      storage.StoreDrv
+	cfg      VerifyConfig
+	now      time.Time
+	findings []Finding
+	// CA's found in the global area by path without extension
+	cas map[string]*x509.Certificate
+}
+
+func (a *auditor) fail(node string, filePath string, format string, args ...interface{}) {
+	problem := fmt.Sprintf(format, args...)
+	fmt.Printf("VERIFY FAIL: [%-30s] [%-50s] => %q\n", node, filePath, problem)
+	a.findings = append(a.findings, Finding{Node: node, Path: filePath, Problem: problem})
+}
+
+func (a *auditor) readCert(file storage.StoredFile) (crt *x509.Certificate, ok bool) {
+	content, err := a.drv.Read(file.StoragePath)
+	if err != nil {
+		a.fail(file.Node, file.Path, "cannot read certificate: %v", err)
+		return nil, false
+	}
+	certs, err := cert.ParseCertsPEM(content)
+	if err != nil {
+		a.fail(file.Node, file.Path, "invalid certificate: %v", err)
+		return nil, false
+	}
+	if len(certs) != 1 {
+		a.fail(file.Node, file.Path, "%d certificates found, expected one", len(certs))
+		return nil, false
+	}
+	return certs[0], true
+}
+
+func (a *auditor) checkKey(file storage.StoredFile, crt *x509.Certificate) {
+	keyPath := strings.TrimSuffix(file.StoragePath, ".crt") + ".key"
+	content, err := a.drv.Read(keyPath)
+	if err != nil {
+		a.fail(file.Node, file.Path, "cannot read private key: %v", err)
+		return
+	}
+	key, err := sslutil.ParsePrivateKeyPEM(content)
+	if err != nil {
+		a.fail(file.Node, file.Path, "invalid private key: %v", err)
+		return
+	}
+	if err = sslutil.KeyMatchesCrt(crt, key); err != nil {
+		a.fail(file.Node, file.Path, "%v", err)
+	}
+}
+
+// checkExpiry returns the time to verify the chain at: now, or the last second
+// an expired cert was valid so the chain gets checked regardless
+func (a *auditor) checkExpiry(file storage.StoredFile, crt *x509.Certificate) (at time.Time) {
+	switch {
+	case a.now.After(crt.NotAfter):
+		a.fail(file.Node, file.Path, "expired on %s", crt.NotAfter.UTC().Format(time.RFC3339))
+		return crt.NotAfter.Add(-time.Second)
+	case a.now.Before(crt.NotBefore):
+		a.fail(file.Node, file.Path, "not valid before %s", crt.NotBefore.UTC().Format(time.RFC3339))
+		return crt.NotBefore.Add(time.Second)
+	case a.now.Add(a.cfg.MinValid).After(crt.NotAfter):
+		a.fail(file.Node, file.Path, "expires on %s, in less than %s", crt.NotAfter.UTC().Format(time.RFC3339), a.cfg.MinValid)
+	}
+	return a.now
+}
+
+func (a *auditor) checkCA(file storage.StoredFile, crt *x509.Certificate) {
+	if err := crt.CheckSignatureFrom(crt); err != nil {
+		a.fail(file.Node, file.Path, "CA is not self signed: %v", err)
+	}
+}
+
+// checkChain verifies crt against the CA it is expected to be signed by with the usages it is expected to have.
+// Certs no template is known for are verified against every CA found.
+func (a *auditor) checkChain(file storage.StoredFile, crt *x509.Certificate, at time.Time) {
+	tplPath := strings.TrimSuffix(file.Path, ".crt")
+	parent, usages, known := kubecerts.ExpectedIssuer(tplPath)
+	if !known && strings.HasPrefix(tplPath, webhookcerts.WebhooksPath+"/") && path.Base(tplPath) == "tls" {
+		usages = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+
+	roots := x509.NewCertPool()
+	if known {
+		ca, ok := a.cas[parent]
+		if !ok {
+			a.fail(file.Node, file.Path, "CA %q is missing", parent)
+			return
+		}
+		roots.AddCert(ca)
+	} else {
+		for _, ca := range a.cas {
+			roots.AddCert(ca)
+		}
+	}
+
+	keyUsages := usages
+	if len(keyUsages) == 0 {
+		keyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	}
+	_, err := crt.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: at, KeyUsages: keyUsages})
+	if err != nil {
+		if known {
+			a.fail(file.Node, file.Path, "does not verify against CA %q: %v", parent, err)
+		} else {
+			a.fail(file.Node, file.Path, "does not verify against any CA: %v", err)
+		}
+		return
+	}
+	for _, usage := range usages {
+		if !hasUsage(crt, usage) {
+			a.fail(file.Node, file.Path, "missing extended key usage %s", usageName(usage))
+		}
+	}
+}
+
+func hasUsage(crt *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range crt.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
+
+func usageName(usage x509.ExtKeyUsage) string {
+	switch usage {
+	case x509.ExtKeyUsageServerAuth:
+		return "server auth"
+	case x509.ExtKeyUsageClientAuth:
+		return "client auth"
+	default:
+		return fmt.Sprintf("%d", usage)
+	}
+}
+
+// checkShared compares node copies of global files with the global ones
+func (a *auditor) checkShared(files []storage.StoredFile) {
+	global := make(map[string]string)
+	for _, file := range files {
+		if file.Node == "" {
+			global[file.Path] = file.StoragePath
+		}
+	}
+	for _, file := range files {
+		globalPath, ok := global[file.Path]
+		if file.Node == "" || !ok {
+			continue
+		}
+		nodeContent, err := a.drv.Read(file.StoragePath)
+		if err != nil {
+			a.fail(file.Node, file.Path, "cannot read file: %v", err)
+			continue
+		}
+		globalContent, err := a.drv.Read(globalPath)
+		if err != nil {
+			a.fail("", file.Path, "cannot read file: %v", err)
+			continue
+		}
+		if !bytes.Equal(nodeContent, globalContent) {
+			a.fail(file.Node, file.Path, "differs from the global copy")
+		}
+	}
+}
+
+// checkSealed reports the files an encrypted storage keeps in clear, they stay so until rewritten
+func (a *auditor) checkSealed(files []storage.StoredFile) {
+	crypt, ok := a.drv.(*storage.StoreCrypt)
+	if !ok {
+		return
+	}
+	for _, file := range files {
+		unsealed, err := crypt.Unsealed(file.StoragePath)
+		if err != nil {
+			a.fail(file.Node, file.Path, "cannot read file: %v", err)
+			continue
+		}
+		if unsealed {
+			a.fail(file.Node, file.Path, "stored unencrypted")
+		}
+	}
+}
+
+// checkKeyPairs verifies the service account signing keys
+func (a *auditor) checkKeyPairs() {
+	for _, keyPath := range kubekeys.Paths() {
+		storagePath := path.Join(storage.GlobalPath, keyPath)
+		privPEM, err := a.drv.Read(storagePath + ".key")
+		if err != nil {
+			a.fail("", keyPath+".key", "cannot read private key: %v", err)
+			continue
+		}
+		bundle, err := a.drv.Read(storagePath + ".pub")
+		if err != nil {
+			a.fail("", keyPath+".pub", "cannot read public key: %v", err)
+			continue
+		}
+		if err = kubekeys.CheckPair(privPEM, bundle); err != nil {
+			a.fail("", keyPath, "%v", err)
+			continue
+		}
+		fmt.Printf("VERIFY OK  : [%-30s] [%-50s]\n", "", keyPath)
+	}
+}
+
+// Execute audits every certificate, key and shared file in storage without writing anything.
+// Every problem found is printed and returned, err is only set when the audit itself could not run.
+func Execute(drv storage.StoreDrv, cfg VerifyConfig) (findings []Finding, err error) {
+	if err = kubecerts.AddTemplates(cfg.Templates); err != nil {
+		return nil, err
+	}
+	files, err := storage.ListFiles(drv)
+	if err != nil {
+		return nil, err
+	}
+	a := &auditor{
+		drv: drv,
+		cfg: cfg,
+		now: time.Now(),
+		cas: make(map[string]*x509.Certificate),
+	}
+
+	// node copies of global files are only compared with the global ones
+	global := make(map[string]struct{})
+	for _, file := range files {
+		if file.Node == "" {
+			global[file.Path] = struct{}{}
+		}
+	}
+
+	certs := make(map[string]*x509.Certificate)
+	for _, file := range files {
+		if _, ok := global[file.Path]; path.Ext(file.Path) != ".crt" || (ok && file.Node != "") {
+			continue
+		}
+		crt, ok := a.readCert(file)
+		if !ok {
+			continue
+		}
+		certs[file.StoragePath] = crt
+		if file.Node == "" && crt.IsCA {
+			a.cas[strings.TrimSuffix(file.Path, ".crt")] = crt
+		}
+	}
+
+	for _, file := range files {
+		crt, ok := certs[file.StoragePath]
+		if !ok {
+			continue
+		}
+		before := len(a.findings)
+		a.checkKey(file, crt)
+		at := a.checkExpiry(file, crt)
+		if crt.IsCA {
+			a.checkCA(file, crt)
+		} else {
+			a.checkChain(file, crt, at)
+		}
+		if len(a.findings) == before {
+			fmt.Printf("VERIFY OK  : [%-30s] [%-50s]\n", file.Node, file.Path)
+		}
+	}
+	a.checkShared(files)
+	a.checkKeyPairs()
+	a.checkSealed(files)
+	return a.findings, nil
+}
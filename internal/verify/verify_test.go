@@ -0,0 +1,175 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package verify
+
+import (
+	"crypto/x509"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"github.com/stefan-kiss/genkubessl/internal/testutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// alt names of the certs of m1
+var sans = []string{"m1", "10.0.0.1"}
+
+func TestExecute(t *testing.T) {
+	drv, cleanup := testutil.TempStore(t)
+	defer cleanup()
+
+	ca := testutil.NewCA(t, "kubernetes")
+	testutil.Store(t, drv, "global/etc/kubernetes/pki/ca", ca)
+	apiserver := testutil.Issue(t, ca, "kube-apiserver", sans, x509.ExtKeyUsageServerAuth)
+	testutil.Store(t, drv, "nodes/m1/etc/kubernetes/pki/apiserver", apiserver)
+	client := testutil.Issue(t, ca, "kube-apiserver-kubelet-client", sans, x509.ExtKeyUsageClientAuth)
+	testutil.Store(t, drv, "nodes/m1/etc/kubernetes/pki/apiserver-kubelet-client", client)
+	err := drv.Write("nodes/m1/etc/kubernetes/pki/ca.crt", sslutil.EncodeCertPEM(ca.Crt))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	saKey, _ := sslutil.NewPrivateKey("")
+	testutil.StoreSA(t, drv, saKey, saKey)
+
+	findings, err := Execute(drv, VerifyConfig{MinValid: time.Hour})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if len(findings) != 0 {
+		t.Fatalf("Execute() findings on a sound PKI: %v", findings)
+	}
+
+	// break every single thing verify looks at
+	otherCA := testutil.NewCA(t, "other")
+	wrongUsage := testutil.Issue(t, ca, "kube-apiserver-kubelet-client", sans, x509.ExtKeyUsageServerAuth)
+	testutil.Store(t, drv, "nodes/m1/etc/kubernetes/pki/apiserver-kubelet-client", wrongUsage)
+	foreign := testutil.Issue(t, otherCA, "kube-apiserver", sans, x509.ExtKeyUsageServerAuth)
+	testutil.Store(t, drv, "nodes/m2/etc/kubernetes/pki/apiserver", foreign)
+	testutil.Store(t, drv, "nodes/m3/etc/kubernetes/pki/apiserver", testutil.Pair{Crt: apiserver.Crt, Key: client.Key})
+	if err = drv.Write("nodes/m1/etc/kubernetes/pki/ca.crt", sslutil.EncodeCertPEM(otherCA.Crt)); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	otherSAKey, _ := sslutil.NewPrivateKey("")
+	testutil.StoreSA(t, drv, saKey, otherSAKey)
+
+	findings, err = Execute(drv, VerifyConfig{MinValid: time.Hour})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	var got [][2]string
+	for _, finding := range findings {
+		got = append(got, [2]string{finding.Node, finding.Path})
+	}
+	want := [][2]string{
+		{"m1", "/etc/kubernetes/pki/apiserver-kubelet-client.crt"},
+		{"m2", "/etc/kubernetes/pki/apiserver.crt"},
+		{"m3", "/etc/kubernetes/pki/apiserver.crt"},
+		{"m1", "/etc/kubernetes/pki/ca.crt"},
+		{"", "/etc/kubernetes/pki/sa"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Execute() findings = %v, want them for %v", findings, want)
+	}
+
+	// CA's are valid for ten years, asking for twenty gets them reported
+	findings, _ = Execute(drv, VerifyConfig{MinValid: 20 * sslutil.Duration365d})
+	expiring := 0
+	for _, finding := range findings {
+		if finding.Path == "/etc/kubernetes/pki/ca.crt" && finding.Node == "" {
+			expiring++
+		}
+	}
+	if expiring != 1 {
+		t.Errorf("Execute() did not report the CA expiring: %v", findings)
+	}
+}
+
+func TestExecuteAfterUpgrade(t *testing.T) {
+	defer kubecerts.Reset()
+	drv, cleanup := testutil.TempStore(t)
+	defer cleanup()
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	templates := []kubecerts.CertTemplateConfig{
+		{Path: "/etc/x/a", Parent: "/etc/kubernetes/pki/ca", CommonName: "a", Usages: []string{"server"}},
+	}
+	generate := func(reissueUsages bool) {
+		kubecerts.Reset()
+		kubecerts.ReissueUsages = reissueUsages
+		if err := kubecerts.ExecuteTemplates(cfg, templates); err != nil {
+			t.Fatalf("ExecuteTemplates() error = %v", err)
+		}
+	}
+	audit := func() []Finding {
+		kubecerts.Reset()
+		findings, err := Execute(drv, VerifyConfig{Templates: templates, MinValid: time.Hour})
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		return findings
+	}
+	generate(false)
+	saKey, _ := sslutil.NewPrivateKey("")
+	testutil.StoreSA(t, drv, saKey, saKey)
+
+	// as issued by versions setting no extended key usage
+	ca := testutil.Load(t, drv, "global/etc/kubernetes/pki/ca")
+	testutil.Store(t, drv, "global/etc/x/a", testutil.WithoutUsages(t, ca, testutil.Load(t, drv, "global/etc/x/a")))
+	findings := audit()
+	if len(findings) != 1 || findings[0].Problem != "missing extended key usage server auth" {
+		t.Fatalf("Execute() findings = %v, want the missing usage reported", findings)
+	}
+
+	// kubecerts leaves it alone unless asked to reissue it, which clears the finding
+	generate(false)
+	if findings = audit(); len(findings) != 1 {
+		t.Fatalf("Execute() findings after kubecerts = %v, want the missing usage still reported", findings)
+	}
+	generate(true)
+	if findings = audit(); len(findings) != 0 {
+		t.Errorf("Execute() findings after kubecerts = %v, want none", findings)
+	}
+}
+
+func TestExecuteUnsealed(t *testing.T) {
+	plain, cleanup := testutil.TempStore(t)
+	defer cleanup()
+	ca := testutil.NewCA(t, "kubernetes")
+	saKey, _ := sslutil.NewPrivateKey("")
+
+	// written before encryption was enabled
+	testutil.Store(t, plain, "global/etc/kubernetes/pki/ca", ca)
+	drv := storage.NewStoreCrypt(plain, []byte("passphrase"))
+	testutil.StoreSA(t, drv, saKey, saKey)
+
+	findings, err := Execute(drv, VerifyConfig{MinValid: time.Hour})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	want := []Finding{{Path: "/etc/kubernetes/pki/ca.key", Problem: "stored unencrypted"}}
+	if !reflect.DeepEqual(findings, want) {
+		t.Errorf("Execute() findings = %v, want %v", findings, want)
+	}
+
+	testutil.Store(t, drv, "global/etc/kubernetes/pki/ca", ca)
+	if findings, err = Execute(drv, VerifyConfig{MinValid: time.Hour}); err != nil || len(findings) != 0 {
+		t.Errorf("Execute() = %v, %v after sealing, want no findings", findings, err)
+	}
+}
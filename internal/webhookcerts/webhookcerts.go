@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhookcerts
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/storage"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// WebhooksPath holds a directory per webhook: <namespace>/<service>
+	WebhooksPath = "/webhooks"
+	// DefaultCA is the dedicated webhook CA, used unless another one is given
+	DefaultCA = WebhooksPath + "/ca"
+
+	certName   = "tls"
+	secretName = "secret.yaml"
+	patchName  = "cabundle-patch.json"
+)
+
+var (
+	// TODO return value rather than use global
+	Changed = false
+
+	dnsLabelRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+	// written files, for StoredFiles
+	storedFiles []string
+)
+
+// WebhookConfig describes the webhooks to issue certs for
+type WebhookConfig struct {
+	Webhooks      []Webhook
+	ClusterDomain string
+	// CA path signing the webhook certs, either a built in CA, which must exist and is only read,
+	// or a dedicated one under WebhooksPath created as needed
+	CA string
+	// PatchWebhooks is the number of webhooks in the webhook configurations the caBundle patch covers
+	PatchWebhooks int
+}
+
+// Webhook is the service an admission webhook is served by
+type Webhook struct {
+	Service   string
+	Namespace string
+}
+
+func (w Webhook) dir() string {
+	return path.Join(WebhooksPath, w.Namespace, w.Service)
+}
+
+// Sans returns the names the webhook service is reachable by from within the cluster
+func (w Webhook) Sans(clusterDomain string) []string {
+	return []string{
+		w.Service,
+		w.Service + "." + w.Namespace,
+		w.Service + "." + w.Namespace + ".svc",
+		w.Service + "." + w.Namespace + ".svc." + clusterDomain,
+	}
+}
+
+// ParseWebhooks reads a comma separated list of <service>/<namespace>
+func ParseWebhooks(spec string) (webhooks []Webhook, err error) {
+	if spec == "" {
+		return nil, fmt.Errorf("must have at least one webhook")
+	}
+	seen := make(map[Webhook]struct{})
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, "/")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid webhook %q, format is <service>/<namespace>", entry)
+		}
+		webhook := Webhook{Service: parts[0], Namespace: parts[1]}
+		for _, name := range parts {
+			if len(name) > 63 || !dnsLabelRegexp.MatchString(name) {
+				return nil, fmt.Errorf("invalid webhook %q: %q is not a valid DNS label", entry, name)
+			}
+		}
+		if _, ok := seen[webhook]; ok {
+			return nil, fmt.Errorf("duplicate webhook %q", entry)
+		}
+		seen[webhook] = struct{}{}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, nil
+}
+
+// Templates returns the certificate templates for the webhooks, preceded by the one of the dedicated CA
+// unless an existing CA (one of knownCAs) is used
+func Templates(WebhookCfg WebhookConfig, knownCAs []string) (templates []kubecerts.CertTemplateConfig) {
+	dedicated := true
+	for _, ca := range knownCAs {
+		if ca == WebhookCfg.CA {
+			dedicated = false
+		}
+	}
+	if dedicated {
+		templates = append(templates, kubecerts.CertTemplateConfig{
+			Path:       WebhookCfg.CA,
+			CommonName: path.Base(WebhookCfg.CA),
+		})
+	}
+	for _, webhook := range WebhookCfg.Webhooks {
+		templates = append(templates, kubecerts.CertTemplateConfig{
+			Path:       path.Join(webhook.dir(), certName),
+			Parent:     WebhookCfg.CA,
+			CommonName: webhook.Service + "." + webhook.Namespace + ".svc",
+			Usages:     []string{"server"},
+			ExtraSans:  webhook.Sans(WebhookCfg.ClusterDomain),
+		})
+	}
+	return templates
+}
+
+// RenderSecret returns the kubernetes.io/tls Secret the webhook server mounts
+func RenderSecret(webhook Webhook, caPEM, certPEM, keyPEM []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "apiVersion: v1\n")
+	fmt.Fprintf(&b, "kind: Secret\n")
+	fmt.Fprintf(&b, "metadata:\n")
+	fmt.Fprintf(&b, "  name: %s-tls\n", webhook.Service)
+	fmt.Fprintf(&b, "  namespace: %s\n", webhook.Namespace)
+	fmt.Fprintf(&b, "type: kubernetes.io/tls\n")
+	fmt.Fprintf(&b, "data:\n")
+	fmt.Fprintf(&b, "  ca.crt: %s\n", base64.StdEncoding.EncodeToString(caPEM))
+	fmt.Fprintf(&b, "  tls.crt: %s\n", base64.StdEncoding.EncodeToString(certPEM))
+	fmt.Fprintf(&b, "  tls.key: %s\n", base64.StdEncoding.EncodeToString(keyPEM))
+	return b.Bytes()
+}
+
+// RenderPatch returns a JSON patch setting the caBundle of the first count webhooks of a
+// ValidatingWebhookConfiguration or MutatingWebhookConfiguration:
+// kubectl patch validatingwebhookconfiguration <name> --type=json --patch-file cabundle-patch.json
+func RenderPatch(caPEM []byte, count int) []byte {
+	var b bytes.Buffer
+	caBundle := base64.StdEncoding.EncodeToString(caPEM)
+	fmt.Fprintf(&b, "[\n")
+	for idx := 0; idx < count; idx++ {
+		separator := ","
+		if idx == count-1 {
+			separator = ""
+		}
+		fmt.Fprintf(&b, "  {\"op\": \"add\", \"path\": \"/webhooks/%d/clientConfig/caBundle\", \"value\": \"%s\"}%s\n", idx, caBundle, separator)
+	}
+	fmt.Fprintf(&b, "]\n")
+	return b.Bytes()
+}
+
+// StoredFiles returns the storage paths of the manifests written by the last Execute.
+func StoredFiles() (files []string) {
+	return storedFiles
+}
+
+// Execute issues (or checks) the webhook certs through the kubecerts pipeline, then writes
+// the TLS Secret manifest and the caBundle patch of every webhook.
+func Execute(GlobalCfg config.GlobalConfig, WebhookCfg WebhookConfig) (err error) {
+	storedFiles = nil
+	knownCA := false
+	for _, ca := range kubecerts.TemplateCAs() {
+		knownCA = knownCA || ca == WebhookCfg.CA
+	}
+	if !knownCA && !strings.HasPrefix(WebhookCfg.CA, WebhooksPath+"/") {
+		return fmt.Errorf("CA %q is neither a built in CA nor under %s", WebhookCfg.CA, WebhooksPath)
+	}
+	// a built in CA signs the cluster certs, replacing it here would leave them all signed by the old one
+	if knownCA {
+		GlobalCfg.ReadOnlyCerts = append(GlobalCfg.ReadOnlyCerts, WebhookCfg.CA)
+	}
+	err = kubecerts.ExecuteTemplates(GlobalCfg, Templates(WebhookCfg, kubecerts.TemplateCAs()))
+	if err != nil {
+		return err
+	}
+
+	caPEM, _, ok := kubecerts.StoredCert(WebhookCfg.CA)
+	if !ok {
+		return fmt.Errorf("CA %q not found", WebhookCfg.CA)
+	}
+	write := func(filePath string, content []byte) (err error) {
+		storedFiles = append(storedFiles, filePath)
+		written, err := config.CheckWrite(GlobalCfg, "", filePath, content, "")
+		Changed = Changed || written
+		return err
+	}
+	for _, webhook := range WebhookCfg.Webhooks {
+		certPEM, keyPEM, ok := kubecerts.StoredCert(path.Join(webhook.dir(), certName))
+		if !ok {
+			return fmt.Errorf("cert of webhook %s/%s not found", webhook.Service, webhook.Namespace)
+		}
+		dir := path.Join(storage.GlobalPath, webhook.dir())
+		if err = write(path.Join(dir, secretName), RenderSecret(webhook, caPEM, certPEM, keyPEM)); err != nil {
+			return err
+		}
+		if err = write(path.Join(dir, patchName), RenderPatch(caPEM, WebhookCfg.PatchWebhooks)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright (c) 2019. Stefan Kiss.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+
+package webhookcerts
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/stefan-kiss/genkubessl/internal/config"
+	"github.com/stefan-kiss/genkubessl/internal/kubecerts"
+	"github.com/stefan-kiss/genkubessl/internal/sslutil"
+	"github.com/stefan-kiss/genkubessl/internal/storage/file"
+	"github.com/stefan-kiss/genkubessl/internal/testutil"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestParseWebhooks(t *testing.T) {
+	webhooks, err := ParseWebhooks("policy/policy-system,mutator/kube-system")
+	if err != nil {
+		t.Fatalf("ParseWebhooks() error = %v", err)
+	}
+	want := []Webhook{{"policy", "policy-system"}, {"mutator", "kube-system"}}
+	if !reflect.DeepEqual(webhooks, want) {
+		t.Errorf("ParseWebhooks() = %v, want %v", webhooks, want)
+	}
+	for _, spec := range []string{"", "policy", "policy/ns/x", "Policy/ns", "policy/ns,policy/ns", "-policy/ns"} {
+		if _, err = ParseWebhooks(spec); err == nil {
+			t.Errorf("ParseWebhooks(%q) should fail", spec)
+		}
+	}
+}
+
+func TestRenderPatch(t *testing.T) {
+	var patch []map[string]string
+	if err := json.Unmarshal(RenderPatch([]byte("ca"), 2), &patch); err != nil {
+		t.Fatalf("RenderPatch() is not valid JSON: %v", err)
+	}
+	if len(patch) != 2 || patch[1]["path"] != "/webhooks/1/clientConfig/caBundle" || patch[1]["value"] != base64.StdEncoding.EncodeToString([]byte("ca")) {
+		t.Errorf("RenderPatch() = %v", patch)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "genkubessl-webhookcerts")
+	if err != nil {
+		t.Fatalf("cant create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	drv := file.NewStoreFile(tmp)
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	webhookCfg := WebhookConfig{
+		Webhooks:      []Webhook{{"policy", "policy-system"}},
+		ClusterDomain: "cluster.local",
+		CA:            DefaultCA,
+		PatchWebhooks: 1,
+	}
+	if err = Execute(cfg, webhookCfg); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	crtPEM, err := drv.Read("global/webhooks/policy-system/policy/tls.crt")
+	if err != nil {
+		t.Fatalf("webhook cert not written: %v", err)
+	}
+	keyPEM, _ := drv.Read("global/webhooks/policy-system/policy/tls.key")
+	crt, _, err := sslutil.LoadCrtAndKeyFromPEM(crtPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("LoadCrtAndKeyFromPEM() error = %v", err)
+	}
+	want := []string{"policy", "policy.policy-system", "policy.policy-system.svc", "policy.policy-system.svc.cluster.local"}
+	sort.Strings(crt.DNSNames)
+	if !reflect.DeepEqual(crt.DNSNames, want) {
+		t.Errorf("webhook cert names = %v, want %v", crt.DNSNames, want)
+	}
+	for _, name := range []string{"secret.yaml", "cabundle-patch.json"} {
+		if exists, _ := drv.Exists("global/webhooks/policy-system/policy/" + name); !exists {
+			t.Errorf("%s not written", name)
+		}
+	}
+
+	webhookCfg.CA = "/etc/somewhere/ca"
+	if err = Execute(cfg, webhookCfg); err == nil {
+		t.Errorf("Execute() should refuse a CA outside of %s", WebhooksPath)
+	}
+}
+
+func TestExecuteBuiltinCA(t *testing.T) {
+	defer kubecerts.Reset()
+	drv, cleanup := testutil.TempStore(t)
+	defer cleanup()
+	cfg := config.GlobalConfig{WriteDriver: drv, ReadDriver: drv}
+	webhookCfg := WebhookConfig{
+		Webhooks:      []Webhook{{"policy", "policy-system"}},
+		ClusterDomain: "cluster.local",
+		CA:            "/etc/kubernetes/pki/ca",
+		PatchWebhooks: 1,
+	}
+
+	// the cluster CA is never created, nor replaced, by webhookcerts
+	kubecerts.Reset()
+	if err := Execute(cfg, webhookCfg); err == nil {
+		t.Errorf("Execute() with a missing cluster CA should fail")
+	}
+	if exists, _ := drv.Exists("global/etc/kubernetes/pki/ca.crt"); exists {
+		t.Errorf("Execute() created the cluster CA")
+	}
+
+	ca := testutil.NewCA(t, "kubernetes")
+	testutil.Store(t, drv, "global/etc/kubernetes/pki/ca", ca)
+	kubecerts.Reset()
+	if err := Execute(cfg, webhookCfg); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if stored := testutil.Load(t, drv, "global/etc/kubernetes/pki/ca"); !stored.Crt.Equal(ca.Crt) {
+		t.Errorf("Execute() replaced the cluster CA")
+	}
+	webhook := testutil.Load(t, drv, "global/webhooks/policy-system/policy/tls")
+	if err := webhook.Crt.CheckSignatureFrom(ca.Crt); err != nil {
+		t.Errorf("webhook cert not signed by the cluster CA: %v", err)
+	}
+}